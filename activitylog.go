@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrg/xdg"
+	"github.com/pwiecz/go-fltk"
+)
+
+// The size that the activity log file is allowed to grow to before it's
+// rotated.
+const ACTIVITY_LOG_MAX_SIZE = 1 << 20
+
+// How many rotated activity log files are kept, as activity.log.1 (the newest)
+// up to activity.log.3 (the oldest).
+const ACTIVITY_LOG_BACKUPS = 3
+
+// How many of the latest entries the activity view shows.
+const MAX_ACTIVITY_ENTRIES = 200
+
+// The time format of activity log entries.
+const ACTIVITY_TIME_FORMAT = time.RFC3339
+
+// activityEntry is a line of the activity log.
+type activityEntry struct {
+	Time    time.Time
+	Level   slog.Level
+	Message string
+}
+
+// String returns the entry as it's written to the activity log file. Line
+// breaks in the message are replaced with spaces, so that each entry takes up
+// exactly one line. Entries without a time, such as the ones that were moved
+// from old config files, are written as only their message when they are at
+// the info level, like the lines that parseActivityEntry reads without a time.
+func (e activityEntry) String() string {
+	msg := strings.ReplaceAll(strings.TrimRight(e.Message, "\n"), "\n", " ")
+	if e.Time.IsZero() && e.Level == slog.LevelInfo {
+		return msg
+	}
+
+	return fmt.Sprintf("%v %v %v", e.Time.Format(ACTIVITY_TIME_FORMAT), e.Level, msg)
+}
+
+// parseActivityEntry parses a line of the activity log file. Lines that don't
+// start with a time are kept whole as the message, and lines without a level,
+// which older versions wrote, are at the info level.
+func parseActivityEntry(line string) activityEntry {
+	ts, rest, ok := strings.Cut(line, " ")
+	if !ok {
+		return activityEntry{Message: line}
+	}
+
+	t, err := time.Parse(ACTIVITY_TIME_FORMAT, ts)
+	if err != nil {
+		return activityEntry{Message: line}
+	}
+
+	e := activityEntry{Time: t, Level: slog.LevelInfo, Message: rest}
+
+	// levels are written in upper case, unlike the start of a message
+	name, msg, _ := strings.Cut(rest, " ")
+	var level slog.Level
+	if name == strings.ToUpper(name) && level.UnmarshalText([]byte(name)) == nil {
+		e.Level, e.Message = level, msg
+	}
+
+	return e
+}
+
+// activityLog is the file that the activity is written to, so that it's kept
+// between runs without growing forever. Once the file would grow past maxSize,
+// it's rotated: it's renamed with the suffix .1, the file that was .1 becomes
+// .2 and so on, and the file that was the oldest of the backups is deleted. It
+// is safe for concurrent use.
+type activityLog struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// openActivityLog opens the activity log at path, creating it if needed, to
+// append entries to it.
+func openActivityLog(path string, maxSize int64, backups int) (*activityLog, error) {
+	l := &activityLog{path: path, maxSize: maxSize, backups: backups}
+
+	err := l.open(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// open opens the log file with flag in addition to the flags for appending.
+// l.mu must be held, unless l isn't shared yet.
+func (l *activityLog) open(flag int) error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND|flag, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open the activity log %v: %w", l.path, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to check the activity log %v: %w", l.path, err)
+	}
+
+	l.f = f
+	l.size = info.Size()
+
+	return nil
+}
+
+// getBackupPath returns the path of the nth rotated log file, where 1 is the
+// newest.
+func (l *activityLog) getBackupPath(n int) string {
+	return fmt.Sprintf("%v.%v", l.path, n)
+}
+
+// files returns the paths of the log files, oldest first, including ones that
+// don't exist.
+func (l *activityLog) files() []string {
+	files := make([]string, 0, l.backups+1)
+	for n := l.backups; n > 0; n-- {
+		files = append(files, l.getBackupPath(n))
+	}
+
+	return append(files, l.path)
+}
+
+// Write appends an entry to the log, rotating it first if the entry doesn't
+// fit.
+func (l *activityLog) Write(e activityEntry) error {
+	warning, err := l.write(e)
+
+	// logging the warning writes to the log again, so it waits until l.mu is
+	// released. The log starts over after such a failure, so the warning
+	// doesn't cause another rotation
+	if warning != nil {
+		Warnf("%v", warning.Error())
+	}
+
+	return err
+}
+
+// write appends an entry to the log, rotating it first if the entry doesn't
+// fit. The warning is a failure to rotate the log, which write works around.
+func (l *activityLog) write(e activityEntry) (warning error, err error) {
+	line := e.String() + "\n"
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil, fmt.Errorf("the activity log %v is closed", l.path)
+	}
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		warning, err = l.rotate()
+		if err != nil {
+			return warning, err
+		}
+	}
+
+	n, err := l.f.WriteString(line)
+	l.size += int64(n)
+	if err != nil {
+		return warning, fmt.Errorf("failed to write to the activity log %v: %w", l.path, err)
+	}
+
+	return warning, nil
+}
+
+// rotate moves the log file to the first backup, shifting the existing
+// backups along and dropping the oldest one, and starts a new file. The
+// warning is about the files that couldn't be moved, while err means that the
+// new file couldn't be started. l.mu must be held.
+func (l *activityLog) rotate() (warning error, err error) {
+	l.f.Close()
+	l.f = nil
+
+	var errs []error
+	if l.backups > 0 {
+		for n := l.backups - 1; n > 0; n-- {
+			err := os.Rename(l.getBackupPath(n), l.getBackupPath(n+1))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+
+		err := os.Rename(l.path, l.getBackupPath(1))
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		warning = fmt.Errorf("failed to rotate the activity log, so it starts over: %w", errors.Join(errs...))
+	}
+
+	// if the file couldn't be moved, it starts over instead, so that it
+	// doesn't keep growing
+	return warning, l.open(os.O_TRUNC)
+}
+
+// Tail returns the last n entries of the log, oldest first, reading the
+// rotated files as needed.
+func (l *activityLog) Tail(n int) ([]activityEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	files := l.files()
+	var lines []string
+	for i := len(files) - 1; i >= 0 && len(lines) < n; i-- {
+		b, err := os.ReadFile(files[i])
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the activity log %v: %w", files[i], err)
+		}
+
+		fileLines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+		if len(b) == 0 {
+			fileLines = nil
+		}
+
+		lines = append(fileLines, lines...)
+	}
+
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	entries := make([]activityEntry, 0, len(lines))
+	for _, line := range lines {
+		entries = append(entries, parseActivityEntry(line))
+	}
+
+	return entries, nil
+}
+
+// Export writes the whole log to w, oldest entries first.
+func (l *activityLog) Export(w io.Writer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, path := range l.files() {
+		f, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the activity log %v: %w", path, err)
+		}
+
+		_, err = io.Copy(bw, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to export the activity log %v: %w", path, err)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Clear deletes every entry of the log, including the rotated files.
+func (l *activityLog) Clear() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+
+	var errs []error
+	for n := 1; n <= l.backups; n++ {
+		err := os.Remove(l.getBackupPath(n))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	errs = append(errs, l.open(os.O_TRUNC))
+
+	return errors.Join(errs...)
+}
+
+// Close closes the log file. Entries can't be written afterwards.
+func (l *activityLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+
+	err := l.f.Close()
+	l.f = nil
+
+	return err
+}
+
+// exportActivityLog writes the whole activity log to filename.
+func exportActivityLog(l *activityLog, filename string) error {
+	var b bytes.Buffer
+	err := l.Export(&b)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, b.Bytes())
+}
+
+// configActivityBreakRegexp matches the ends of the paragraphs and the line
+// breaks that separate the entries of the activity that old config files kept.
+var configActivityBreakRegexp = regexp.MustCompile(`(?i)</p\s*>|<br\s*/?>`)
+
+// htmlTagRegexp matches HTML tags.
+var htmlTagRegexp = regexp.MustCompile(`<[^>]*>`)
+
+// parseConfigActivity returns the entries of the activity that config files
+// before version 2 kept, which was the HTML of the activity view with a
+// paragraph for each entry, after the placeholder that the view started with.
+// The entries are kept as plain text, and they don't have a time, since it
+// wasn't kept.
+func parseConfigActivity(old string) []activityEntry {
+	placeholder := htmlTagRegexp.ReplaceAllString(ACTIVITY_PLACEHOLDER, "")
+
+	var entries []activityEntry
+	for _, p := range configActivityBreakRegexp.Split(old, -1) {
+		msg := strings.TrimSpace(html.UnescapeString(htmlTagRegexp.ReplaceAllString(p, "")))
+		if msg == "" || msg == placeholder {
+			continue
+		}
+
+		entries = append(entries, activityEntry{Level: slog.LevelInfo, Message: msg})
+	}
+
+	return entries
+}
+
+// importConfigActivity writes the activity that old config files kept to the
+// activity log, so that it isn't lost when the config file is upgraded.
+func importConfigActivity(old string) {
+	entries := parseConfigActivity(old)
+	if len(entries) == 0 {
+		return
+	}
+
+	if activityStore == nil {
+		Warnf("the activity log isn't open, so the activity from the config file is only kept in the config file's backup")
+		return
+	}
+
+	for _, e := range entries {
+		err := activityStore.Write(e)
+		if err != nil {
+			Warnf("failed to move the activity from the config file to the activity log: %v", err.Error())
+			return
+		}
+	}
+}
+
+// openActivityStore opens the activity log file in the XDG state directory as
+// activityStore.
+func openActivityStore() {
+	path, err := xdg.StateFile("go-fltk-sane/activity.log")
+	if err != nil {
+		Warnf("failed to locate the activity log, activity won't be kept: %v", err.Error())
+		return
+	}
+
+	l, err := openActivityLog(path, ACTIVITY_LOG_MAX_SIZE, ACTIVITY_LOG_BACKUPS)
+	if err != nil {
+		Warnf("failed to open the activity log, activity won't be kept: %v", err.Error())
+		return
+	}
+
+	activityStore = l
+}
+
+// loadActivity shows the latest entries of the activity log file in the
+// activity view.
+func loadActivity() {
+	if activityStore == nil {
+		return
+	}
+
+	entries, err := activityStore.Tail(MAX_ACTIVITY_ENTRIES)
+
+	rendered := make([]string, 0, len(entries))
+	for _, e := range entries {
+		rendered = append(rendered, renderActivityEntry(e))
+	}
+
+	// anything that was logged before the activity log was read, such as
+	// problems with the config file, is kept after the entries of earlier runs
+	activityMu.Lock()
+	rendered = append(rendered, activityEntries...)
+	activityMu.Unlock()
+	if len(rendered) > MAX_ACTIVITY_ENTRIES {
+		rendered = rendered[len(rendered)-MAX_ACTIVITY_ENTRIES:]
+	}
+	setActivityEntries(rendered)
+
+	if err != nil {
+		Warnf("failed to read the activity log: %v", err.Error())
+	}
+}
+
+// clearActivity deletes the activity log, including the rotated files, and
+// empties the activity view, once the user confirms it.
+func clearActivity() {
+	if fltk.ChoiceDialog("Clear the activity log? This deletes all of it, not only what is shown.", "Clear", "Cancel") != 0 {
+		return
+	}
+
+	if activityStore != nil {
+		err := activityStore.Clear()
+		if err != nil {
+			fltk.MessageBox("Error", fmt.Sprintf("Unable to clear the activity log: %v", err.Error()))
+		}
+	}
+
+	setActivityEntries(nil)
+	activity.SetValue(getActivityText())
+}
+
+// exportActivity asks for a file and writes the whole activity log to it.
+func exportActivity() {
+	if activityStore == nil {
+		fltk.MessageBox("Error", "There is no activity log to export, since it couldn't be opened.")
+		return
+	}
+
+	fc := fltk.NewNativeFileChooser()
+	defer fc.Destroy()
+	fc.SetOptions(fltk.NativeFileChooser_SAVEAS_CONFIRM | fltk.NativeFileChooser_NEW_FOLDER)
+	fc.SetType(fltk.NativeFileChooser_BROWSE_SAVE_FILE)
+	fc.SetTitle("Export the activity log")
+	fc.SetPresetFile("go-fltk-sane-activity.log")
+	fc.Show()
+
+	names := fc.Filenames()
+	if len(names) == 0 {
+		return
+	}
+
+	err := exportActivityLog(activityStore, names[0])
+	if err != nil {
+		fltk.MessageBox("Error", fmt.Sprintf("Unable to export the activity log: %v", err.Error()))
+		return
+	}
+
+	Logf("exported the activity log to %v", names[0])
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActivityEntry(t *testing.T) {
+	when := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+
+	line := activityEntry{Time: when, Level: slog.LevelError, Message: "scanimage failed:\nno device\n"}.String()
+	if line != "2026-10-16T09:30:00Z ERROR scanimage failed: no device" {
+		t.Errorf("got %q", line)
+	}
+
+	e := parseActivityEntry(line)
+	if !e.Time.Equal(when) || e.Level != slog.LevelError || e.Message != "scanimage failed: no device" {
+		t.Errorf("parse: got %+v", e)
+	}
+
+	// entries without a time, which were moved from old config files
+	line = activityEntry{Message: "scanning to /scans/a.png..."}.String()
+	if line != "scanning to /scans/a.png..." {
+		t.Errorf("without a time: got %q", line)
+	}
+
+	tests := []struct {
+		line    string
+		level   slog.Level
+		message string
+	}{
+		{line: "2026-10-16T09:30:00Z WARN skipped a setting", level: slog.LevelWarn, message: "skipped a setting"},
+		{line: "2026-10-16T09:30:00Z DEBUG-2 running scanimage", level: slog.LevelDebug - 2, message: "running scanimage"},
+		// entries that were written without a level
+		{line: "2026-10-16T09:30:00Z scanning to /scans/doc.pdf...", level: slog.LevelInfo, message: "scanning to /scans/doc.pdf..."},
+		{line: "2026-10-16T09:30:00Z error isn't a level here", level: slog.LevelInfo, message: "error isn't a level here"},
+		{line: "<p>not an entry</p>", message: "<p>not an entry</p>"},
+	}
+
+	for _, test := range tests {
+		e := parseActivityEntry(test.line)
+		if e.Level != test.level || e.Message != test.message {
+			t.Errorf("%q: got %+v", test.line, e)
+		}
+	}
+}
+
+func TestActivityLogRotateFails(t *testing.T) {
+	useActivityEntries(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "activity.log")
+
+	// the log can't be moved over a directory that isn't empty
+	if err := os.MkdirAll(filepath.Join(path+".1", "taken"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := openActivityLog(path, 40, 1)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer l.Close()
+
+	when := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+	for _, msg := range []string{"entry 00", "entry 01"} {
+		if err := l.Write(activityEntry{Time: when, Message: msg}); err != nil {
+			t.Fatalf("failed to write %v: %v", msg, err)
+		}
+	}
+
+	if got := getActivityText(); !strings.Contains(got, "failed to rotate the activity log") {
+		t.Errorf("the failure wasn't logged: %v", got)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil || string(b) != "2026-10-16T09:30:00Z INFO entry 01\n" {
+		t.Errorf("the log didn't start over: %q, %v", b, err)
+	}
+}
+
+func TestActivityLogRotates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "activity.log")
+	when := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+
+	// each entry is 35 bytes with its line break, so two fit in a file
+	l, err := openActivityLog(path, 100, 2)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 11; i++ {
+		err := l.Write(activityEntry{Time: when, Message: fmt.Sprintf("entry %02d", i)})
+		if err != nil {
+			t.Fatalf("failed to write entry %v: %v", i, err)
+		}
+	}
+
+	for _, name := range []string{"activity.log", "activity.log.1", "activity.log.2"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil || info.Size() > 100 {
+			t.Errorf("%v: unexpected file: %v", name, err)
+		}
+	}
+	if fileExists(path + ".3") {
+		t.Errorf("more backups were kept than asked for")
+	}
+
+	entries, err := l.Tail(4)
+	if err != nil {
+		t.Fatalf("tail: %v", err)
+	}
+	msgs := []string{}
+	for _, e := range entries {
+		msgs = append(msgs, e.Message)
+	}
+	if strings.Join(msgs, ",") != "entry 07,entry 08,entry 09,entry 10" {
+		t.Errorf("tail: got %v", msgs)
+	}
+
+	var b bytes.Buffer
+	if err := l.Export(&b); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	// the six oldest entries were rotated away
+	if len(lines) != 5 || !strings.HasSuffix(lines[0], "entry 06") || !strings.HasSuffix(lines[4], "entry 10") {
+		t.Errorf("export: got %q", lines)
+	}
+
+	// reopening appends to the existing file
+	l.Close()
+	l, err = openActivityLog(path, 100, 2)
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer l.Close()
+	if err := l.Write(activityEntry{Time: when, Message: "entry 11"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ = l.Tail(1)
+	if len(entries) != 1 || entries[0].Message != "entry 11" {
+		t.Errorf("reopen: got %+v", entries)
+	}
+}
+
+func TestActivityLogClear(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "activity.log")
+
+	l, err := openActivityLog(path, 50, 2)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 5; i++ {
+		l.Write(activityEntry{Time: time.Now(), Message: "some activity"})
+	}
+
+	if err := l.Clear(); err != nil {
+		t.Fatalf("clear: %v", err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("expected only the empty log to be left: %v", entries)
+	}
+	if tail, _ := l.Tail(10); len(tail) != 0 {
+		t.Errorf("expected no entries, got %+v", tail)
+	}
+
+	// it can still be written to afterwards
+	if err := l.Write(activityEntry{Time: time.Now(), Message: "after"}); err != nil {
+		t.Errorf("write after clear: %v", err)
+	}
+
+	exported := filepath.Join(dir, "export.log")
+	if err := exportActivityLog(l, exported); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	b, _ := os.ReadFile(exported)
+	if !strings.HasSuffix(string(b), " after\n") || strings.Count(string(b), "\n") != 1 {
+		t.Errorf("export: got %q", b)
+	}
+}
@@ -0,0 +1,749 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The environment variable that the token of the HTTP API can be provided
+// with, instead of the one in the config file.
+const API_TOKEN_ENV = "GO_FLTK_SANE_API_TOKEN"
+
+// The most that the body of a request to the HTTP API may contain.
+const MAX_API_REQUEST_SIZE = 1 << 20
+
+// apiScan is what the HTTP API keeps track of for the scans that were started
+// through it. It's guarded by the mutex of the apiServer.
+type apiScan struct {
+	Request  scanRequest
+	Result   scanResult
+	Progress ScanProgress
+}
+
+// apiServer serves the HTTP API, which lists devices, reads and changes their
+// settings, and scans with them, using the same jobs and config as the
+// graphical interface. Each request needs the token, as a bearer token.
+type apiServer struct {
+	token string
+	// withConfig runs fn with sole access to appConf and the other state of
+	// the app, such as pendingOutputs, and waits for it to return.
+	withConfig func(fn func())
+	// configChanged is called with access to the config once the API changed
+	// it, to save it.
+	configChanged func()
+	// settingsChanged (if not nil) is called with access to the config once
+	// the settings of dev were changed, so that they can be shown.
+	settingsChanged func(dev string)
+	// fileScanned (if not nil) is called from the scan job as each file of a
+	// scan is written.
+	fileScanned func(filename string)
+
+	// The server that serves the API, once startAPIServer started it.
+	srv *http.Server
+	// Set once the server is shutting down, after which no more scans are
+	// queued.
+	closing atomic.Bool
+
+	mu    sync.Mutex
+	scans map[int]*apiScan
+}
+
+// newAPIServer returns an apiServer for when there is no graphical interface,
+// which guards the config with a mutex and saves it right away.
+func newAPIServer(token string) *apiServer {
+	var mu sync.Mutex
+
+	return &apiServer{
+		token: token,
+		withConfig: func(fn func()) {
+			mu.Lock()
+			defer mu.Unlock()
+			fn()
+		},
+		configChanged: saveConfig,
+		scans:         make(map[int]*apiScan),
+	}
+}
+
+// newGUIAPIServer returns an apiServer that hands its access to the config
+// over to the UI thread, and shows what it changes in the graphical
+// interface.
+func newGUIAPIServer(token string) *apiServer {
+	s := newAPIServer(token)
+	s.withConfig = callOnUI
+	s.configChanged = requestConfigSave
+	s.settingsChanged = func(dev string) {
+		if dev != appConf.Device {
+			return
+		}
+
+		rebuildOptionsPanel()
+		requestDeviceOptionsRefresh()
+		updateFilenamePreview()
+	}
+	s.fileScanned = func(filename string) {
+		onUI(func() {
+			addScannedFile(filename, nil)
+		})
+	}
+
+	return s
+}
+
+// getAPIToken returns the token of the HTTP API: the one from API_TOKEN_ENV
+// if it's set, or else the one from the config file. If there isn't one yet,
+// a random token is created and kept in the config file. The second return
+// value is true if the token was created.
+func getAPIToken() (string, bool, error) {
+	if token := os.Getenv(API_TOKEN_ENV); token != "" {
+		return token, false, nil
+	}
+
+	if appConf.APIToken != "" {
+		return appConf.APIToken, false, nil
+	}
+
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to create a token for the HTTP API: %w", err)
+	}
+
+	appConf.APIToken = hex.EncodeToString(b)
+
+	return appConf.APIToken, true, nil
+}
+
+// setupAPIToken returns the token of the HTTP API, saving it to the config
+// file if it was just created, and tells w where the token can be found. The
+// token itself is only written to w if it couldn't be saved. It must have sole
+// access to the config.
+func setupAPIToken(w io.Writer) (string, error) {
+	token, created, err := getAPIToken()
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case !created && appConf.APIToken != token:
+		fmt.Fprintf(w, "the HTTP API uses the token from %v\n", API_TOKEN_ENV)
+	case created:
+		saveConfig()
+		if configFilePath == "" || savedConfig.path != configFilePath || !bytes.Contains(savedConfig.b, []byte(token)) {
+			fmt.Fprintf(w, "the token of the HTTP API couldn't be saved; for this run, it's %v\n", token)
+			break
+		}
+		fmt.Fprintf(w, "created a token for the HTTP API, which is the apitoken in %v\n", configFilePath)
+	default:
+		fmt.Fprintf(w, "the token of the HTTP API is the apitoken in %v\n", configFilePath)
+	}
+
+	return token, nil
+}
+
+// startGUIAPIServer serves the HTTP API on addr alongside the graphical
+// interface. It must be called from the UI thread.
+func startGUIAPIServer(addr string) (*apiServer, error) {
+	token, err := setupAPIToken(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newGUIAPIServer(token)
+	err = startAPIServer(addr, s)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// isLoopbackAddr returns true if the listen address, such as
+// "127.0.0.1:8080", only accepts connections from this machine.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// Handler returns the handler of the API's endpoints.
+func (s *apiServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/devices", s.listDevices)
+	mux.HandleFunc("GET /api/devices/{device}/options", s.getOptions)
+	mux.HandleFunc("PATCH /api/devices/{device}/settings", s.setSettings)
+	mux.HandleFunc("GET /api/scans", s.listScans)
+	mux.HandleFunc("POST /api/scans", s.startScan)
+	mux.HandleFunc("GET /api/scans/{id}", s.getScan)
+	mux.HandleFunc("DELETE /api/scans/{id}", s.cancelScan)
+	mux.HandleFunc("GET /api/scans/{id}/file", s.downloadScan)
+
+	return s.authenticate(mux)
+}
+
+// authenticate only lets requests with the token through to next.
+func (s *apiServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Debugf("HTTP API: %v %v from %v", r.Method, r.URL.Path, r.RemoteAddr)
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-fltk-sane"`)
+			writeAPIError(w, http.StatusUnauthorized, errors.New("a valid token is needed"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeAPIJSON responds with v as JSON.
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	writeJSON(w, v)
+}
+
+// writeAPIError responds with the error as JSON, such as
+// {"Error": "unknown scan 3"}.
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIJSON(w, status, struct{ Error string }{err.Error()})
+}
+
+// readAPIJSON decodes the body of the request into v. Unknown fields are
+// rejected, so that misspelled ones don't go unnoticed.
+func readAPIJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_API_REQUEST_SIZE))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+	if err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+
+	return nil
+}
+
+func (s *apiServer) listDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := backend.ListDevices()
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, fmt.Errorf("failed to get devices: %w", err))
+		return
+	}
+
+	s.withConfig(func() {
+		appConf.Scanners = devices
+		s.configChanged()
+	})
+
+	writeAPIJSON(w, http.StatusOK, devices)
+}
+
+// apiOptions are the options of a device, along with the settings that are
+// used for it.
+type apiOptions struct {
+	Device   string
+	Options  []DeviceOption
+	Settings map[string]string
+}
+
+func (s *apiServer) getOptions(w http.ResponseWriter, r *http.Request) {
+	dev := r.PathValue("device")
+
+	var settings map[string]string
+	s.withConfig(func() {
+		settings = cliSettings(dev, nil)
+	})
+
+	opts, err := backend.DescribeOptions(dev, settings)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, fmt.Errorf("failed to get options for %v: %w", dev, err))
+		return
+	}
+
+	writeAPIJSON(w, http.StatusOK, apiOptions{Device: dev, Options: opts, Settings: settings})
+}
+
+// setSettings changes the settings of a device, such as {"resolution":
+// "300"}, and responds with all of its settings. Empty values go back to the
+// device's default.
+func (s *apiServer) setSettings(w http.ResponseWriter, r *http.Request) {
+	dev := r.PathValue("device")
+
+	var changes map[string]string
+	err := readAPIJSON(w, r, &changes)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var settings map[string]string
+	s.withConfig(func() {
+		settings = cliSettings(dev, nil)
+	})
+
+	updates := make(map[string]string)
+	for name, value := range changes {
+		if value == "" {
+			delete(settings, name)
+		} else {
+			settings[name] = value
+			updates[name] = value
+		}
+	}
+
+	opts, err := backend.DescribeOptions(dev, settings)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, fmt.Errorf("failed to get options for %v: %w", dev, err))
+		return
+	}
+
+	err = validateSettings(opts, updates)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.withConfig(func() {
+		// the settings may have changed in the meantime, so only the
+		// changes are applied to them
+		current := cliSettings(dev, nil)
+		for name, value := range changes {
+			if value == "" {
+				delete(current, name)
+			} else {
+				current[name] = value
+			}
+		}
+
+		if dev == appConf.Device {
+			appConf.DeviceSettings = current
+		} else {
+			if appConf.Devices == nil {
+				appConf.Devices = make(map[string]deviceState)
+			}
+			state := appConf.Devices[dev]
+			state.Settings = current
+			appConf.Devices[dev] = state
+		}
+		settings = maps.Clone(current)
+
+		Logf("the HTTP API changed the settings of %v", dev)
+		s.configChanged()
+		if s.settingsChanged != nil {
+			s.settingsChanged(dev)
+		}
+	})
+
+	writeAPIJSON(w, http.StatusOK, settings)
+}
+
+// apiScanRequest is the body of a request to start a scan. Each of the fields
+// is optional, and defaults to what is configured, like the flags of the scan
+// command.
+type apiScanRequest struct {
+	Device string
+	// Settings for this scan only, in addition to the device's settings.
+	Settings map[string]string
+	// The filename template, such as "receipt-{date}.pdf".
+	Filename  string
+	Label     *string
+	Batch     *bool
+	PageSize  *string
+	AppendPDF *bool
+	// One of collisionPolicies. Since there is no one to ask, "prompt" fails
+	// the request if the file already exists.
+	Collision string
+}
+
+// apiJob is the status of a scan job, as the API reports it.
+type apiJob struct {
+	ID       int
+	Name     string
+	State    JobState
+	Error    string `json:",omitempty"`
+	Queued   time.Time
+	Started  time.Time
+	Finished time.Time
+	// The progress of the page that is being scanned.
+	Page    int     `json:",omitempty"`
+	Percent float64 `json:",omitempty"`
+	// The document or image that was written, which can be downloaded, and
+	// the pages of batch scans.
+	File  string   `json:",omitempty"`
+	Pages []string `json:",omitempty"`
+}
+
+// getAPIJob returns the status of the job, along with what's known about it
+// if it was started through the API.
+func (s *apiServer) getAPIJob(job ScanJob) apiJob {
+	j := apiJob{ID: job.ID, Name: job.Name, State: job.State, Queued: job.Queued, Started: job.Started, Finished: job.Finished}
+	if job.Err != nil {
+		j.Error = job.Err.Error()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scan, ok := s.scans[job.ID]
+	if ok {
+		j.Page, j.Percent = scan.Progress.Page, scan.Progress.Percent
+		j.File, j.Pages = scan.Result.File, scan.Result.Pages
+	}
+
+	return j
+}
+
+// getJob returns the job with the ID in the request's path.
+func (s *apiServer) getJob(r *http.Request) (ScanJob, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return ScanJob{}, fmt.Errorf("unknown scan %v", r.PathValue("id"))
+	}
+
+	for _, job := range jobs.Jobs() {
+		if job.ID == id {
+			return job, nil
+		}
+	}
+
+	return ScanJob{}, fmt.Errorf("unknown scan %v", id)
+}
+
+func (s *apiServer) listScans(w http.ResponseWriter, r *http.Request) {
+	all := jobs.Jobs()
+	list := make([]apiJob, 0, len(all))
+	for _, job := range all {
+		list = append(list, s.getAPIJob(job))
+	}
+
+	writeAPIJSON(w, http.StatusOK, list)
+}
+
+func (s *apiServer) getScan(w http.ResponseWriter, r *http.Request) {
+	job, err := s.getJob(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+
+	writeAPIJSON(w, http.StatusOK, s.getAPIJob(job))
+}
+
+func (s *apiServer) cancelScan(w http.ResponseWriter, r *http.Request) {
+	job, err := s.getJob(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+
+	err = jobs.Cancel(job.ID)
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, err)
+		return
+	}
+
+	Logf("the HTTP API cancelled scan #%v", job.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startScan queues a scan, and responds with its job. The scan happens in the
+// background; its status can be polled at the job's Location.
+func (s *apiServer) startScan(w http.ResponseWriter, r *http.Request) {
+	var body apiScanRequest
+	err := readAPIJSON(w, r, &body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// the choices that weren't made in the request are taken from the
+	// config, like the scan command does
+	var dev, tmpl, dir, label, pageSize, collision string
+	var batch, appendPDF bool
+	var settings map[string]string
+	s.withConfig(func() {
+		dev, tmpl, dir, label = appConf.Device, appConf.FilenameTemplate, appConf.SelectedDir, appConf.FilenameLabel
+		pageSize, collision = appConf.PDFPageSize, getCollisionPolicy(appConf.CollisionPolicy)
+		batch, appendPDF = appConf.BatchScan, appConf.AppendPDF
+		if body.Device != "" {
+			dev = body.Device
+		}
+		settings = cliSettings(dev, body.Settings)
+	})
+
+	if body.Filename != "" {
+		tmpl = body.Filename
+	}
+	if tmpl == "" {
+		tmpl = DEFAULT_FILENAME_TEMPLATE
+	}
+	if dir == "" {
+		writeAPIError(w, http.StatusConflict, errors.New("an output directory has not been chosen"))
+		return
+	}
+	if body.Label != nil {
+		label = *body.Label
+	}
+	if body.PageSize != nil {
+		pageSize = *body.PageSize
+	}
+	if body.Collision != "" {
+		collision = body.Collision
+	}
+	if body.Batch != nil {
+		batch = *body.Batch
+	}
+	if body.AppendPDF != nil {
+		appendPDF = *body.AppendPDF
+	}
+
+	if dev == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("a device was not provided and none is configured"))
+		return
+	}
+
+	err = checkScanChoices(tmpl, pageSize, collision)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	opts, err := getScanOptions(dev, settings, body.Settings, batch || getFileType(tmpl) == ".pdf")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// the file names and the counter are worked out along with queueing the
+	// scan, so that other scans don't pick the same names in the meantime
+	var job ScanJob
+	var status int
+	s.withConfig(func() {
+		if s.closing.Load() {
+			status, err = http.StatusServiceUnavailable, errors.New("the HTTP API is shutting down")
+			return
+		}
+
+		vars := getTemplateVars(time.Now(), dev, appConf.Scanners, opts, settings, max(appConf.FilenameCounter, 1), label)
+		var filename, pattern string
+		filename, pattern, err = scanFilenames(tmpl, dir, vars, batch)
+		if err != nil {
+			status, err = http.StatusBadRequest, fmt.Errorf("invalid filename template: %w", err)
+			return
+		}
+
+		req := scanRequest{
+			Filename:    filename,
+			PagePattern: pattern,
+			Device:      dev,
+			Settings:    settings,
+			Layout:      pdfLayout{DPI: getScanResolution(opts, settings), PageSize: pageSize},
+			Batch:       batch,
+			AppendPDF:   appendPDF,
+		}
+
+		req, err = applyCollisionPolicy(req, collision, isOutputTaken)
+		if err != nil {
+			status = http.StatusConflict
+			return
+		}
+
+		job, err = s.submitScan(req)
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			return
+		}
+
+		pendingOutputs[job.ID] = getScanOutputs(req)
+		Logf("the HTTP API queued scan #%v to %v", job.ID, req.Filename)
+
+		if next := nextFilenameCounter(tmpl, vars.Counter); next != vars.Counter {
+			appConf.FilenameCounter = next
+			s.configChanged()
+		}
+	})
+	if err != nil {
+		writeAPIError(w, status, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/scans/%v", job.ID))
+	writeAPIJSON(w, http.StatusAccepted, s.getAPIJob(job))
+}
+
+// submitScan queues the scan, keeping track of its progress and result for
+// the API.
+func (s *apiServer) submitScan(req scanRequest) (ScanJob, error) {
+	scan := &apiScan{Request: req}
+
+	job, err := jobs.Submit(req.Filename, func(ctx context.Context) error {
+		Logf("scanning to %v...", req.Filename)
+
+		onFile := func(filename string) {
+			if s.fileScanned != nil {
+				s.fileScanned(filename)
+			}
+		}
+
+		result, err := performScan(ctx, req, func(page int, filename string) {
+			Logf("scanned page %v to %v", page, filename)
+			onFile(filename)
+		}, func(p ScanProgress) {
+			s.mu.Lock()
+			scan.Progress = p
+			s.mu.Unlock()
+		})
+
+		s.mu.Lock()
+		scan.Result = result
+		s.mu.Unlock()
+
+		if result.Output != "" {
+			Log(result.Output)
+		}
+		if ctx.Err() != nil {
+			Logf("cancelled scan to %v", req.Filename)
+			return ctx.Err()
+		}
+		if err != nil {
+			Errorf("failed to scan to %v: %v", req.Filename, err.Error())
+			return err
+		}
+
+		Logf("successfully wrote scanned image/document to %v", result.File)
+		onFile(result.File)
+
+		return nil
+	})
+	if err != nil {
+		return job, err
+	}
+
+	s.mu.Lock()
+	s.scans[job.ID] = scan
+	s.mu.Unlock()
+
+	return job, nil
+}
+
+// downloadScan responds with the document or image that a scan wrote, or with
+// one of the pages of a batch scan if the page query parameter is provided,
+// such as ?page=2. Only the files of scans that were started through the API
+// can be downloaded.
+func (s *apiServer) downloadScan(w http.ResponseWriter, r *http.Request) {
+	job, err := s.getJob(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+
+	s.mu.Lock()
+	scan, ok := s.scans[job.ID]
+	var result scanResult
+	if ok {
+		result = scan.Result
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("scan %v wasn't started through the HTTP API", job.ID))
+		return
+	}
+
+	path := result.File
+	if page := r.URL.Query().Get("page"); page != "" {
+		n, err := strconv.Atoi(page)
+		if err != nil || n < 1 || n > len(result.Pages) {
+			writeAPIError(w, http.StatusNotFound, fmt.Errorf("scan %v has no page %v", job.ID, page))
+			return
+		}
+		path = result.Pages[n-1]
+	} else if job.State != JobSucceeded {
+		writeAPIError(w, http.StatusConflict, fmt.Errorf("scan %v has %v", job.ID, job.State))
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		writeAPIError(w, http.StatusGone, fmt.Errorf("the file of scan %v is gone: %w", job.ID, err))
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+}
+
+// startAPIServer serves the API on addr in the background. Failing to listen
+// is returned right away, and the server can be stopped with Shutdown.
+func startAPIServer(addr string, s *apiServer) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %v: %w", addr, err)
+	}
+
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.srv = srv
+
+	if !isLoopbackAddr(addr) {
+		Warnf("the HTTP API accepts connections from other machines on %v, without encryption, so the token can be seen by others on the network", addr)
+	}
+	Logf("the HTTP API is listening on http://%v/api/", l.Addr())
+
+	go func() {
+		err := srv.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			Errorf("the HTTP API stopped: %v", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown stops the server from accepting connections, and waits for the
+// requests that are being handled to finish. Requests that still get to
+// withConfig in the meantime don't queue scans. Since the requests may wait
+// for the UI thread, it must not be called from it.
+func (s *apiServer) Shutdown(ctx context.Context) error {
+	s.closing.Store(true)
+	if s.srv == nil {
+		return nil
+	}
+
+	return s.srv.Shutdown(ctx)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useAPIServer starts the HTTP API with the fake scanimage in mode, using a
+// job manager of its own and a config with a device and directory chosen,
+// and returns the server's URL.
+func useAPIServer(t *testing.T, mode string) string {
+	t.Helper()
+
+	useFakeBackend(t, mode)
+	useConfigFile(t, "")
+	appConf.Device = "brother5:bus2;dev1"
+	appConf.SelectedDir = t.TempDir()
+
+	oldJobs := jobs
+	jobs = NewJobManager(nil)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), COMMAND_WAIT_DELAY*2)
+		defer cancel()
+		jobs.Close(ctx)
+		jobs = oldJobs
+	})
+
+	srv := httptest.NewServer(newAPIServer("secret").Handler())
+	t.Cleanup(srv.Close)
+
+	return srv.URL
+}
+
+// callAPI makes a request to the HTTP API with the token, decoding the
+// response into v if it's not nil, and returns the response's status.
+func callAPI(t *testing.T, method, url, body string, v any) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%v %v: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		err = json.NewDecoder(resp.Body).Decode(v)
+		if err != nil {
+			t.Fatalf("%v %v: failed to decode the response: %v", method, url, err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+// waitForScan polls the scan until it's done, and returns it.
+func waitForScan(t *testing.T, url string, id int) apiJob {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var job apiJob
+		if status := callAPI(t, "GET", url+"/api/scans/"+strconv.Itoa(id), "", &job); status != http.StatusOK {
+			t.Fatalf("get scan: got status %v", status)
+		}
+		if job.State.Done() {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the scan is still %v", job.State)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestAPIAuthentication(t *testing.T) {
+	url := useAPIServer(t, "")
+
+	for _, header := range []string{"", "Bearer wrong", "secret", "Basic secret"} {
+		req, _ := http.NewRequest("GET", url+"/api/devices", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%q: got status %v", header, resp.StatusCode)
+		}
+	}
+
+	if status := callAPI(t, "GET", url+"/api/devices", "", nil); status != http.StatusOK {
+		t.Errorf("with the token: got status %v", status)
+	}
+}
+
+func TestAPIDevices(t *testing.T) {
+	url := useAPIServer(t, "")
+
+	var devices []ScannerDevice
+	if status := callAPI(t, "GET", url+"/api/devices", "", &devices); status != http.StatusOK {
+		t.Fatalf("got status %v", status)
+	}
+	if len(devices) != 2 || devices[0].Device != "brother5:bus2;dev1" {
+		t.Errorf("unexpected devices: %v", devices)
+	}
+
+	var opts apiOptions
+	if status := callAPI(t, "GET", url+"/api/devices/brother5:bus2;dev1/options", "", &opts); status != http.StatusOK {
+		t.Fatalf("options: got status %v", status)
+	}
+	if opts.Device != "brother5:bus2;dev1" || len(opts.Options) == 0 {
+		t.Errorf("unexpected options: %+v", opts)
+	}
+}
+
+func TestAPISettings(t *testing.T) {
+	url := useAPIServer(t, "")
+	settingsURL := url + "/api/devices/brother5:bus2;dev1/settings"
+
+	var settings map[string]string
+	if status := callAPI(t, "PATCH", settingsURL, `{"resolution": "300"}`, &settings); status != http.StatusOK {
+		t.Fatalf("got status %v", status)
+	}
+	if settings["resolution"] != "300" || appConf.DeviceSettings["resolution"] != "300" {
+		t.Errorf("the setting wasn't applied: %v, %v", settings, appConf.DeviceSettings)
+	}
+
+	for _, body := range []string{`{"resolution": "301"}`, `{"nonexistent": "1"}`, `{"resolution": 300}`, `not json`} {
+		if status := callAPI(t, "PATCH", settingsURL, body, nil); status != http.StatusBadRequest {
+			t.Errorf("%v: got status %v, wanted %v", body, status, http.StatusBadRequest)
+		}
+	}
+	if appConf.DeviceSettings["resolution"] != "300" {
+		t.Errorf("an invalid setting was applied: %v", appConf.DeviceSettings)
+	}
+
+	// other devices keep their own settings, and empty values remove them
+	otherURL := url + "/api/devices/other/settings"
+	appConf.Devices = map[string]deviceState{"other": {Settings: map[string]string{"mode": "Color"}}}
+	callAPI(t, "PATCH", otherURL, `{"resolution": "300"}`, nil)
+	settings = nil
+	callAPI(t, "PATCH", otherURL, `{"resolution": ""}`, &settings)
+	if _, ok := settings["resolution"]; ok || appConf.Devices["other"].Settings["resolution"] != "" || appConf.Devices["other"].Settings["mode"] != "Color" {
+		t.Errorf("unexpected settings of the other device: %v, %v", settings, appConf.Devices["other"].Settings)
+	}
+}
+
+func TestAPIScan(t *testing.T) {
+	url := useAPIServer(t, "")
+	dir := appConf.SelectedDir
+
+	req, _ := http.NewRequest("POST", url+"/api/scans", strings.NewReader(`{"Filename": "receipt-{counter}.png", "Settings": {"resolution": "300"}}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job apiJob
+	json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("got status %v: %+v", resp.StatusCode, job)
+	}
+	if resp.Header.Get("Location") != "/api/scans/"+strconv.Itoa(job.ID) {
+		t.Errorf("unexpected location %q", resp.Header.Get("Location"))
+	}
+	if appConf.FilenameCounter != 2 {
+		t.Errorf("the counter didn't go up: %v", appConf.FilenameCounter)
+	}
+
+	job = waitForScan(t, url, job.ID)
+	if job.State != JobSucceeded || job.File != filepath.Join(dir, "receipt-1.png") {
+		t.Fatalf("unexpected scan: %+v", job)
+	}
+
+	var list []apiJob
+	callAPI(t, "GET", url+"/api/scans", "", &list)
+	if len(list) != 1 || list[0].ID != job.ID {
+		t.Errorf("unexpected scans: %+v", list)
+	}
+
+	req, _ = http.NewRequest("GET", url+"/api/scans/"+strconv.Itoa(job.ID)+"/file", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	want, _ := os.ReadFile(job.File)
+	if resp.StatusCode != http.StatusOK || len(want) == 0 || !bytes.Equal(got, want) {
+		t.Errorf("download: got status %v and %v bytes, wanted %v bytes", resp.StatusCode, len(got), len(want))
+	}
+	if !strings.Contains(resp.Header.Get("Content-Disposition"), "receipt-1.png") {
+		t.Errorf("unexpected content disposition %q", resp.Header.Get("Content-Disposition"))
+	}
+
+	for _, path := range []string{"/api/scans/99", "/api/scans/bogus", "/api/scans/99/file", "/api/scans/" + strconv.Itoa(job.ID) + "/file?page=2"} {
+		if status := callAPI(t, "GET", url+path, "", nil); status != http.StatusNotFound {
+			t.Errorf("%v: got status %v, wanted %v", path, status, http.StatusNotFound)
+		}
+	}
+
+	// a file that's taken can't be asked about
+	if status := callAPI(t, "POST", url+"/api/scans", `{"Filename": "receipt-1.png", "Collision": "prompt"}`, nil); status != http.StatusConflict {
+		t.Errorf("prompt: got status %v, wanted %v", status, http.StatusConflict)
+	}
+
+	for _, body := range []string{`{"Filename": "scan.tiff"}`, `{"Collision": "explode"}`, `{"Settings": {"resolution": "301"}}`, `{"Colour": "red"}`} {
+		if status := callAPI(t, "POST", url+"/api/scans", body, nil); status != http.StatusBadRequest {
+			t.Errorf("%v: got status %v, wanted %v", body, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAPICancelScan(t *testing.T) {
+	url := useAPIServer(t, "slow")
+
+	var job apiJob
+	if status := callAPI(t, "POST", url+"/api/scans", `{}`, &job); status != http.StatusAccepted {
+		t.Fatalf("got status %v", status)
+	}
+
+	if status := callAPI(t, "DELETE", url+"/api/scans/"+strconv.Itoa(job.ID), "", nil); status != http.StatusNoContent {
+		t.Fatalf("cancel: got status %v", status)
+	}
+
+	job = waitForScan(t, url, job.ID)
+	if job.State != JobCancelled {
+		t.Errorf("unexpected state %v", job.State)
+	}
+
+	if status := callAPI(t, "DELETE", url+"/api/scans/"+strconv.Itoa(job.ID), "", nil); status != http.StatusConflict {
+		t.Errorf("cancelling again: got status %v", status)
+	}
+	if status := callAPI(t, "GET", url+"/api/scans/"+strconv.Itoa(job.ID)+"/file", "", nil); status != http.StatusConflict {
+		t.Errorf("download: got status %v", status)
+	}
+}
+
+func TestAPIShutdown(t *testing.T) {
+	useAPIServer(t, "")
+
+	s := newAPIServer("secret")
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+
+	err := s.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// requests that were already being handled don't queue scans
+	if status := callAPI(t, "POST", srv.URL+"/api/scans", `{}`, nil); status != http.StatusServiceUnavailable {
+		t.Errorf("got status %v, wanted %v", status, http.StatusServiceUnavailable)
+	}
+	if n := len(jobs.Jobs()); n != 0 {
+		t.Errorf("%v scans were queued", n)
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1:8080": true,
+		"localhost:8080": true,
+		"[::1]:8080":     true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"192.168.1.2:80": false,
+		"bogus":          false,
+	}
+
+	for addr, expected := range tests {
+		if got := isLoopbackAddr(addr); got != expected {
+			t.Errorf("%v: got %v, wanted %v", addr, got, expected)
+		}
+	}
+}
+
+func TestGetAPIToken(t *testing.T) {
+	useConfigFile(t, "")
+	t.Setenv(API_TOKEN_ENV, "")
+
+	token, created, err := getAPIToken()
+	if err != nil || !created || len(token) < 32 || appConf.APIToken != token {
+		t.Fatalf("got %q, %v, %v", token, created, err)
+	}
+
+	again, created, _ := getAPIToken()
+	if again != token || created {
+		t.Errorf("the token wasn't kept: %q, %v", again, created)
+	}
+
+	t.Setenv(API_TOKEN_ENV, "from-env")
+	if got, created, _ := getAPIToken(); got != "from-env" || created {
+		t.Errorf("the environment variable wasn't used: %q, %v", got, created)
+	}
+}
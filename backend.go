@@ -0,0 +1,63 @@
+package main
+
+import "context"
+
+// Backend is implemented by anything that can discover scanner devices,
+// describe their options, and scan an image. The UI only ever talks to the
+// currently selected backend, so that other backends (or a fake one for
+// testing) can be swapped in without touching any of the FLTK callbacks.
+type Backend interface {
+	// ListDevices retrieves all of the scanner devices that the backend can
+	// see.
+	ListDevices() ([]ScannerDevice, error)
+	// DescribeOptions retrieves all of the options for the device, in the
+	// order that the device lists them, after applying the settings. The
+	// settings may be nil, in which case the device's defaults are described.
+	DescribeOptions(dev string, deviceSettings map[string]string) ([]DeviceOption, error)
+	// Scan scans a single image from the device and writes it to filename in
+	// the provided format, such as "png" or "pdf". Any output from the backend
+	// is returned so that it can be shown to the user. onProgress (if not nil)
+	// is called as the scan progresses. The scan is stopped if ctx is
+	// cancelled.
+	Scan(ctx context.Context, filename string, deviceSettings map[string]string, format string, dev string, onProgress func(p ScanProgress)) (string, error)
+	// ScanBatch scans pages from the device's document feeder until it runs
+	// out, writing each page to a file named after pattern, where %d is the
+	// page number. onPage is called as each page is written, and onProgress
+	// as each page progresses. The files of the scanned pages are returned
+	// along with any output from the backend. The scan is stopped if ctx is
+	// cancelled.
+	ScanBatch(ctx context.Context, pattern string, deviceSettings map[string]string, format string, dev string, onPage func(page int, filename string), onProgress func(p ScanProgress)) ([]string, string, error)
+}
+
+// ScanimageBackend is a Backend that parses the CLI output of the scanimage
+// binary from the sane project.
+type ScanimageBackend struct {
+	// The path to the scanimage binary. If empty, scanimage is looked up in
+	// $PATH. Tests point this at a fake scanimage script.
+	Path string
+}
+
+// bin returns the scanimage binary that should be executed.
+func (b *ScanimageBackend) bin() string {
+	if b.Path == "" {
+		return "scanimage"
+	}
+
+	return b.Path
+}
+
+func (b *ScanimageBackend) ListDevices() ([]ScannerDevice, error) {
+	return getDevices(b.bin())
+}
+
+func (b *ScanimageBackend) DescribeOptions(dev string, deviceSettings map[string]string) ([]DeviceOption, error) {
+	return getDeviceOptionsConstraints(b.bin(), dev, deviceSettings)
+}
+
+func (b *ScanimageBackend) Scan(ctx context.Context, filename string, deviceSettings map[string]string, format string, dev string, onProgress func(p ScanProgress)) (string, error) {
+	return ScanImage(ctx, b.bin(), filename, deviceSettings, format, dev, onProgress)
+}
+
+func (b *ScanimageBackend) ScanBatch(ctx context.Context, pattern string, deviceSettings map[string]string, format string, dev string, onPage func(page int, filename string), onProgress func(p ScanProgress)) ([]string, string, error) {
+	return ScanBatch(ctx, b.bin(), pattern, deviceSettings, format, dev, onPage, onProgress)
+}
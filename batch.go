@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// getBatchPageExt returns the file extension for the individual pages of a
+// batch scan to a file with the extension ext. PDF documents are assembled
+// from png pages.
+func getBatchPageExt(ext string) string {
+	if ext == ".pdf" {
+		return ".png"
+	}
+
+	return ext
+}
+
+// getBatchPattern returns the scanimage --batch pattern for the pages of a
+// batch scan to filename, such as "doc-page%d.png" for "doc.png". Any "%" in
+// filename is escaped, since scanimage formats the pattern with printf.
+func getBatchPattern(filename string) string {
+	ext := filepath.Ext(filename)
+	base := strings.ReplaceAll(strings.TrimSuffix(filename, ext), "%", "%%")
+
+	return fmt.Sprintf("%v-page%%d%v", base, getBatchPageExt(strings.ToLower(ext)))
+}
+
+// getBatchDocument returns the name of the document that the pages of a batch
+// scan to filename are combined into. It is always a PDF, since that's the
+// only supported format that holds more than one page.
+func getBatchDocument(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".pdf"
+}
+
+// scanBatchDocument scans every page in the document feeder of dev to its own
+// file, named according to the scanimage --batch pattern (or after filename if
+// the pattern is empty), and then combines the pages into a single PDF
+// document, laid out according to layout. If appendExisting is true and the document already
+// exists, the pages are added to the end of it. onPage is called as each page
+// is scanned, and onProgress as each page progresses. The pages, the document,
+// and any output from the backend are returned.
+func scanBatchDocument(ctx context.Context, filename string, pattern string, deviceSettings map[string]string, dev string, layout pdfLayout, appendExisting bool, onPage func(page int, filename string), onProgress func(p ScanProgress)) ([]string, string, string, error) {
+	ext := getFileType(filename)
+	if ext == "" {
+		return nil, "", "", fmt.Errorf("only png, jpg, and pdf formats are supported")
+	}
+
+	if pattern == "" {
+		pattern = getBatchPattern(filename)
+	}
+
+	format := strings.TrimPrefix(getBatchPageExt(ext), ".")
+	pages, out, err := backend.ScanBatch(ctx, pattern, deviceSettings, format, dev, onPage, onProgress)
+	if err != nil {
+		return pages, "", out, err
+	}
+
+	doc := getBatchDocument(filename)
+	_, err = writePDFFile(doc, pages, layout, appendExisting)
+	if err != nil {
+		return pages, "", out, fmt.Errorf("failed to combine %v pages: %w", len(pages), err)
+	}
+
+	return pages, doc, out, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGetBatchPattern(t *testing.T) {
+	tests := []struct {
+		filename string
+		pattern  string
+		document string
+	}{
+		{filename: "/scans/doc.png", pattern: "/scans/doc-page%d.png", document: "/scans/doc.pdf"},
+		{filename: "/scans/doc.jpg", pattern: "/scans/doc-page%d.jpg", document: "/scans/doc.pdf"},
+		{filename: "/scans/doc.pdf", pattern: "/scans/doc-page%d.png", document: "/scans/doc.pdf"},
+		{filename: "/scans/100%.PDF", pattern: "/scans/100%%-page%d.png", document: "/scans/100%.pdf"},
+	}
+
+	for _, test := range tests {
+		got := getBatchPattern(test.filename)
+		if got != test.pattern {
+			t.Errorf("%v: pattern mismatch: got %v, wanted %v", test.filename, got, test.pattern)
+		}
+
+		got = getBatchDocument(test.filename)
+		if got != test.document {
+			t.Errorf("%v: document mismatch: got %v, wanted %v", test.filename, got, test.document)
+		}
+	}
+}
+
+func TestScanBatchDocument(t *testing.T) {
+	tests := []struct {
+		mode    string
+		pages   int
+		wantErr bool
+	}{
+		{mode: "", pages: 3},
+		{mode: "", pages: 1},
+		{mode: "", pages: 0, wantErr: true},
+		{mode: "fail", pages: 3, wantErr: true},
+	}
+
+	for _, test := range tests {
+		useFakeBackend(t, test.mode)
+		t.Setenv("FAKE_SCANIMAGE_PAGES", strconv.Itoa(test.pages))
+
+		filename := filepath.Join(t.TempDir(), "100% scanned.pdf")
+
+		var reported []string
+		var finished []int
+		pages, doc, _, err := scanBatchDocument(context.Background(), filename, "", nil, "brother5:bus2;dev1", pdfLayout{}, false, func(page int, filename string) {
+			reported = append(reported, filename)
+			if page != len(reported) {
+				t.Errorf("pages %v: page %v was reported out of order", test.pages, page)
+			}
+		}, func(p ScanProgress) {
+			if p.Percent == 100 {
+				finished = append(finished, p.Page)
+			}
+		})
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("mode %q, pages %v: expected an error but got nil", test.mode, test.pages)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("pages %v: unexpected error: %v", test.pages, err)
+			continue
+		}
+
+		if len(pages) != test.pages || strings.Join(pages, "\n") != strings.Join(reported, "\n") {
+			t.Errorf("pages %v: reported pages %v don't match %v", test.pages, reported, pages)
+		}
+		if len(finished) != test.pages || finished[len(finished)-1] != test.pages {
+			t.Errorf("pages %v: unexpected progress for finished pages: %v", test.pages, finished)
+		}
+		for _, p := range pages {
+			if _, err := os.Stat(p); err != nil {
+				t.Errorf("pages %v: page is missing: %v", test.pages, err)
+			}
+		}
+
+		b, err := os.ReadFile(doc)
+		if err != nil {
+			t.Fatalf("pages %v: failed to read document: %v", test.pages, err)
+		}
+		if !strings.Contains(string(b), fmt.Sprintf("/Count %v ", test.pages)) {
+			t.Errorf("pages %v: document doesn't have the expected page count", test.pages)
+		}
+	}
+}
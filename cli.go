@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const cliUsage = `usage: go-fltk-sane [flags] <command> [command flags]
+
+With no command, the graphical interface is started. The commands share the
+config file with the graphical interface, so the device, device settings,
+directory and filename template chosen there are used by default.
+
+commands:
+  devices    list the scanner devices
+  options    list the options of a device
+  scan       scan an image to a file
+  serve      serve the HTTP API until interrupted
+
+Run "go-fltk-sane <command> -h" for the flags of each command.
+`
+
+// settingsFlag collects repeated -set name=value flags into device settings.
+type settingsFlag map[string]string
+
+func (s settingsFlag) String() string {
+	pairs := make([]string, 0, len(s))
+	for k, v := range s {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", k, v))
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, " ")
+}
+
+func (s settingsFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("%q is not in the form name=value", v)
+	}
+
+	s[name] = value
+
+	return nil
+}
+
+// runCLI runs the headless command described by args, which are the
+// non-flag arguments left over after parseFlags, and returns the exit code.
+// Errors are written to stderr; anything else goes to stdout.
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	var err error
+
+	switch args[0] {
+	case "devices":
+		err = cliDevices(args[1:], stdout, stderr)
+	case "options":
+		err = cliOptions(args[1:], stdout, stderr)
+	case "scan":
+		err = cliScan(args[1:], stdout, stderr)
+	case "serve":
+		err = cliServe(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%v", args[0], cliUsage)
+		return 2
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if errors.Is(err, errUsage) {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// errUsage is returned by the commands when the provided flags are invalid.
+// The flag package has already explained why to the user by then.
+var errUsage = errors.New("invalid usage")
+
+// newCommandFlags creates the flag set for a command, which reports errors
+// to stderr instead of exiting.
+func newCommandFlags(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	return fs
+}
+
+// parseCommandFlags parses the args for a command and rejects any leftover
+// arguments.
+func parseCommandFlags(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	if err != nil {
+		return errUsage
+	}
+
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "unexpected arguments: %v\n", strings.Join(fs.Args(), " "))
+		fs.Usage()
+		return errUsage
+	}
+
+	return nil
+}
+
+// writeJSON prints v as indented JSON.
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
+
+// cliSettings returns the device settings to use for dev: the settings from
+// the config file that were last used with dev, overridden by the settings
+// that were provided via flags.
+func cliSettings(dev string, overrides settingsFlag) map[string]string {
+	settings := make(map[string]string)
+	if dev == appConf.Device {
+		maps.Copy(settings, appConf.DeviceSettings)
+	} else if saved, ok := appConf.Devices[dev]; ok {
+		maps.Copy(settings, saved.Settings)
+	}
+	maps.Copy(settings, overrides)
+
+	return settings
+}
+
+func cliDevices(args []string, stdout, stderr io.Writer) error {
+	fs := newCommandFlags("devices", stderr)
+	asJSON := fs.Bool("json", false, "print the devices as JSON")
+	err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	devices, err := backend.ListDevices()
+	if err != nil {
+		return fmt.Errorf("failed to get devices: %w", err)
+	}
+
+	if *asJSON {
+		return writeJSON(stdout, devices)
+	}
+
+	for _, d := range devices {
+		fmt.Fprintf(stdout, "%v\t%v %v (%v)\n", d.Device, d.Vendor, d.Model, d.Type)
+	}
+
+	return nil
+}
+
+func cliOptions(args []string, stdout, stderr io.Writer) error {
+	overrides := settingsFlag{}
+
+	fs := newCommandFlags("options", stderr)
+	dev := fs.String("device", appConf.Device, "the device to describe")
+	all := fs.Bool("all", false, "include advanced and inactive options")
+	asJSON := fs.Bool("json", false, "print the options as JSON")
+	fs.Var(overrides, "set", "apply a `name=value` setting before describing the options; may be repeated")
+	err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *dev == "" {
+		return fmt.Errorf("a device was not provided via -device and none is configured")
+	}
+
+	opts, err := backend.DescribeOptions(*dev, cliSettings(*dev, overrides))
+	if err != nil {
+		return fmt.Errorf("failed to get options for %v: %w", *dev, err)
+	}
+
+	if *asJSON {
+		return writeJSON(stdout, opts)
+	}
+
+	for i, group := range groupDeviceOptions(opts, *all) {
+		if i > 0 {
+			fmt.Fprintln(stdout)
+		}
+
+		name := group.Name
+		if name == "" {
+			name = "Options"
+		}
+		fmt.Fprintf(stdout, "%v:\n", name)
+
+		for _, opt := range group.Options {
+			line := fmt.Sprintf("  %v %v [%v]", opt.Name, opt.Constraint, opt.Current)
+			if opt.Inactive() {
+				line = fmt.Sprintf("%v [inactive]", line)
+			}
+			fmt.Fprintln(stdout, line)
+		}
+	}
+
+	return nil
+}
+
+// validateSettings checks each of the settings against the options that the
+// device reported.
+func validateSettings(opts []DeviceOption, settings map[string]string) error {
+	byName := make(map[string]DeviceOption, len(opts))
+	for _, opt := range opts {
+		byName[opt.Name] = opt
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		opt, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("the device has no option named %v", name)
+		}
+		if !opt.Settable() {
+			return fmt.Errorf("option %v cannot be set", name)
+		}
+
+		err := opt.Validate(settings[name])
+		if err != nil {
+			return fmt.Errorf("invalid value for %v: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// checkScanChoices checks the filename template, PDF page size and collision
+// policy of a scan that was asked for by the scan command or the HTTP API.
+func checkScanChoices(tmpl string, pageSize string, collision string) error {
+	if _, err := parseFilenameTemplate(tmpl); err != nil {
+		return fmt.Errorf("invalid filename template: %w", err)
+	}
+	if getFileType(tmpl) == "" {
+		return fmt.Errorf("only png, jpg, and pdf formats are supported")
+	}
+
+	if pageSize != "" && !slices.Contains(pdfPageSizeNames, pageSize) {
+		return fmt.Errorf("unknown page size %v", pageSize)
+	}
+
+	if !slices.Contains(collisionPolicies, collision) {
+		return fmt.Errorf("unknown collision policy %v", collision)
+	}
+
+	return nil
+}
+
+// getScanOptions describes the options of dev with the settings applied, and
+// checks the overrides against them. Only the overrides are checked, since
+// the configured settings were already checked by the graphical interface.
+// Since describing the options takes a while, it's only done when there are
+// overrides, or when pdf is true and the resolution of the pages isn't set;
+// otherwise nil is returned.
+func getScanOptions(dev string, settings map[string]string, overrides map[string]string, pdf bool) ([]DeviceOption, error) {
+	_, hasResolution := settings["resolution"]
+	if len(overrides) == 0 && (hasResolution || !pdf) {
+		return nil, nil
+	}
+
+	opts, err := backend.DescribeOptions(dev, settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get options for %v: %w", dev, err)
+	}
+
+	err = validateSettings(opts, overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+func cliScan(args []string, stdout, stderr io.Writer) error {
+	overrides := settingsFlag{}
+
+	tmpl := appConf.FilenameTemplate
+	if tmpl == "" {
+		tmpl = DEFAULT_FILENAME_TEMPLATE
+	}
+	dir := appConf.SelectedDir
+	if dir == "" {
+		dir = "."
+	}
+
+	fs := newCommandFlags("scan", stderr)
+	dev := fs.String("device", appConf.Device, "the device to scan with")
+	out := fs.String("out", tmpl, "the filename template to write to, with tokens such as {date}, {counter} and {page}; see -help-template")
+	label := fs.String("label", appConf.FilenameLabel, "the value of the {label} token in the filename template")
+	templateHelp := fs.Bool("help-template", false, "describe the tokens of filename templates and exit")
+	outDir := fs.String("dir", dir, "the directory to write to; the filename template may add subdirectories within it")
+	collision := fs.String("collision", getCollisionPolicy(appConf.CollisionPolicy), fmt.Sprintf("what to do when the file already exists, one of %v; prompt fails instead of asking", strings.Join(collisionPolicies, ", ")))
+	batch := fs.Bool("batch", appConf.BatchScan, "scan every page in the document feeder, to a file per page and a combined pdf")
+	pageSize := fs.String("page-size", appConf.PDFPageSize, fmt.Sprintf("the page size of pdfs, one of %v", strings.Join(pdfPageSizeNames, ", ")))
+	appendPDF := fs.Bool("append", appConf.AppendPDF, "add the pages to the end of the pdf if it already exists")
+	showProgress := fs.Bool("progress", false, "print the progress of each page to stderr")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Var(overrides, "set", "apply a `name=value` setting to the device; may be repeated")
+	err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *templateHelp {
+		io.WriteString(stdout, FILENAME_TEMPLATE_HELP+"\n")
+		return nil
+	}
+
+	if *dev == "" {
+		return fmt.Errorf("a device was not provided via -device and none is configured")
+	}
+
+	err = checkScanChoices(*out, *pageSize, *collision)
+	if err != nil {
+		return err
+	}
+
+	settings := cliSettings(*dev, overrides)
+	opts, err := getScanOptions(*dev, settings, overrides, *batch || getFileType(*out) == ".pdf")
+	if err != nil {
+		return err
+	}
+
+	vars := getTemplateVars(time.Now(), *dev, appConf.Scanners, opts, settings, max(appConf.FilenameCounter, 1), *label)
+	filename, pattern, err := scanFilenames(*out, *outDir, vars, *batch)
+	if err != nil {
+		return fmt.Errorf("invalid filename template: %w", err)
+	}
+
+	req := scanRequest{
+		Filename:    filename,
+		PagePattern: pattern,
+		Device:      *dev,
+		Settings:    settings,
+		Layout:      pdfLayout{DPI: getScanResolution(opts, settings), PageSize: *pageSize},
+		Batch:       *batch,
+		AppendPDF:   *appendPDF,
+	}
+
+	req, err = applyCollisionPolicy(req, *collision, fileExists)
+	if err != nil {
+		return err
+	}
+
+	// the counter goes up even if the scan fails, like it does in the
+	// graphical interface, so that a file is never named twice
+	if next := nextFilenameCounter(*out, vars.Counter); next != vars.Counter {
+		appConf.FilenameCounter = next
+		saveConfig()
+	}
+
+	// interrupting the command stops the scan, rather than leaving scanimage
+	// running
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var onProgress func(p ScanProgress)
+	if *showProgress {
+		eta := &etaEstimator{}
+		onProgress = func(p ScanProgress) {
+			line := fmt.Sprintf("page %v: %5.1f%%", p.Page, p.Percent)
+			if left, ok := eta.Estimate(p, time.Now()); ok {
+				line = fmt.Sprintf("%v, %v left", line, left)
+			}
+			// overwrite the previous progress line
+			fmt.Fprintf(stderr, "\r%-40v", line)
+			if p.Percent >= 100 {
+				fmt.Fprintln(stderr)
+			}
+		}
+	}
+
+	result, err := performScan(ctx, req, func(page int, filename string) {
+		fmt.Fprintf(stderr, "scanned page %v to %v\n", page, filename)
+	}, onProgress)
+	if result.Output != "" && !*asJSON {
+		fmt.Fprint(stderr, result.Output)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return writeJSON(stdout, result)
+	}
+
+	fmt.Fprintln(stdout, result.File)
+
+	return nil
+}
+
+// cliServe serves the HTTP API without the graphical interface, until it's
+// interrupted.
+func cliServe(args []string, stdout, stderr io.Writer) error {
+	fs := newCommandFlags("serve", stderr)
+	addr := fs.String("listen", listenAddr, "the `address` to serve the HTTP API on, such as 127.0.0.1:8080")
+	err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *addr == "" {
+		return fmt.Errorf("an address was not provided via -listen")
+	}
+
+	token, err := setupAPIToken(stderr)
+	if err != nil {
+		return err
+	}
+
+	if jobs == nil {
+		jobs = NewJobManager(nil)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := newAPIServer(token)
+	err = startAPIServer(*addr, srv)
+	if err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+	stop()
+	Log("stopping the HTTP API, please wait a moment...")
+
+	// running scans are stopped, so that scanimage isn't left running
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), COMMAND_WAIT_DELAY*2)
+	defer cancel()
+	err = errors.Join(srv.Shutdown(shutdownCtx), jobs.Close(shutdownCtx))
+	if err != nil {
+		return fmt.Errorf("failed to stop cleanly: %w", err)
+	}
+
+	return nil
+}
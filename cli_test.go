@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useFakeBackend points the global backend at the fake scanimage script and
+// resets the app config, restoring both once the test is done.
+func useFakeBackend(t *testing.T, mode string) {
+	t.Helper()
+
+	oldBackend, oldConf := backend, appConf
+	t.Cleanup(func() {
+		backend, appConf = oldBackend, oldConf
+	})
+
+	backend = &ScanimageBackend{Path: fakeScanimage(t, mode)}
+	appConf = AppConfig{}
+}
+
+func TestRunCLIDevices(t *testing.T) {
+	useFakeBackend(t, "")
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code := runCLI([]string{"devices", "-json"}, stdout, stderr)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %v: %v", code, stderr.String())
+	}
+
+	var got []ScannerDevice
+	err := json.Unmarshal(stdout.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("failed to parse json output: %v", err)
+	}
+	if len(got) != 2 || got[0].Device != "brother5:bus2;dev1" {
+		t.Errorf("unexpected devices: %v", got)
+	}
+
+	stdout.Reset()
+	code = runCLI([]string{"devices"}, stdout, stderr)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %v: %v", code, stderr.String())
+	}
+	if !strings.HasPrefix(stdout.String(), "brother5:bus2;dev1\tBrother ADS-1700W (USB scanner)\n") {
+		t.Errorf("unexpected output: %q", stdout.String())
+	}
+}
+
+func TestRunCLIOptions(t *testing.T) {
+	useFakeBackend(t, "")
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code := runCLI([]string{"options"}, stdout, stderr)
+	if code != 1 {
+		t.Errorf("expected a failure without a device, got exit code %v", code)
+	}
+
+	appConf.Device = "brother5:bus2;dev1"
+	stdout.Reset()
+	code = runCLI([]string{"options", "-json"}, stdout, stderr)
+	if code != 0 {
+		t.Fatalf("unexpected exit code %v: %v", code, stderr.String())
+	}
+
+	var got []DeviceOption
+	err := json.Unmarshal(stdout.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("failed to parse json output: %v", err)
+	}
+	if len(got) != 9 || got[0].Name != "mode" {
+		t.Errorf("unexpected options: %v", got)
+	}
+}
+
+func TestRunCLIScan(t *testing.T) {
+	tests := []struct {
+		mode     string
+		args     []string
+		expected int
+		wantFile bool
+	}{
+		{mode: "", args: []string{"-set", "resolution=300"}, expected: 0, wantFile: true},
+		{mode: "", args: []string{"-set", "resolution=301"}, expected: 1},
+		{mode: "", args: []string{"-set", "nonexistent=1"}, expected: 1},
+		{mode: "", args: []string{"-set", "resolution"}, expected: 2},
+		{mode: "", args: []string{"-out", "scan.tiff"}, expected: 1},
+		{mode: "", args: []string{"-out", "{bogus}.png"}, expected: 1},
+		{mode: "fail", args: []string{}, expected: 1},
+	}
+
+	for _, test := range tests {
+		useFakeBackend(t, test.mode)
+
+		argsFile := filepath.Join(t.TempDir(), "args")
+		t.Setenv("FAKE_SCANIMAGE_ARGS", argsFile)
+
+		dir := t.TempDir()
+		args := append([]string{"scan", "-device", "brother5:bus2;dev1", "-dir", dir, "-out", "scan-%t.png", "-json"}, test.args...)
+
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		code := runCLI(args, stdout, stderr)
+		if code != test.expected {
+			t.Errorf("%v: exit code mismatch: got %v, wanted %v: %v", test.args, code, test.expected, stderr.String())
+			continue
+		}
+		if !test.wantFile {
+			continue
+		}
+
+		var got scanResult
+		err := json.Unmarshal(stdout.Bytes(), &got)
+		if err != nil {
+			t.Fatalf("%v: failed to parse json output: %v", test.args, err)
+		}
+		if filepath.Dir(got.File) != dir || strings.Contains(got.File, "%t") {
+			t.Errorf("%v: unexpected file %v", test.args, got.File)
+		}
+		if _, err := os.Stat(got.File); err != nil {
+			t.Errorf("%v: scanned file is missing: %v", test.args, err)
+		}
+
+		b, err := os.ReadFile(argsFile)
+		if err != nil {
+			t.Fatalf("%v: failed to read args: %v", test.args, err)
+		}
+		if !strings.Contains(string(b), "--resolution=300\n") {
+			t.Errorf("%v: the setting was not passed to scanimage: %q", test.args, string(b))
+		}
+	}
+}
+
+func TestRunCLIUsage(t *testing.T) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if code := runCLI([]string{"bogus"}, stdout, stderr); code != 2 {
+		t.Errorf("unknown command: got exit code %v, wanted 2", code)
+	}
+	if code := runCLI([]string{"devices", "extra"}, stdout, stderr); code != 2 {
+		t.Errorf("extra arguments: got exit code %v, wanted 2", code)
+	}
+	if code := runCLI([]string{"help"}, stdout, stderr); code != 0 {
+		t.Errorf("help: got exit code %v, wanted 0", code)
+	}
+}
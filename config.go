@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrg/xdg"
+	"gopkg.in/yaml.v3"
+)
+
+// The version of the config file that this version of the app writes. It goes
+// up whenever the meaning or shape of a key changes, along with a migration in
+// configMigrations.
+const CONFIG_VERSION = 2
+
+type AppConfig struct {
+	// The version of the config file, which is CONFIG_VERSION once it's
+	// loaded. Config files from before it was introduced are version 0.
+	Version int
+	// The currently selected output directory for scanned images
+	SelectedDir      string
+	FilenameTemplate string
+	// The value of the {counter} token in the filename template for the next
+	// scan. It goes up with each scan that uses it.
+	FilenameCounter int
+	// The value of the {label} token in the filename template.
+	FilenameLabel string
+	// What happens when a scan would write to a file that already exists,
+	// which is one of collisionPolicies. Empty is the same as "suffix".
+	CollisionPolicy string
+	Scanners        []ScannerDevice
+	// The device that will perform the scanning operation
+	Device string
+	// Contains all of the options available for the device, as well as the
+	// constraints for each option (for example, the "resolution" option may
+	// have constraints of 100,200,300 dpi)
+	DeviceOptions []DeviceOption
+	// Whether the options panel shows advanced and inactive options.
+	ShowAdvanced bool
+	// Whether each scan takes every page from the document feeder, rather
+	// than a single page.
+	BatchScan bool
+	// The page size of the PDFs that scans are saved to, which is one of
+	// pdfPageSizeNames. Empty fits each page to its scan.
+	PDFPageSize string
+	// Whether scans to a PDF that already exists are added to the end of it,
+	// rather than replacing it.
+	AppendPDF bool
+	// Contains the current settings for the device. Each key is the name of
+	// an option from DeviceOptions, although empty values may get removed
+	// before scanning occurs.
+	DeviceSettings map[string]string
+	// The options and settings of each device that was used before, by device
+	// name, so that switching back to a device restores its settings. The
+	// current device's are only stored here once another device is chosen or
+	// the app is closed.
+	Devices map[string]deviceState
+	// Whether the gallery also shows the other images and documents in
+	// SelectedDir, rather than only the ones scanned during this session.
+	GalleryShowDir bool
+	// The saved scan profiles, in the order they are listed in.
+	Profiles []scanProfile
+	// The name of the profile that was applied last, if any.
+	Profile string
+	// The token that requests to the HTTP API need, which is created the first
+	// time the API is started. The GO_FLTK_SANE_API_TOKEN environment variable
+	// takes precedence over it.
+	APIToken string
+}
+
+// deviceState is what is remembered about a device that isn't the current one.
+type deviceState struct {
+	// The options that the device reported when it was last used.
+	Options []DeviceOption
+	// The settings that were last used with the device.
+	Settings map[string]string
+}
+
+// movedConfig is what the migrations moved out of a config file to be kept
+// elsewhere. It's only stored there once the upgraded file has been saved, since
+// otherwise the old file is upgraded again the next time it's loaded.
+type movedConfig struct {
+	// The activity that was kept in the file, which belongs in the activity log.
+	Activity string
+}
+
+// configMigrations upgrade config files from one version to the next: the
+// migration at index i upgrades version i to version i+1. They work on the
+// keys of the file, before it is decoded into an AppConfig, and add anything
+// that has to be kept elsewhere to moved.
+var configMigrations = []func(conf map[string]any, moved *movedConfig){
+	// 0 to 1: the options of the device used to be kept as a map of option
+	// names to their values, which deviceoptions replaced. The options are
+	// discovered again when the device is chosen
+	func(conf map[string]any, moved *movedConfig) {
+		delete(conf, "devicemap")
+	},
+	// 1 to 2: the activity view used to be saved here when the app closed,
+	// which moved to its own log file, along with what was saved here
+	func(conf map[string]any, moved *movedConfig) {
+		if old, ok := conf["log"].(string); ok {
+			moved.Activity = old
+		}
+		delete(conf, "log")
+	},
+}
+
+// The problems that were found with the config file when it was loaded, for
+// the user to be told about. Values that were invalid have been replaced with
+// their defaults.
+var configProblems []string
+
+// unknownFieldRegexp matches the errors that the yaml package reports for keys
+// that AppConfig doesn't have.
+var unknownFieldRegexp = regexp.MustCompile(`^line (\d+): field (.+) not found in type .+$`)
+
+// lineRegexp matches the line number that the yaml package starts its errors
+// with.
+var lineRegexp = regexp.MustCompile(`^line \d+: `)
+
+// getConfigVersion returns the version of the config file with the keys conf.
+func getConfigVersion(conf map[string]any) (int, error) {
+	v, ok := conf["version"]
+	if !ok {
+		return 0, nil
+	}
+
+	version, ok := v.(int)
+	if !ok || version < 0 {
+		return 0, fmt.Errorf("version: %v is not a valid version", v)
+	}
+
+	return version, nil
+}
+
+// parseConfig decodes the contents of a config file, upgrading it from older
+// versions, and returns the config along with the version of the file, what the
+// upgrade moved out of it, and any problems with it. Keys that AppConfig doesn't have and invalid values are
+// problems, rather than errors, so that as much of the config as possible is
+// kept; an error is only returned if the file isn't YAML at all.
+func parseConfig(b []byte) (AppConfig, int, movedConfig, []string, error) {
+	conf := AppConfig{}
+	moved := movedConfig{}
+	problems := []string{}
+
+	raw := make(map[string]any)
+	err := yaml.Unmarshal(b, &raw)
+	if err != nil {
+		return conf, 0, moved, nil, fmt.Errorf("the config file is not valid YAML: %w", err)
+	}
+
+	version, err := getConfigVersion(raw)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if version > CONFIG_VERSION {
+		problems = append(problems, fmt.Sprintf("version: the config file is from a newer version of this app (%v, while this one uses %v), so the settings that this version doesn't know about are ignored", version, CONFIG_VERSION))
+	}
+
+	if version < CONFIG_VERSION {
+		for v := version; v < CONFIG_VERSION; v++ {
+			configMigrations[v](raw, &moved)
+		}
+		raw["version"] = CONFIG_VERSION
+
+		b, err = yaml.Marshal(raw)
+		if err != nil {
+			return conf, version, moved, problems, fmt.Errorf("failed to upgrade the config file: %w", err)
+		}
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	err = dec.Decode(&conf)
+
+	var typeErr *yaml.TypeError
+	switch {
+	case errors.As(err, &typeErr):
+		// the rest of the config is decoded regardless. Upgraded files were
+		// written out again, so the line numbers wouldn't match the file
+		for _, e := range typeErr.Errors {
+			m := unknownFieldRegexp.FindStringSubmatch(e)
+			switch {
+			case m != nil && version >= CONFIG_VERSION:
+				e = fmt.Sprintf("%v: unknown key on line %v", m[2], m[1])
+			case m != nil:
+				e = fmt.Sprintf("%v: unknown key", m[2])
+			case version < CONFIG_VERSION:
+				e = lineRegexp.ReplaceAllString(e, "")
+			}
+			problems = append(problems, e)
+		}
+	case err != nil && !errors.Is(err, io.EOF):
+		return AppConfig{}, version, moved, problems, fmt.Errorf("the config file is not valid: %w", err)
+	}
+
+	problems = append(problems, validateConfig(&conf)...)
+
+	return conf, version, moved, problems, nil
+}
+
+// validateConfig checks the values of conf that the rest of the app relies
+// on, and replaces the invalid ones with their defaults. The problems that
+// were found are returned.
+func validateConfig(conf *AppConfig) []string {
+	problems := []string{}
+
+	if conf.FilenameTemplate != "" {
+		if _, err := parseFilenameTemplate(conf.FilenameTemplate); err != nil {
+			problems = append(problems, fmt.Sprintf("filenametemplate: %v; using the default", err.Error()))
+			conf.FilenameTemplate = ""
+		}
+	}
+
+	if conf.FilenameCounter < 0 {
+		problems = append(problems, fmt.Sprintf("filenamecounter: %v is negative; starting over at 1", conf.FilenameCounter))
+		conf.FilenameCounter = 0
+	}
+
+	if conf.CollisionPolicy != "" && !slices.Contains(collisionPolicies, conf.CollisionPolicy) {
+		problems = append(problems, fmt.Sprintf("collisionpolicy: %v is not one of %v; using %v", conf.CollisionPolicy, strings.Join(collisionPolicies, ", "), collisionPolicies[0]))
+		conf.CollisionPolicy = ""
+	}
+
+	if conf.PDFPageSize != "" && !slices.Contains(pdfPageSizeNames, conf.PDFPageSize) {
+		problems = append(problems, fmt.Sprintf("pdfpagesize: %v is not one of %v; using %v", conf.PDFPageSize, strings.Join(pdfPageSizeNames, ", "), pdfPageSizeNames[0]))
+		conf.PDFPageSize = ""
+	}
+
+	profiles := []scanProfile{}
+	for i, p := range conf.Profiles {
+		switch {
+		case strings.TrimSpace(p.Name) == "":
+			problems = append(problems, fmt.Sprintf("profiles: profile %v has no name and was removed", i+1))
+			continue
+		case findProfile(profiles, p.Name) >= 0:
+			problems = append(problems, fmt.Sprintf("profiles: there is more than one profile named %v; only the first is kept", p.Name))
+			continue
+		}
+
+		if p.FilenameTemplate != "" {
+			if _, err := parseFilenameTemplate(p.FilenameTemplate); err != nil {
+				problems = append(problems, fmt.Sprintf("profiles: the filename template of %v is invalid (%v); it keeps the current template instead", p.Name, err.Error()))
+				p.FilenameTemplate = ""
+			}
+		}
+
+		profiles = append(profiles, p)
+	}
+	if conf.Profiles != nil {
+		conf.Profiles = profiles
+	}
+
+	return problems
+}
+
+// backupConfig writes b, the contents of the config file at path, next to it
+// with the suffix, such as "config.yml.v0.bak", and returns the path of the
+// backup. An existing backup is never replaced.
+func backupConfig(path string, b []byte, suffix string) (string, error) {
+	backup := fmt.Sprintf("%v.%v.bak", path, suffix)
+	for n := 1; fileExists(backup) && n <= MAX_COLLISION_SUFFIX; n++ {
+		backup = addPathSuffix(fmt.Sprintf("%v.%v.bak", path, suffix), n)
+	}
+
+	err := writeFileAtomic(backup, b)
+	if err != nil {
+		return "", fmt.Errorf("failed to back up the config file: %w", err)
+	}
+
+	return backup, nil
+}
+
+// readConfigFile loads the config file at path into appConf. If the file is
+// from an older version of the app, it's upgraded and saved, after backing up
+// the original, and what the upgrade moved out of it is stored elsewhere. Files
+// that can't be fully understood are backed up too, since they are replaced
+// when the app saves its config. If a file can't be backed up, the config isn't
+// saved at all, so that nothing is lost.
+func readConfigFile(path string) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("there is no config file at %v yet", path)
+		return
+	}
+	if err != nil {
+		configProblems = append(configProblems, fmt.Sprintf("the config file can't be read, so the settings won't be saved: %v", err.Error()))
+		configFilePath = ""
+		return
+	}
+
+	conf, version, moved, problems, err := parseConfig(b)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("%v; starting over with the default settings", err.Error()))
+	}
+	configProblems = append(configProblems, problems...)
+
+	suffix := ""
+	switch {
+	case err != nil:
+		suffix = "invalid"
+	case version != CONFIG_VERSION:
+		suffix = fmt.Sprintf("v%v", version)
+	}
+
+	if suffix != "" {
+		backup, err := backupConfig(path, b, suffix)
+		if err != nil {
+			configProblems = append(configProblems, fmt.Sprintf("%v, so the settings won't be saved", err.Error()))
+			configFilePath = ""
+		} else {
+			log.Printf("backed up the config file to %v", backup)
+		}
+	}
+
+	appConf = conf
+	appConf.Version = CONFIG_VERSION
+
+	if version < CONFIG_VERSION && err == nil && configFilePath != "" {
+		err = writeConfig()
+		if err != nil {
+			log.Printf("failed to save the upgraded config, so it will be upgraded again: %v", err.Error())
+			return
+		}
+
+		log.Printf("upgraded the config file from version %v to %v", version, CONFIG_VERSION)
+		importConfigActivity(moved.Activity)
+	}
+}
+
+// loadConfig locates the config file, unless one was provided via flags, locks
+// it and loads it into appConf.
+func loadConfig() {
+	var err error
+
+	appConf.Version = CONFIG_VERSION
+
+	if configFilePath == "" {
+		configFilePath, err = xdg.SearchConfigFile("go-fltk-sane/config.yml")
+		if err != nil {
+			log.Printf("failed to get xdg config dir: %v", err.Error())
+		}
+	}
+
+	found := configFilePath
+	if found == "" {
+		if xdg.ConfigHome == "" {
+			log.Println("unable to automatically identify any suitable config dirs; configuration will not be saved")
+			return
+		}
+
+		configFilePath = path.Join(xdg.ConfigHome, "go-fltk-sane", "config.yml")
+		log.Printf("using %v for config file path", configFilePath)
+	}
+
+	lockConfig()
+
+	if found != "" {
+		readConfigFile(found)
+
+		log.Printf("loaded config: %v", appConf)
+	}
+}
+
+// The time to wait after the settings last changed before saving them, so
+// that typing a filename template or dragging a slider doesn't write the config
+// file over and over.
+const CONFIG_SAVE_DELAY = 2 * time.Second
+
+// debouncer calls fn once Trigger hasn't been called for delay. fn runs in its
+// own goroutine.
+type debouncer struct {
+	delay time.Duration
+	fn    func()
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+func newDebouncer(delay time.Duration, fn func()) *debouncer {
+	return &debouncer{delay: delay, fn: fn}
+}
+
+// Trigger calls fn after delay, unless Trigger is called again before then, in
+// which case the wait starts over.
+func (d *debouncer) Trigger() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.timer = time.AfterFunc(d.delay, d.fn)
+}
+
+// Stop cancels the pending call of fn, and returns whether there was one.
+func (d *debouncer) Stop() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer == nil {
+		return false
+	}
+
+	stopped := d.timer.Stop()
+	d.timer = nil
+
+	return stopped
+}
+
+// configSaver saves the config on the UI thread, which appConf belongs to,
+// once the settings stop changing.
+var configSaver = newDebouncer(CONFIG_SAVE_DELAY, func() { onUI(saveConfig) })
+
+// requestConfigSave saves the config shortly after the settings changed, so
+// that they aren't lost if the app doesn't get to close cleanly. It must be
+// called on the UI thread.
+func requestConfigSave() {
+	configSaver.Trigger()
+}
+
+// The config file and its contents as it was last saved, so that saving
+// settings that didn't change doesn't write the file again.
+var savedConfig struct {
+	path string
+	b    []byte
+}
+
+// saveConfig writes appConf to the config file, if there is one. The file is
+// replaced all at once, so a crash while saving leaves the previous settings
+// in place rather than a truncated file.
+func saveConfig() {
+	if configFilePath == "" {
+		return
+	}
+
+	err := writeConfig()
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// writeConfig is saveConfig, returning why the config couldn't be saved.
+func writeConfig() error {
+	if configFilePath == "" {
+		return errors.New("there is no config file to save the config to")
+	}
+
+	b, err := yaml.Marshal(appConf)
+	if err != nil {
+		return fmt.Errorf("failed to marshal app config to yaml: %w", err)
+	}
+
+	if configFilePath == savedConfig.path && bytes.Equal(b, savedConfig.b) {
+		return nil
+	}
+
+	dir, _ := filepath.Split(configFilePath)
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		log.Printf("failed to create app config parent dir %v: %v", dir, err.Error())
+	}
+
+	// the token of the HTTP API is kept from other users
+	perm := os.FileMode(0o644)
+	if appConf.APIToken != "" {
+		perm = 0o600
+	}
+
+	err = writeFileAtomicPerm(configFilePath, b, perm)
+	if err != nil {
+		return fmt.Errorf("failed to save app config to %v: %w", configFilePath, err)
+	}
+
+	savedConfig.path, savedConfig.b = configFilePath, b
+
+	return nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestConfigMigrations(t *testing.T) {
+	if len(configMigrations) != CONFIG_VERSION {
+		t.Errorf("there are %v migrations for version %v", len(configMigrations), CONFIG_VERSION)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	v0, err := os.ReadFile(filepath.Join("testdata", "config", "v0.yml"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		content  string
+		version  int
+		problems []string
+		wantErr  bool
+		check    func(conf AppConfig) bool
+	}{
+		{
+			name:    "version 0",
+			content: string(v0),
+			version: 0,
+			check: func(conf AppConfig) bool {
+				return conf.Device == "brother5:bus2;dev1" && conf.DeviceSettings["mode"] == "True Gray" && conf.SelectedDir == "/home/user/scans" && len(conf.Scanners) == 1
+			},
+		},
+		{
+			name:    "current version",
+			content: "version: 2\nselecteddir: /scans\n",
+			version: 2,
+			check:   func(conf AppConfig) bool { return conf.SelectedDir == "/scans" },
+		},
+		{name: "empty", content: "", version: 0},
+		{
+			name:     "unknown keys",
+			content:  "version: 2\nselectedir: /scans\nprofiles:\n    - name: a\n      colour: red\n",
+			version:  2,
+			problems: []string{"selectedir: unknown key on line 2", "colour: unknown key on line 5"},
+			check:    func(conf AppConfig) bool { return len(conf.Profiles) == 1 && conf.Profiles[0].Name == "a" },
+		},
+		{
+			name:     "unknown keys in an upgraded file",
+			content:  "version: 1\nselectedir: /scans\nlog: <p>scanning</p>\n",
+			version:  1,
+			problems: []string{"selectedir: unknown key"},
+			check:    func(conf AppConfig) bool { return conf.SelectedDir == "" },
+		},
+		{
+			name:     "wrong type",
+			content:  "version: 2\nbatchscan: sometimes\nselecteddir: /scans\n",
+			version:  2,
+			problems: []string{"sometimes"},
+			check:    func(conf AppConfig) bool { return conf.SelectedDir == "/scans" },
+		},
+		{
+			name:     "bad values",
+			content:  "version: 2\ncollisionpolicy: explode\npdfpagesize: a3\nfilenametemplate: '{bogus}.png'\nfilenamecounter: -3\nprofiles:\n    - name: ''\n    - name: a\n      filenametemplate: '{'\n    - name: a\n",
+			version:  2,
+			problems: []string{"filenametemplate", "filenamecounter", "collisionpolicy", "pdfpagesize", "profile 1 has no name", "the filename template of a", "more than one profile named a"},
+			check: func(conf AppConfig) bool {
+				return conf.CollisionPolicy == "" && conf.PDFPageSize == "" && conf.FilenameTemplate == "" && conf.FilenameCounter == 0 && len(conf.Profiles) == 1 && conf.Profiles[0].FilenameTemplate == ""
+			},
+		},
+		{
+			name:     "newer version",
+			content:  "version: 99\nselecteddir: /scans\nscanqueue: []\n",
+			version:  99,
+			problems: []string{"newer version", "scanqueue: unknown key"},
+			check:    func(conf AppConfig) bool { return conf.SelectedDir == "/scans" },
+		},
+		{name: "not yaml", content: "selecteddir: [\n", wantErr: true},
+		{name: "not a mapping", content: "- a\n- b\n", wantErr: true},
+	}
+
+	for _, test := range tests {
+		conf, version, _, problems, err := parseConfig([]byte(test.content))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%v: expected an error but got nil", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		if version != test.version {
+			t.Errorf("%v: version: got %v, wanted %v", test.name, version, test.version)
+		}
+		if len(problems) != len(test.problems) {
+			t.Errorf("%v: got problems %q, wanted %q", test.name, problems, test.problems)
+		} else {
+			for i := range problems {
+				if !strings.Contains(problems[i], test.problems[i]) {
+					t.Errorf("%v: problem %v: got %q, wanted it to mention %q", test.name, i, problems[i], test.problems[i])
+				}
+			}
+		}
+		if test.check != nil && !test.check(conf) {
+			t.Errorf("%v: unexpected config: %+v", test.name, conf)
+		}
+	}
+}
+
+// useConfigFile points the config file at path and resets the app config,
+// restoring both once the test is done.
+func useConfigFile(t *testing.T, path string) {
+	t.Helper()
+
+	oldPath, oldConf, oldProblems := configFilePath, appConf, configProblems
+	t.Cleanup(func() {
+		unlockConfig()
+		configFilePath, appConf, configProblems = oldPath, oldConf, oldProblems
+	})
+
+	configFilePath, appConf, configProblems = path, AppConfig{}, nil
+}
+
+func TestLoadConfigMigrates(t *testing.T) {
+	v0, err := os.ReadFile(filepath.Join("testdata", "config", "v0.yml"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, v0, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	useConfigFile(t, path)
+
+	loadConfig()
+
+	if len(configProblems) != 0 {
+		t.Errorf("unexpected problems: %v", configProblems)
+	}
+	if appConf.Version != CONFIG_VERSION || appConf.DeviceSettings["resolution"] != "300" {
+		t.Errorf("unexpected config: %+v", appConf)
+	}
+
+	backup, err := os.ReadFile(path + ".v0.bak")
+	if err != nil || string(backup) != string(v0) {
+		t.Errorf("the original config wasn't backed up: %v", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the upgraded config: %v", err)
+	}
+	var saved map[string]any
+	if err := yaml.Unmarshal(b, &saved); err != nil {
+		t.Fatalf("failed to parse the upgraded config: %v", err)
+	}
+	if saved["version"] != CONFIG_VERSION {
+		t.Errorf("the upgraded config wasn't saved: %v", saved["version"])
+	}
+	if _, ok := saved["devicemap"]; ok {
+		t.Errorf("the upgraded config still has devicemap")
+	}
+
+	// loading the upgraded config again doesn't back it up again
+	useConfigFile(t, path)
+	loadConfig()
+	matches, _ := filepath.Glob(path + "*.bak")
+	if len(matches) != 1 {
+		t.Errorf("unexpected backups: %v", matches)
+	}
+}
+
+// useActivityStore opens an activity log of its own as activityStore,
+// restoring the previous one once the test is done.
+func useActivityStore(t *testing.T) *activityLog {
+	t.Helper()
+
+	store, err := openActivityLog(filepath.Join(t.TempDir(), "activity.log"), ACTIVITY_LOG_MAX_SIZE, ACTIVITY_LOG_BACKUPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldStore := activityStore
+	activityStore = store
+	t.Cleanup(func() {
+		store.Close()
+		activityStore = oldStore
+	})
+
+	return store
+}
+
+func TestLoadConfigMovesActivity(t *testing.T) {
+	store := useActivityStore(t)
+
+	// old versions added a paragraph after the placeholder for each entry
+	v0, err := os.ReadFile(filepath.Join("testdata", "config", "v0.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Replace(string(v0), "<br/>", "<br/><p>scanning to /home/user/scans/a.png...</p><p>successfully wrote <b>a &amp; b.png</b></p>", 1)
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	useConfigFile(t, path)
+
+	loadConfig()
+
+	if len(configProblems) != 0 || appConf.SelectedDir != "/home/user/scans" {
+		t.Errorf("unexpected config: %+v, %v", appConf, configProblems)
+	}
+
+	entries, err := store.Tail(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Message != "scanning to /home/user/scans/a.png..." || entries[1].Message != "successfully wrote a & b.png" {
+		t.Fatalf("the activity wasn't moved to the activity log: %+v", entries)
+	}
+	if !entries[0].Time.IsZero() || entries[0].Level != slog.LevelInfo {
+		t.Errorf("unexpected entry: %+v", entries[0])
+	}
+
+	b, _ := os.ReadFile(path)
+	if strings.Contains(string(b), "log:") {
+		t.Errorf("the upgraded config still has the log: %q", b)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	if err := os.WriteFile(path, []byte("selecteddir: [\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	useConfigFile(t, path)
+
+	loadConfig()
+
+	if len(configProblems) != 1 || !strings.Contains(configProblems[0], "not valid YAML") {
+		t.Errorf("unexpected problems: %v", configProblems)
+	}
+	if appConf.SelectedDir != "" || appConf.Version != CONFIG_VERSION {
+		t.Errorf("expected the default config, got %+v", appConf)
+	}
+
+	backup, err := os.ReadFile(path + ".invalid.bak")
+	if err != nil || string(backup) != "selecteddir: [\n" {
+		t.Errorf("the invalid config wasn't backed up: %q, %v", backup, err)
+	}
+
+	// a missing file isn't a problem
+	useConfigFile(t, filepath.Join(dir, "missing.yml"))
+	loadConfig()
+	if len(configProblems) != 0 {
+		t.Errorf("missing file: unexpected problems: %v", configProblems)
+	}
+}
+
+func TestSaveConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "go-fltk-sane", "config.yml")
+	useConfigFile(t, path)
+
+	appConf = AppConfig{Version: CONFIG_VERSION, SelectedDir: "/scans"}
+	saveConfig()
+
+	b, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(b), "selecteddir: /scans") {
+		t.Fatalf("the config wasn't saved: %q, %v", b, err)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("temporary files were left behind: %v", entries)
+	}
+
+	// settings that didn't change aren't written again
+	if err := os.WriteFile(path, []byte("edited"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	saveConfig()
+	b, _ = os.ReadFile(path)
+	if string(b) != "edited" {
+		t.Errorf("the unchanged config was written again: %q", b)
+	}
+
+	appConf.SelectedDir = "/other"
+	saveConfig()
+	b, _ = os.ReadFile(path)
+	if !strings.Contains(string(b), "selecteddir: /other") {
+		t.Errorf("the changed config wasn't saved: %q", b)
+	}
+
+	// the token of the HTTP API is kept from other users
+	appConf.APIToken = "secret"
+	saveConfig()
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("the config with a token can be read by others: %v, %v", info.Mode(), err)
+	}
+}
+
+func TestDebouncer(t *testing.T) {
+	var calls atomic.Int32
+	done := make(chan struct{}, 10)
+	d := newDebouncer(50*time.Millisecond, func() {
+		calls.Add(1)
+		done <- struct{}{}
+	})
+
+	for i := 0; i < 5; i++ {
+		d.Trigger()
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("fn was never called")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := calls.Load(); n != 1 {
+		t.Errorf("fn was called %v times, wanted once", n)
+	}
+
+	d.Trigger()
+	if !d.Stop() {
+		t.Errorf("stop: expected a pending call")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := calls.Load(); n != 1 {
+		t.Errorf("fn was called after being stopped")
+	}
+	if d.Stop() {
+		t.Errorf("stop: expected no pending call")
+	}
+}
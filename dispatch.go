@@ -0,0 +1,42 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/pwiecz/go-fltk"
+)
+
+// FLTK widgets may only be used from the thread that runs the event loop,
+// which is the main goroutine, locked to the main thread. Widget callbacks
+// already run there. Any other goroutine, such as a scan job, must hand its
+// changes to the widgets over to onUI instead.
+
+func init() {
+	// FLTK, and the windowing systems beneath it, expect to be used from the
+	// main thread, and the main goroutine must not move away from it
+	runtime.LockOSThread()
+}
+
+// onUI runs fn on the UI thread once the event loop gets to it. It can be
+// called from any goroutine, and doesn't wait for fn to run.
+func onUI(fn func()) {
+	fltk.Awake(fn)
+}
+
+// callOnUI runs fn on the UI thread, like onUI, and waits for it to return. It
+// must not be called from the UI thread itself, which would never get to fn.
+func callOnUI(fn func()) {
+	done := make(chan struct{})
+	onUI(func() {
+		defer close(done)
+		fn()
+	})
+	<-done
+}
+
+// showError shows an error dialog. It can be called from any goroutine.
+func showError(msg string) {
+	onUI(func() {
+		fltk.MessageBox("Error", msg)
+	})
+}
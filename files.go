@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The largest width or height of the thumbnails in the gallery, in pixels.
+// They are scaled down further to fit the gallery.
+const THUMBNAIL_SIZE = 128
+
+// scannedFile is an image or document that is shown in the gallery, either
+// because it was scanned during this session or because it is in the output
+// directory.
+type scannedFile struct {
+	Path    string
+	ModTime time.Time
+	// The request that scanned the file, if it can be scanned again to
+	// replace it. Only single page scans that weren't appended to a PDF can
+	// be.
+	Request *scanRequest
+}
+
+// isScanFile returns true if the file is one of the formats that this
+// application scans to.
+func isScanFile(name string) bool {
+	return getFileType(name) != ""
+}
+
+// listScanFiles returns the images and documents in dir, newest first.
+// Subdirectories are not included.
+func listScanFiles(dir string) ([]scannedFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %v: %w", dir, err)
+	}
+
+	files := []scannedFile{}
+	for _, entry := range entries {
+		// hidden files include scans that are still being written
+		if !entry.Type().IsRegular() || !isScanFile(entry.Name()) || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			// removed since the directory was read
+			continue
+		}
+
+		files = append(files, scannedFile{Path: filepath.Join(dir, entry.Name()), ModTime: info.ModTime()})
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].ModTime.Equal(files[j].ModTime) {
+			return files[i].Path > files[j].Path
+		}
+		return files[i].ModTime.After(files[j].ModTime)
+	})
+
+	return files, nil
+}
+
+// makeThumbnail returns a copy of img that is scaled down to fit within size by
+// size pixels, keeping its aspect ratio. Each pixel of the thumbnail is the
+// average of the pixels that it covers, so that text and lines don't vanish.
+// Images that already fit are copied as they are.
+func makeThumbnail(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	tw, th := w, h
+	if w > size || h > size {
+		if w >= h {
+			tw, th = size, max(h*size/w, 1)
+		} else {
+			tw, th = max(w*size/h, 1), size
+		}
+	}
+
+	sum := getPixelSummer(img)
+
+	thumb := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for ty := 0; ty < th; ty++ {
+		y0, y1 := b.Min.Y+ty*h/th, b.Min.Y+max((ty+1)*h/th, ty*h/th+1)
+		for tx := 0; tx < tw; tx++ {
+			x0, x1 := b.Min.X+tx*w/tw, b.Min.X+max((tx+1)*w/tw, tx*w/tw+1)
+
+			r, g, bl, a := sum(image.Rect(x0, y0, x1, y1))
+			n := uint64((x1 - x0) * (y1 - y0))
+
+			thumb.SetRGBA(tx, ty, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+
+	return thumb
+}
+
+// getPixelSummer returns a function that adds up the 16-bit red, green, blue
+// and alpha values of the pixels of img within r. Gray and RGBA images, which
+// is what pngs of scans are decoded to, are read from their pixels directly,
+// and YCbCr images, which jpegs are decoded to, without going through
+// img.At, which would be called millions of times for a page scanned at a
+// high resolution.
+func getPixelSummer(img image.Image) func(r image.Rectangle) (uint64, uint64, uint64, uint64) {
+	switch img := img.(type) {
+	case *image.Gray:
+		return func(r image.Rectangle) (uint64, uint64, uint64, uint64) {
+			var v uint64
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for _, p := range img.Pix[img.PixOffset(r.Min.X, y):][:r.Dx()] {
+					v += uint64(p)
+				}
+			}
+			v *= 0x101
+			return v, v, v, uint64(r.Dx()*r.Dy()) * 0xffff
+		}
+	case *image.RGBA:
+		return func(r image.Rectangle) (uint64, uint64, uint64, uint64) {
+			var cr, cg, cb, ca uint64
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				row := img.Pix[img.PixOffset(r.Min.X, y):][:r.Dx()*4]
+				for i := 0; i < len(row); i += 4 {
+					cr, cg, cb, ca = cr+uint64(row[i]), cg+uint64(row[i+1]), cb+uint64(row[i+2]), ca+uint64(row[i+3])
+				}
+			}
+			return cr * 0x101, cg * 0x101, cb * 0x101, ca * 0x101
+		}
+	case *image.YCbCr:
+		return func(r image.Rectangle) (uint64, uint64, uint64, uint64) {
+			var cr, cg, cb uint64
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					pr, pg, pb, _ := img.YCbCrAt(x, y).RGBA()
+					cr, cg, cb = cr+uint64(pr), cg+uint64(pg), cb+uint64(pb)
+				}
+			}
+			return cr, cg, cb, uint64(r.Dx()*r.Dy()) * 0xffff
+		}
+	}
+
+	return func(r image.Rectangle) (uint64, uint64, uint64, uint64) {
+		var cr, cg, cb, ca uint64
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				pr, pg, pb, pa := img.At(x, y).RGBA()
+				cr, cg, cb, ca = cr+uint64(pr), cg+uint64(pg), cb+uint64(pb), ca+uint64(pa)
+			}
+		}
+		return cr, cg, cb, ca
+	}
+}
+
+// loadThumbnail decodes the png or jpeg image at path and returns a thumbnail
+// of it. PDFs aren't decoded, so they don't have thumbnails.
+func loadThumbnail(path string, size int) (*image.RGBA, error) {
+	if strings.ToLower(filepath.Ext(path)) == ".pdf" {
+		return nil, fmt.Errorf("thumbnails of pdf documents are not supported")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %w", path, err)
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v: %w", path, err)
+	}
+
+	return makeThumbnail(img, size), nil
+}
+
+// renameScanFile renames the file at path to name, within the same directory,
+// and returns its new path. The extension of the file is kept if name doesn't
+// have one. An existing file is never replaced.
+func renameScanFile(path, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("%q is not a valid file name", name)
+	}
+
+	if filepath.Ext(name) == "" {
+		name += filepath.Ext(path)
+	}
+	if !isScanFile(name) {
+		return "", fmt.Errorf("%v must end in .png, .jpg, .jpeg or .pdf", name)
+	}
+
+	newPath := filepath.Join(filepath.Dir(path), name)
+	if newPath == path {
+		return path, nil
+	}
+
+	_, err := os.Lstat(newPath)
+	if err == nil {
+		return "", fmt.Errorf("%v already exists", newPath)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("failed to check %v: %w", newPath, err)
+	}
+
+	err = os.Rename(path, newPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to rename %v: %w", path, err)
+	}
+
+	return newPath, nil
+}
+
+// openFile opens the file in the desktop's default application for it. It
+// doesn't wait for the application to exit.
+func openFile(path string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", path)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", path)
+	default:
+		cmd = exec.Command("xdg-open", path)
+	}
+
+	err := cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to open %v: %w", path, err)
+	}
+
+	go cmd.Wait()
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListScanFiles(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	files := []struct {
+		name string
+		age  time.Duration
+	}{
+		{name: "old.png", age: 3 * time.Hour},
+		{name: "new.pdf", age: time.Minute},
+		{name: "middle.JPG", age: time.Hour},
+		{name: "notes.txt", age: 0},
+		{name: "config.yml", age: 0},
+		{name: ".go-fltk-sane-1.png", age: 0},
+	}
+	for _, f := range files {
+		p := filepath.Join(dir, f.name)
+		if err := os.WriteFile(p, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, now.Add(-f.age), now.Add(-f.age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "pages.png"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := listScanFiles(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"new.pdf", "middle.JPG", "old.png"}
+	if len(got) != len(expected) {
+		t.Fatalf("got %v files, wanted %v: %v", len(got), len(expected), got)
+	}
+	for i := range expected {
+		if got[i].Path != filepath.Join(dir, expected[i]) {
+			t.Errorf("file %v: got %v, wanted %v", i, got[i].Path, expected[i])
+		}
+		if got[i].Request != nil {
+			t.Errorf("file %v: files in the directory can't be scanned again", i)
+		}
+	}
+
+	_, err = listScanFiles(filepath.Join(dir, "missing"))
+	if err == nil {
+		t.Errorf("missing directory: expected an error but got nil")
+	}
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	tests := []struct {
+		w      int
+		h      int
+		size   int
+		expect image.Point
+	}{
+		{w: 400, h: 200, size: 100, expect: image.Pt(100, 50)},
+		{w: 200, h: 400, size: 100, expect: image.Pt(50, 100)},
+		{w: 1000, h: 3, size: 100, expect: image.Pt(100, 1)},
+		{w: 50, h: 20, size: 100, expect: image.Pt(50, 20)},
+	}
+
+	for _, test := range tests {
+		img := image.NewGray(image.Rect(10, 10, 10+test.w, 10+test.h))
+		got := makeThumbnail(img, test.size)
+		if got.Bounds().Size() != test.expect {
+			t.Errorf("%vx%v: got %v, wanted %v", test.w, test.h, got.Bounds().Size(), test.expect)
+		}
+	}
+
+	// each pixel averages the pixels it covers
+	img := image.NewGray(image.Rect(0, 0, 4, 2))
+	img.SetGray(0, 0, color.Gray{Y: 255})
+	img.SetGray(1, 1, color.Gray{Y: 255})
+	got := makeThumbnail(img, 2).RGBAAt(0, 0)
+	if got.R != 127 || got.A != 255 {
+		t.Errorf("averaged pixel: got %v, wanted a gray of 127", got)
+	}
+	if got := makeThumbnail(img, 2).RGBAAt(1, 0); got.R != 0 {
+		t.Errorf("black pixel: got %v", got)
+	}
+
+	// the images that scans are decoded to are read directly, with the same
+	// result as reading them through At
+	r := image.Rect(3, 2, 23, 13)
+	gray, rgba, ycbcr := image.NewGray(r), image.NewRGBA(r), image.NewYCbCr(r, image.YCbCrSubsampleRatio422)
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 7)
+	}
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(i * 13)
+	}
+	for i := range ycbcr.Y {
+		ycbcr.Y[i] = uint8(i * 11)
+	}
+	for i := range ycbcr.Cb {
+		ycbcr.Cb[i], ycbcr.Cr[i] = uint8(i*5), uint8(255-i*3)
+	}
+
+	for _, img := range []image.Image{gray, rgba, ycbcr, rgba.SubImage(image.Rect(5, 4, 20, 12))} {
+		got, expected := makeThumbnail(img, 6), makeThumbnail(opaqueImage{img}, 6)
+		if !bytes.Equal(got.Pix, expected.Pix) {
+			t.Errorf("%T: got %v, wanted %v", img, got.Pix, expected.Pix)
+		}
+	}
+}
+
+func TestLoadThumbnail(t *testing.T) {
+	thumb, err := loadThumbnail(filepath.Join("testdata", "scanimage", "image.png"), 8)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s := thumb.Bounds().Size(); s.X > 8 || s.Y > 8 || s.X == 0 || s.Y == 0 {
+		t.Errorf("thumbnail doesn't fit: %v", s)
+	}
+
+	_, err = loadThumbnail(filepath.Join(t.TempDir(), "doc.pdf"), 8)
+	if err == nil {
+		t.Errorf("pdf: expected an error but got nil")
+	}
+}
+
+func TestRenameScanFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"scan.png", "taken.png"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+		wantErr  bool
+	}{
+		{name: "../escape.png", wantErr: true},
+		{name: "", wantErr: true},
+		{name: "taken.png", wantErr: true},
+		{name: "notes.txt", wantErr: true},
+		{name: "scan.png", expected: "scan.png"},
+		{name: " receipt ", expected: "receipt.png"},
+	}
+
+	path := filepath.Join(dir, "scan.png")
+	for _, test := range tests {
+		got, err := renameScanFile(path, test.name)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error but got %v", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		if got != filepath.Join(dir, test.expected) {
+			t.Errorf("%q: got %v, wanted %v", test.name, got, test.expected)
+		}
+		path = got
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "taken.png"))
+	if err != nil || string(b) != "taken.png" {
+		t.Errorf("an existing file was replaced: %q, %v", b, err)
+	}
+	b, err = os.ReadFile(filepath.Join(dir, "receipt.png"))
+	if err != nil || string(b) != "scan.png" {
+		t.Errorf("the renamed file is missing: %q, %v", b, err)
+	}
+}
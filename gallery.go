@@ -0,0 +1,415 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pwiecz/go-fltk"
+)
+
+// The gap, in pixels, between the thumbnails in the gallery, and the height of
+// the file name beneath each thumbnail.
+const (
+	GALLERY_GAP          = 4
+	GALLERY_LABEL_HEIGHT = 14
+)
+
+// How many thumbnails are decoded at the same time.
+const THUMBNAIL_WORKERS = 2
+
+// galleryThumb is a thumbnail that was loaded for the gallery. It is only used
+// while the file hasn't been modified since.
+type galleryThumb struct {
+	ModTime time.Time
+	Image   *fltk.RgbImage
+}
+
+// The state of the gallery. It belongs to the UI thread.
+var (
+	// The files that were scanned during this session, oldest first.
+	sessionFiles []scannedFile
+	// The files that are shown in the gallery, newest first.
+	galleryFiles []scannedFile
+	// The path of the selected file, if any.
+	gallerySelected string
+	// The thumbnail button of each file that is shown, by path.
+	galleryButtons map[string]*fltk.Button
+	// The thumbnails that were loaded, by path. The ones that are no longer
+	// shown, such as those of deleted files or of another directory, are
+	// destroyed as the gallery is rebuilt.
+	galleryThumbs = make(map[string]galleryThumb)
+	// The files whose thumbnails are being loaded.
+	galleryLoading = make(map[string]bool)
+	// Limits how many thumbnails are decoded at the same time.
+	thumbnailSem = make(chan struct{}, THUMBNAIL_WORKERS)
+)
+
+// addScannedFile adds a file that was just written by a scan to the gallery,
+// and selects it. rescan is the request that can scan the file again, if any.
+func addScannedFile(path string, rescan *scanRequest) {
+	info, err := os.Stat(path)
+	if err != nil {
+		Warnf("unable to show %v in the gallery: %v", path, err.Error())
+		return
+	}
+
+	for i := range sessionFiles {
+		if sessionFiles[i].Path == path {
+			sessionFiles = append(sessionFiles[:i], sessionFiles[i+1:]...)
+			break
+		}
+	}
+
+	sessionFiles = append(sessionFiles, scannedFile{Path: path, ModTime: info.ModTime(), Request: rescan})
+	gallerySelected = path
+
+	refreshGallery()
+}
+
+// refreshGallery lists the files of this session, newest first, followed by
+// the other files in the output directory if the user asked for them, and
+// shows them in the gallery.
+func refreshGallery() {
+	galleryFiles = []scannedFile{}
+	shown := make(map[string]bool)
+
+	for i := len(sessionFiles) - 1; i >= 0; i-- {
+		galleryFiles = append(galleryFiles, sessionFiles[i])
+		shown[sessionFiles[i].Path] = true
+	}
+
+	if appConf.GalleryShowDir && appConf.SelectedDir != "" {
+		files, err := listScanFiles(appConf.SelectedDir)
+		if err != nil {
+			Warnf("unable to show the output directory in the gallery: %v", err.Error())
+		}
+
+		for _, f := range files {
+			if !shown[f.Path] {
+				galleryFiles = append(galleryFiles, f)
+			}
+		}
+	}
+
+	if _, ok := getGalleryFile(gallerySelected); !ok {
+		gallerySelected = ""
+	}
+
+	rebuildGallery()
+}
+
+// getGalleryFile returns the file at path, if it is shown in the gallery.
+func getGalleryFile(path string) (scannedFile, bool) {
+	for _, f := range galleryFiles {
+		if f.Path == path {
+			return f, true
+		}
+	}
+
+	return scannedFile{}, false
+}
+
+// rebuildGallery replaces the thumbnails in the gallery with a button for each
+// of galleryFiles, sized to fit the height of the gallery. Thumbnails that
+// haven't been loaded yet are loaded in the background.
+func rebuildGallery() {
+	if galleryPack != nil {
+		galleryScroll.Remove(galleryPack)
+		galleryPack.Destroy()
+	}
+
+	// no button shows a thumbnail now, so the ones that won't be shown again
+	// can be destroyed
+	pruneGalleryThumbs()
+
+	galleryScroll.Begin()
+	defer galleryScroll.End()
+
+	// the gallery has no size until the window is first laid out
+	h := max(galleryScroll.H()-fltk.ScrollbarSize(), GALLERY_LABEL_HEIGHT*2)
+	w := h
+	galleryPack = fltk.NewPack(galleryScroll.X(), galleryScroll.Y(), galleryScroll.W(), h)
+	galleryPack.SetType(fltk.HORIZONTAL)
+	galleryPack.SetSpacing(GALLERY_GAP)
+	defer galleryPack.End()
+
+	galleryButtons = make(map[string]*fltk.Button)
+
+	if len(galleryFiles) == 0 {
+		placeholder := fltk.NewBox(fltk.NO_BOX, 0, 0, max(galleryScroll.W(), 1), h, "Scanned files will appear here")
+		placeholder.SetAlign(fltk.ALIGN_INSIDE | fltk.ALIGN_LEFT | fltk.ALIGN_WRAP)
+		updateGalleryActions()
+		return
+	}
+
+	for _, f := range galleryFiles {
+		path := f.Path
+
+		btn := fltk.NewButton(0, 0, w, h, filepath.Base(path))
+		btn.SetAlign(fltk.ALIGN_INSIDE | fltk.ALIGN_BOTTOM | fltk.ALIGN_IMAGE_OVER_TEXT | fltk.ALIGN_CLIP)
+		btn.SetLabelSize(10)
+		btn.SetTooltip(path)
+		btn.SetValue(path == gallerySelected)
+		btn.SetCallback(func() {
+			selectGalleryFile(path)
+			if fltk.EventClicks() > 0 {
+				openGalleryFile()
+			}
+		})
+		galleryButtons[path] = btn
+
+		thumb, ok := galleryThumbs[path]
+		switch {
+		case ok && thumb.ModTime.Equal(f.ModTime):
+			setGalleryThumb(btn, thumb.Image)
+		case isScanFile(path) && filepath.Ext(path) != ".pdf":
+			loadGalleryThumb(f)
+		}
+	}
+
+	updateGalleryActions()
+
+	galleryScroll.ScrollTo(0, 0)
+	galleryScroll.Redraw()
+}
+
+// pruneGalleryThumbs destroys the thumbnails of files that aren't in
+// galleryFiles, or that were changed since their thumbnail was loaded. It must
+// only be called while no button shows them.
+func pruneGalleryThumbs() {
+	shown := make(map[string]time.Time, len(galleryFiles))
+	for _, f := range galleryFiles {
+		shown[f.Path] = f.ModTime
+	}
+
+	for path, thumb := range galleryThumbs {
+		modTime, ok := shown[path]
+		if ok && thumb.ModTime.Equal(modTime) {
+			continue
+		}
+
+		thumb.Image.Destroy()
+		delete(galleryThumbs, path)
+	}
+}
+
+// setGalleryThumb shows the thumbnail on the button, scaled to leave room for
+// the file name.
+func setGalleryThumb(btn *fltk.Button, img *fltk.RgbImage) {
+	img.Scale(btn.W()-GALLERY_GAP, btn.H()-GALLERY_LABEL_HEIGHT-GALLERY_GAP, true, false)
+	btn.SetImage(img)
+	btn.Redraw()
+}
+
+// loadGalleryThumb decodes the thumbnail of the file in the background, and
+// shows it on the file's button once it's done.
+func loadGalleryThumb(f scannedFile) {
+	if galleryLoading[f.Path] {
+		return
+	}
+	galleryLoading[f.Path] = true
+
+	go func() {
+		thumbnailSem <- struct{}{}
+		thumb, err := loadThumbnail(f.Path, THUMBNAIL_SIZE)
+		<-thumbnailSem
+
+		onUI(func() {
+			delete(galleryLoading, f.Path)
+			if err != nil {
+				Warnf("unable to load the thumbnail of %v: %v", f.Path, err.Error())
+				return
+			}
+
+			showGalleryThumb(f, thumb)
+		})
+	}()
+}
+
+// showGalleryThumb keeps the thumbnail that was loaded for the file, and shows
+// it if the file is still in the gallery.
+func showGalleryThumb(f scannedFile, thumb *image.RGBA) {
+	img, err := fltk.NewRgbImageFromImage(thumb)
+	if err != nil {
+		Warnf("unable to show the thumbnail of %v: %v", f.Path, err.Error())
+		return
+	}
+
+	old, replaced := galleryThumbs[f.Path]
+	galleryThumbs[f.Path] = galleryThumb{ModTime: f.ModTime, Image: img}
+
+	btn, ok := galleryButtons[f.Path]
+	if ok {
+		setGalleryThumb(btn, img)
+	}
+
+	// the button shows the new thumbnail now, if it showed the old one
+	if replaced {
+		old.Image.Destroy()
+	}
+}
+
+// selectGalleryFile selects the file in the gallery, which the gallery's
+// actions apply to.
+func selectGalleryFile(path string) {
+	gallerySelected = path
+	for p, btn := range galleryButtons {
+		btn.SetValue(p == path)
+	}
+
+	updateGalleryActions()
+}
+
+// updateGalleryActions activates the actions that apply to the selected file.
+func updateGalleryActions() {
+	f, ok := getGalleryFile(gallerySelected)
+
+	for _, btn := range []*fltk.Button{galleryOpenBtn, galleryRenameBtn, galleryDeleteBtn} {
+		if ok {
+			btn.Activate()
+		} else {
+			btn.Deactivate()
+		}
+	}
+
+	if ok && f.Request != nil {
+		galleryRescanBtn.Activate()
+	} else {
+		galleryRescanBtn.Deactivate()
+	}
+}
+
+// openGalleryFile opens the selected file in the desktop's default application.
+func openGalleryFile() {
+	f, ok := getGalleryFile(gallerySelected)
+	if !ok {
+		return
+	}
+
+	err := openFile(f.Path)
+	if err != nil {
+		fltk.MessageBox("Error", fmt.Sprintf("Unable to open the file: %v", err.Error()))
+	}
+}
+
+// renameGalleryFile asks for a new name for the selected file, and renames it.
+func renameGalleryFile() {
+	f, ok := getGalleryFile(gallerySelected)
+	if !ok {
+		return
+	}
+
+	promptText("Rename", fmt.Sprintf("New name for %v:", filepath.Base(f.Path)), filepath.Base(f.Path), func(name string) {
+		newPath, err := renameScanFile(f.Path, name)
+		if err != nil {
+			fltk.MessageBox("Error", fmt.Sprintf("Unable to rename the file: %v", err.Error()))
+			return
+		}
+		if newPath == f.Path {
+			return
+		}
+
+		Logf("renamed %v to %v", f.Path, newPath)
+
+		for i := range sessionFiles {
+			if sessionFiles[i].Path != f.Path {
+				continue
+			}
+			sessionFiles[i].Path = newPath
+			if sessionFiles[i].Request != nil {
+				// scanning it again replaces the renamed file
+				r := *sessionFiles[i].Request
+				r.Filename = newPath
+				sessionFiles[i].Request = &r
+			}
+		}
+
+		if thumb, ok := galleryThumbs[f.Path]; ok {
+			galleryThumbs[newPath] = thumb
+			delete(galleryThumbs, f.Path)
+		}
+
+		gallerySelected = newPath
+		refreshGallery()
+	})
+}
+
+// deleteGalleryFile deletes the selected file, once the user confirms it.
+func deleteGalleryFile() {
+	f, ok := getGalleryFile(gallerySelected)
+	if !ok {
+		return
+	}
+
+	if fltk.ChoiceDialog(fmt.Sprintf("Delete %v?", f.Path), "Delete", "Cancel") != 0 {
+		return
+	}
+
+	err := os.Remove(f.Path)
+	if err != nil {
+		fltk.MessageBox("Error", fmt.Sprintf("Unable to delete the file: %v", err.Error()))
+		return
+	}
+
+	Logf("deleted %v", f.Path)
+
+	for i := range sessionFiles {
+		if sessionFiles[i].Path == f.Path {
+			sessionFiles = append(sessionFiles[:i], sessionFiles[i+1:]...)
+			break
+		}
+	}
+
+	// the thumbnail is destroyed as the gallery is rebuilt without the file
+	refreshGallery()
+}
+
+// rescanGalleryFile scans the selected file again with the settings that it
+// was first scanned with, replacing it.
+func rescanGalleryFile() {
+	f, ok := getGalleryFile(gallerySelected)
+	if !ok || f.Request == nil {
+		return
+	}
+
+	err := submitScan(*f.Request)
+	if err != nil {
+		fltk.MessageBox("Error", fmt.Sprintf("Unable to queue the scan: %v", err.Error()))
+	}
+}
+
+// promptText asks the user for a line of text in a small modal window, and
+// calls onOK with the text unless the user cancels.
+func promptText(title string, label string, value string, onOK func(text string)) {
+	win := fltk.NewWindow(340, 100)
+	win.SetLabel(title)
+	win.SetModal()
+
+	input := fltk.NewInput(10, 30, 320, 25, label)
+	input.SetAlign(fltk.ALIGN_TOP_LEFT)
+	input.SetValue(value)
+
+	okBtn := fltk.NewReturnButton(170, 65, 75, 25, "OK")
+	promptCancelBtn := fltk.NewButton(255, 65, 75, 25, "Cancel")
+
+	win.End()
+
+	// the window can't be destroyed from within its own callbacks
+	closeWin := func() {
+		win.Hide()
+		onUI(win.Destroy)
+	}
+
+	okBtn.SetCallback(func() {
+		text := input.Value()
+		closeWin()
+		onOK(text)
+	})
+	promptCancelBtn.SetCallback(closeWin)
+	win.SetCallback(closeWin)
+
+	win.Show()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"strconv"
+)
+
+// The resolution, in DPI, that preview scans aim for. It is low enough for the
+// preview to be quick, and high enough to make out the edges of a document.
+const PREVIEW_RESOLUTION = 75
+
+// scanArea is the whole area that a device can scan, in the unit of its
+// geometry options, which is usually mm.
+type scanArea struct {
+	Left   float64
+	Top    float64
+	Width  float64
+	Height float64
+}
+
+// previewRegion is a region of a preview scan. The corners are fractions of
+// the preview's width and height, from 0 to 1, so that the region doesn't
+// depend on the resolution of the preview or on how large it is shown. The
+// corners may be in any order, such as when a rectangle is dragged up and to
+// the left.
+type previewRegion struct {
+	X0 float64
+	Y0 float64
+	X1 float64
+	Y1 float64
+}
+
+// wholePreviewRegion is the region that covers the whole preview.
+var wholePreviewRegion = previewRegion{X0: 0, Y0: 0, X1: 1, Y1: 1}
+
+// clamp01 limits f to the range 0 to 1.
+func clamp01(f float64) float64 {
+	return math.Min(math.Max(f, 0), 1)
+}
+
+// Normalize returns the region with its top-left corner first and the corners
+// limited to the preview.
+func (r previewRegion) Normalize() previewRegion {
+	return previewRegion{
+		X0: clamp01(math.Min(r.X0, r.X1)),
+		Y0: clamp01(math.Min(r.Y0, r.Y1)),
+		X1: clamp01(math.Max(r.X0, r.X1)),
+		Y1: clamp01(math.Max(r.Y0, r.Y1)),
+	}
+}
+
+// Empty returns true if the region has no width or no height.
+func (r previewRegion) Empty() bool {
+	n := r.Normalize()
+	return n.X1 <= n.X0 || n.Y1 <= n.Y0
+}
+
+// getGeometryOptions returns the l, t, x and y options, which are the left
+// and top of the scanned region and its width and height. Returns false unless
+// the device has all four as ranges.
+func getGeometryOptions(opts []DeviceOption) ([4]DeviceOption, bool) {
+	var geometry [4]DeviceOption
+
+	for i, name := range []string{"l", "t", "x", "y"} {
+		opt, ok := getDeviceOption(opts, name)
+		if !ok || opt.Kind != ConstraintRange {
+			return geometry, false
+		}
+		geometry[i] = opt
+	}
+
+	return geometry, true
+}
+
+// getScanArea returns the whole area that the device can scan, according to
+// the ranges of its geometry options. Returns false if the device can't scan
+// a region.
+func getScanArea(opts []DeviceOption) (scanArea, bool) {
+	g, ok := getGeometryOptions(opts)
+	if !ok || g[2].Max <= 0 || g[3].Max <= 0 {
+		return scanArea{}, false
+	}
+
+	return scanArea{Left: g[0].Min, Top: g[1].Min, Width: g[2].Max, Height: g[3].Max}, true
+}
+
+// snapToOption rounds f to the nearest value that the range option accepts,
+// and formats it for scanimage.
+func snapToOption(opt DeviceOption, f float64) string {
+	if opt.Step > 0 {
+		f = opt.Min + math.Round((f-opt.Min)/opt.Step)*opt.Step
+	}
+	f = math.Min(math.Max(f, opt.Min), opt.Max)
+
+	if opt.Type != OptionTypeInt {
+		// the steps of fixed point options rarely add up to round numbers
+		f = math.Round(f*10000) / 10000
+	}
+
+	return formatOptionNumber(f, opt.Type)
+}
+
+// getPreviewResolution returns the resolution that the device accepts that is
+// closest to PREVIEW_RESOLUTION, preferring a higher resolution over a lower
+// one. Returns an empty string if the device doesn't have a resolution option.
+func getPreviewResolution(opts []DeviceOption) string {
+	opt, ok := getDeviceOption(opts, "resolution")
+	if !ok {
+		return ""
+	}
+
+	switch opt.Kind {
+	case ConstraintRange:
+		return snapToOption(opt, PREVIEW_RESOLUTION)
+	case ConstraintList:
+		best, bestF := "", 0.0
+		for _, v := range opt.Values {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+
+			// the lowest resolution that is at least PREVIEW_RESOLUTION, or
+			// else the highest one
+			switch {
+			case best == "",
+				f >= PREVIEW_RESOLUTION && (bestF < PREVIEW_RESOLUTION || f < bestF),
+				f < PREVIEW_RESOLUTION && bestF < PREVIEW_RESOLUTION && f > bestF:
+				best, bestF = v, f
+			}
+		}
+		return best
+	}
+
+	return ""
+}
+
+// getPreviewSettings returns a copy of the settings that scans the whole area
+// of the device at the preview resolution, so that a region can be chosen
+// from the preview.
+func getPreviewSettings(opts []DeviceOption, settings map[string]string) map[string]string {
+	preview := maps.Clone(settings)
+	if preview == nil {
+		preview = make(map[string]string)
+	}
+
+	if res := getPreviewResolution(opts); res != "" {
+		preview["resolution"] = res
+	}
+
+	if g, ok := getGeometryOptions(opts); ok {
+		preview["l"] = snapToOption(g[0], g[0].Min)
+		preview["t"] = snapToOption(g[1], g[1].Min)
+		preview["x"] = snapToOption(g[2], g[2].Max)
+		preview["y"] = snapToOption(g[3], g[3].Max)
+	}
+
+	return preview
+}
+
+// regionToGeometry converts a region of a preview of the whole scan area into
+// the l, t, x and y settings that scan only that region.
+func regionToGeometry(opts []DeviceOption, r previewRegion) (map[string]string, error) {
+	g, ok := getGeometryOptions(opts)
+	area, areaOK := getScanArea(opts)
+	if !ok || !areaOK {
+		return nil, fmt.Errorf("the device doesn't support scanning a region")
+	}
+
+	if r.Empty() {
+		return nil, fmt.Errorf("the selected region is empty")
+	}
+
+	r = r.Normalize()
+
+	return map[string]string{
+		"l": snapToOption(g[0], area.Left+r.X0*area.Width),
+		"t": snapToOption(g[1], area.Top+r.Y0*area.Height),
+		"x": snapToOption(g[2], (r.X1-r.X0)*area.Width),
+		"y": snapToOption(g[3], (r.Y1-r.Y0)*area.Height),
+	}, nil
+}
+
+// geometryToRegion returns the region of a preview of the whole scan area
+// that the settings scan, falling back to the device's current geometry for
+// the settings that haven't been chosen. Returns the whole preview if the
+// device doesn't support scanning a region.
+func geometryToRegion(opts []DeviceOption, settings map[string]string) previewRegion {
+	g, ok := getGeometryOptions(opts)
+	area, areaOK := getScanArea(opts)
+	if !ok || !areaOK {
+		return wholePreviewRegion
+	}
+
+	var values [4]float64
+	for i, opt := range g {
+		v, ok := settings[opt.Name]
+		if !ok {
+			v = opt.Current
+		}
+
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return wholePreviewRegion
+		}
+		values[i] = f
+	}
+
+	x0 := (values[0] - area.Left) / area.Width
+	y0 := (values[1] - area.Top) / area.Height
+
+	return previewRegion{
+		X0: x0,
+		Y0: y0,
+		X1: x0 + values[2]/area.Width,
+		Y1: y0 + values[3]/area.Height,
+	}.Normalize()
+}
+
+// fitRect returns the largest rectangle with the aspect ratio of a w by h
+// image that fits within bounds, centered within it.
+func fitRect(w, h int, bounds Pos) Pos {
+	if w <= 0 || h <= 0 || bounds.W <= 0 || bounds.H <= 0 {
+		return Pos{X: bounds.X, Y: bounds.Y}
+	}
+
+	scale := math.Min(float64(bounds.W)/float64(w), float64(bounds.H)/float64(h))
+	fw := max(int(math.Round(float64(w)*scale)), 1)
+	fh := max(int(math.Round(float64(h)*scale)), 1)
+
+	return Pos{X: bounds.X + (bounds.W-fw)/2, Y: bounds.Y + (bounds.H-fh)/2, W: fw, H: fh}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestGetPreviewResolution(t *testing.T) {
+	tests := []struct {
+		backend  string
+		expected string
+	}{
+		{backend: "brother", expected: "100"},
+		{backend: "epson2", expected: "75"},
+		{backend: "genesys", expected: "75"},
+		{backend: "hpaio", expected: "75"},
+		{backend: "test", expected: "75"},
+	}
+
+	for _, test := range tests {
+		got := getPreviewResolution(parseDeviceOptions(readOptionsFixture(t, test.backend)))
+		if got != test.expected {
+			t.Errorf("%v: got %v, wanted %v", test.backend, got, test.expected)
+		}
+	}
+
+	if got := getPreviewResolution(nil); got != "" {
+		t.Errorf("no options: got %v, wanted an empty string", got)
+	}
+}
+
+func TestGetPreviewSettings(t *testing.T) {
+	opts := parseDeviceOptions(readOptionsFixture(t, "test"))
+	settings := map[string]string{"mode": "Color", "resolution": "600", "l": "10", "x": "20"}
+
+	got := getPreviewSettings(opts, settings)
+	expected := map[string]string{"mode": "Color", "resolution": "75", "l": "0", "t": "0", "x": "200", "y": "200"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, wanted %v", got, expected)
+	}
+
+	if settings["resolution"] != "600" || settings["l"] != "10" {
+		t.Errorf("the original settings were modified: %v", settings)
+	}
+}
+
+func TestRegionToGeometry(t *testing.T) {
+	tests := []struct {
+		backend  string
+		region   previewRegion
+		expected map[string]string
+		wantErr  bool
+	}{
+		{
+			backend:  "test",
+			region:   previewRegion{X0: 0.25, Y0: 0.5, X1: 0.75, Y1: 0},
+			expected: map[string]string{"l": "50", "t": "0", "x": "100", "y": "100"},
+		},
+		{
+			backend:  "test",
+			region:   previewRegion{X0: -1, Y0: -1, X1: 2, Y1: 2},
+			expected: map[string]string{"l": "0", "t": "0", "x": "200", "y": "200"},
+		},
+		{
+			backend:  "epson2",
+			region:   wholePreviewRegion,
+			expected: map[string]string{"l": "0", "t": "0", "x": "215.9", "y": "297.18"},
+		},
+		{
+			// fixed point options are snapped to their steps
+			backend:  "brother",
+			region:   previewRegion{X0: 0.5, Y0: 0.5, X1: 1, Y1: 1},
+			expected: map[string]string{"l": "107.9901", "t": "177.7836", "x": "107.9901", "y": "177.7836"},
+		},
+		{backend: "test", region: previewRegion{X0: 0.5, Y0: 0.1, X1: 0.5, Y1: 0.9}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		opts := parseDeviceOptions(readOptionsFixture(t, test.backend))
+
+		got, err := regionToGeometry(opts, test.region)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%v %+v: expected an error but got %v", test.backend, test.region, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v %+v: unexpected error: %v", test.backend, test.region, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%v %+v: got %v, wanted %v", test.backend, test.region, got, test.expected)
+		}
+
+		for name, value := range got {
+			opt, _ := getDeviceOption(opts, name)
+			if err := opt.Validate(value); err != nil {
+				t.Errorf("%v %+v: the device doesn't accept %v=%v: %v", test.backend, test.region, name, value, err)
+			}
+		}
+	}
+
+	_, err := regionToGeometry(nil, wholePreviewRegion)
+	if err == nil {
+		t.Errorf("no options: expected an error but got nil")
+	}
+}
+
+func TestGeometryToRegion(t *testing.T) {
+	opts := parseDeviceOptions(readOptionsFixture(t, "test"))
+
+	// the device's current geometry is 80 by 100mm, out of 200 by 200mm
+	got := geometryToRegion(opts, nil)
+	expected := previewRegion{X0: 0, Y0: 0, X1: 0.4, Y1: 0.5}
+	if got != expected {
+		t.Errorf("current geometry: got %+v, wanted %+v", got, expected)
+	}
+
+	got = geometryToRegion(opts, map[string]string{"l": "50", "t": "20", "x": "100", "y": "500"})
+	expected = previewRegion{X0: 0.25, Y0: 0.1, X1: 0.75, Y1: 1}
+	if got != expected {
+		t.Errorf("settings: got %+v, wanted %+v", got, expected)
+	}
+
+	if got := geometryToRegion(nil, nil); got != wholePreviewRegion {
+		t.Errorf("no options: got %+v, wanted the whole preview", got)
+	}
+
+	// converting a region back and forth only loses the precision of the
+	// options' steps
+	brother := parseDeviceOptions(readOptionsFixture(t, "brother"))
+	region := previewRegion{X0: 0.1, Y0: 0.2, X1: 0.6, Y1: 0.9}
+	geometry, err := regionToGeometry(brother, region)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got = geometryToRegion(brother, geometry)
+	for i, pair := range [][2]float64{{got.X0, region.X0}, {got.Y0, region.Y0}, {got.X1, region.X1}, {got.Y1, region.Y1}} {
+		if math.Abs(pair[0]-pair[1]) > 0.001 {
+			t.Errorf("round trip corner %v: got %v, wanted %v", i, pair[0], pair[1])
+		}
+	}
+}
+
+func TestFitRect(t *testing.T) {
+	tests := []struct {
+		w        int
+		h        int
+		bounds   Pos
+		expected Pos
+	}{
+		{w: 100, h: 200, bounds: Pos{X: 10, Y: 10, W: 100, H: 100}, expected: Pos{X: 35, Y: 10, W: 50, H: 100}},
+		{w: 200, h: 100, bounds: Pos{X: 0, Y: 0, W: 100, H: 100}, expected: Pos{X: 0, Y: 25, W: 100, H: 50}},
+		{w: 10, h: 10, bounds: Pos{X: 5, Y: 5, W: 40, H: 20}, expected: Pos{X: 15, Y: 5, W: 20, H: 20}},
+		{w: 0, h: 10, bounds: Pos{X: 5, Y: 5, W: 40, H: 20}, expected: Pos{X: 5, Y: 5}},
+	}
+
+	for _, test := range tests {
+		got := fitRect(test.w, test.h, test.bounds)
+		if got != test.expected {
+			t.Errorf("%vx%v in %+v: got %+v, wanted %+v", test.w, test.h, test.bounds, got, test.expected)
+		}
+	}
+}
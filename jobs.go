@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// JobState is where a scan job is in its lifecycle.
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// Done returns true if the job has finished, for better or worse.
+func (s JobState) Done() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobCancelled
+}
+
+// ScanJob is a scan that was submitted to a JobManager. The JobManager hands
+// out copies, so the fields reflect the job at the time it was retrieved.
+type ScanJob struct {
+	ID int
+	// A short description of the job, such as the file it scans to.
+	Name     string
+	State    JobState
+	Err      error
+	Queued   time.Time
+	Started  time.Time
+	Finished time.Time
+
+	run    func(ctx context.Context) error
+	cancel context.CancelFunc
+}
+
+// String summarizes the job for the user, such as "#2 running: scan.png".
+func (j ScanJob) String() string {
+	s := fmt.Sprintf("#%v %v: %v", j.ID, j.State, j.Name)
+	if j.State == JobFailed && j.Err != nil {
+		s = fmt.Sprintf("%v (%v)", s, j.Err.Error())
+	}
+
+	return s
+}
+
+// JobManager owns the scan jobs and runs them one at a time, in the order that
+// they were submitted, since a scanner can only do one scan at a time.
+type JobManager struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	jobs   []*ScanJob
+	nextID int
+	closed bool
+	// called without the lock held whenever a job changes state; it is
+	// called from the job manager's own goroutine
+	onChange func(job ScanJob)
+	done     chan struct{}
+}
+
+// NewJobManager starts a JobManager. onChange (if not nil) is called whenever
+// a job is submitted or changes state.
+func NewJobManager(onChange func(job ScanJob)) *JobManager {
+	m := &JobManager{onChange: onChange, nextID: 1, done: make(chan struct{})}
+	m.cond = sync.NewCond(&m.mu)
+
+	go m.work()
+
+	return m
+}
+
+// notify reports that the job changed. The lock must not be held.
+func (m *JobManager) notify(job ScanJob) {
+	if m.onChange != nil {
+		m.onChange(job)
+	}
+}
+
+// Submit queues a job that runs the provided function. The function should
+// stop as soon as possible once its context is cancelled.
+func (m *JobManager) Submit(name string, run func(ctx context.Context) error) (ScanJob, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ScanJob{}, fmt.Errorf("no more jobs are accepted")
+	}
+
+	job := &ScanJob{ID: m.nextID, Name: name, State: JobQueued, Queued: time.Now(), run: run}
+	m.nextID++
+	m.jobs = append(m.jobs, job)
+	snapshot := *job
+	m.cond.Signal()
+	m.mu.Unlock()
+
+	m.notify(snapshot)
+
+	return snapshot, nil
+}
+
+// next waits for the next queued job and marks it as running. Returns nil once
+// the manager is closed.
+func (m *JobManager) next() (*ScanJob, context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for {
+		if m.closed {
+			return nil, nil
+		}
+
+		for _, job := range m.jobs {
+			if job.State == JobQueued {
+				ctx, cancel := context.WithCancel(context.Background())
+				job.State = JobRunning
+				job.Started = time.Now()
+				job.cancel = cancel
+				return job, ctx
+			}
+		}
+
+		m.cond.Wait()
+	}
+}
+
+// work runs the queued jobs until the manager is closed.
+func (m *JobManager) work() {
+	defer close(m.done)
+
+	for {
+		job, ctx := m.next()
+		if job == nil {
+			return
+		}
+
+		m.mu.Lock()
+		m.notifyLocked(job)
+
+		err := job.run(ctx)
+
+		m.mu.Lock()
+		job.Finished = time.Now()
+		switch {
+		case ctx.Err() != nil:
+			job.State = JobCancelled
+			job.Err = ctx.Err()
+		case err != nil:
+			job.State = JobFailed
+			job.Err = err
+		default:
+			job.State = JobSucceeded
+		}
+		job.cancel()
+		job.cancel = nil
+		m.notifyLocked(job)
+	}
+}
+
+// notifyLocked releases the lock, which must be held, and reports that the
+// job changed.
+func (m *JobManager) notifyLocked(job *ScanJob) {
+	snapshot := *job
+	m.mu.Unlock()
+	m.notify(snapshot)
+}
+
+// Cancel cancels the job. Queued jobs are cancelled immediately; running
+// jobs are cancelled once their function returns. Returns an error if the job
+// doesn't exist or has already finished.
+func (m *JobManager) Cancel(id int) error {
+	m.mu.Lock()
+
+	for _, job := range m.jobs {
+		if job.ID != id {
+			continue
+		}
+
+		switch job.State {
+		case JobQueued:
+			job.State = JobCancelled
+			job.Err = context.Canceled
+			job.Finished = time.Now()
+			m.notifyLocked(job)
+			return nil
+		case JobRunning:
+			job.cancel()
+			m.mu.Unlock()
+			return nil
+		default:
+			m.mu.Unlock()
+			return fmt.Errorf("job #%v has already %v", id, job.State)
+		}
+	}
+
+	m.mu.Unlock()
+
+	return fmt.Errorf("job #%v does not exist", id)
+}
+
+// Running returns the job that is currently running, if there is one.
+func (m *JobManager) Running() (ScanJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, job := range m.jobs {
+		if job.State == JobRunning {
+			return *job, true
+		}
+	}
+
+	return ScanJob{}, false
+}
+
+// Jobs returns all of the jobs that were submitted, oldest first.
+func (m *JobManager) Jobs() []ScanJob {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	jobs := make([]ScanJob, len(m.jobs))
+	for i, job := range m.jobs {
+		jobs[i] = *job
+	}
+
+	return jobs
+}
+
+// Close cancels all of the queued and running jobs and waits for the running
+// job to stop, or for the context to be done. No more jobs are accepted.
+func (m *JobManager) Close(ctx context.Context) error {
+	m.mu.Lock()
+	m.closed = true
+	for _, job := range m.jobs {
+		switch job.State {
+		case JobQueued:
+			job.State = JobCancelled
+			job.Err = context.Canceled
+			job.Finished = time.Now()
+		case JobRunning:
+			job.cancel()
+		}
+	}
+	m.cond.Broadcast()
+	m.mu.Unlock()
+
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return errors.New("timed out waiting for the running job to stop")
+	}
+}
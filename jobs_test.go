@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForJob waits until the job has finished, and returns it.
+func waitForJob(t *testing.T, m *JobManager, id int) ScanJob {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, job := range m.Jobs() {
+			if job.ID == id && job.State.Done() {
+				return job
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("job #%v didn't finish in time", id)
+
+	return ScanJob{}
+}
+
+func TestJobManager(t *testing.T) {
+	var mu sync.Mutex
+	var changes []JobState
+	m := NewJobManager(func(job ScanJob) {
+		mu.Lock()
+		defer mu.Unlock()
+		if job.ID == 1 {
+			changes = append(changes, job.State)
+		}
+	})
+	defer m.Close(context.Background())
+
+	// the first job blocks until it is released, so that the others queue
+	// up behind it
+	release := make(chan struct{})
+	first, _ := m.Submit("first", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	second, _ := m.Submit("second", func(ctx context.Context) error {
+		return errors.New("paper jam")
+	})
+	third, _ := m.Submit("third", func(ctx context.Context) error {
+		t.Errorf("a cancelled job was run")
+		return nil
+	})
+
+	if first.State != JobQueued || first.ID != 1 || second.ID != 2 {
+		t.Errorf("unexpected submitted jobs: %v, %v", first, second)
+	}
+
+	err := m.Cancel(third.ID)
+	if err != nil {
+		t.Errorf("failed to cancel a queued job: %v", err)
+	}
+	close(release)
+
+	if job := waitForJob(t, m, first.ID); job.State != JobSucceeded {
+		t.Errorf("first job: got %v, wanted %v", job.State, JobSucceeded)
+	}
+	if job := waitForJob(t, m, second.ID); job.State != JobFailed || job.Err == nil {
+		t.Errorf("second job: got %v (%v), wanted %v", job.State, job.Err, JobFailed)
+	}
+	if job := waitForJob(t, m, third.ID); job.State != JobCancelled {
+		t.Errorf("third job: got %v, wanted %v", job.State, JobCancelled)
+	}
+
+	mu.Lock()
+	if len(changes) != 3 || changes[0] != JobQueued || changes[1] != JobRunning || changes[2] != JobSucceeded {
+		t.Errorf("unexpected state changes for the first job: %v", changes)
+	}
+	mu.Unlock()
+
+	if err := m.Cancel(first.ID); err == nil {
+		t.Errorf("expected an error when cancelling a finished job")
+	}
+	if err := m.Cancel(100); err == nil {
+		t.Errorf("expected an error when cancelling a job that doesn't exist")
+	}
+}
+
+func TestJobManagerCancelScan(t *testing.T) {
+	useFakeBackend(t, "slow")
+
+	m := NewJobManager(nil)
+	defer m.Close(context.Background())
+
+	filename := filepath.Join(t.TempDir(), "scan.png")
+	job, _ := m.Submit(filename, func(ctx context.Context) error {
+		_, err := performScan(ctx, scanRequest{Filename: filename, Device: "brother5:bus2;dev1"}, nil, nil)
+		return err
+	})
+
+	// wait for scanimage to start before cancelling it
+	for {
+		running, ok := m.Running()
+		if ok && running.ID == job.ID {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	err := m.Cancel(job.ID)
+	if err != nil {
+		t.Fatalf("failed to cancel the running job: %v", err)
+	}
+
+	got := waitForJob(t, m, job.ID)
+	if got.State != JobCancelled {
+		t.Errorf("got %v, wanted %v", got.State, JobCancelled)
+	}
+	if time.Since(start) >= COMMAND_WAIT_DELAY {
+		t.Errorf("scanimage wasn't interrupted, it had to be killed")
+	}
+}
+
+func TestJobManagerClose(t *testing.T) {
+	m := NewJobManager(nil)
+
+	started := make(chan struct{})
+	running, _ := m.Submit("running", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	queued, _ := m.Submit("queued", func(ctx context.Context) error {
+		return nil
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := m.Close(ctx)
+	if err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	for _, job := range m.Jobs() {
+		if job.State != JobCancelled {
+			t.Errorf("job #%v: got %v, wanted %v", job.ID, job.State, JobCancelled)
+		}
+	}
+	if running.ID == queued.ID {
+		t.Errorf("jobs should have distinct IDs")
+	}
+
+	_, err = m.Submit("late", func(ctx context.Context) error { return nil })
+	if err == nil {
+		t.Errorf("expected an error when submitting to a closed manager")
+	}
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pwiecz/go-fltk"
 )
@@ -17,25 +22,69 @@ import (
 // the helpview
 const MAX_TOP_LINE = 1000000
 
-// Wraps around log.Println() as well as adding activity to the
-// activity text buffer. Always adds a newline to the activity buffer.
-func Log(v ...any) {
-	activityText = fmt.Sprintf("%v<p>%v</p>", activityText, fmt.Sprintf("%v", v...))
-	activity.SetValue(activityText)
-	log.Println(v...)
-	activity.SetTopLine(MAX_TOP_LINE)
-	activity.SetTopLine(activity.TopLine() - activity.H()) // scroll to the bottom
+// How long a command is given to exit after it has been interrupted, before it
+// is killed.
+const COMMAND_WAIT_DELAY = 5 * time.Second
+
+// Guards activityEntries, which appendActivity adds to from any goroutine.
+var activityMu sync.Mutex
+
+// Set while an update of the activity view is waiting for the UI thread, so
+// that a burst of log messages only updates the view once.
+var activityPending atomic.Bool
+
+// appendActivity adds the entry to the activity view, dropping the oldest
+// entries past MAX_ACTIVITY_ENTRIES, and schedules an update of the view. It
+// is safe to call from any goroutine.
+func appendActivity(e activityEntry) {
+	s := renderActivityEntry(e)
+
+	activityMu.Lock()
+	activityEntries = append(activityEntries, s)
+	if len(activityEntries) > MAX_ACTIVITY_ENTRIES {
+		activityEntries = activityEntries[len(activityEntries)-MAX_ACTIVITY_ENTRIES:]
+	}
+	activityMu.Unlock()
+
+	if activity == nil || !activityPending.CompareAndSwap(false, true) {
+		return
+	}
+
+	onUI(func() {
+		activityPending.Store(false)
+		activity.SetValue(getActivityText())
+		activity.SetTopLine(MAX_TOP_LINE)
+		activity.SetTopLine(activity.TopLine() - activity.H()) // scroll to the bottom
+	})
+}
+
+// The text that the activity view shows while there are no entries.
+const ACTIVITY_PLACEHOLDER = "<i>Information will appear here.</i>"
+
+// getActivityText returns the HTML of the activity view, with a paragraph for
+// each entry, or the placeholder if there are none.
+func getActivityText() string {
+	activityMu.Lock()
+	defer activityMu.Unlock()
+
+	if len(activityEntries) == 0 {
+		return ACTIVITY_PLACEHOLDER
+	}
+
+	var sb strings.Builder
+	for _, s := range activityEntries {
+		fmt.Fprintf(&sb, "<p>%v</p>", s)
+	}
+
+	return sb.String()
 }
 
-// Wraps around log.Printf() as well as adding activity to the
-// activity text buffer. Always adds a newline to the activity buffer.
-func Logf(format string, v ...any) {
-	format = fmt.Sprintf("%v\n", format)
-	activityText = fmt.Sprintf("%v<p>%v</p>", activityText, fmt.Sprintf(format, v...))
-	activity.SetValue(activityText)
-	log.Printf(format, v...)
-	activity.SetTopLine(MAX_TOP_LINE)
-	activity.SetTopLine(activity.TopLine() - activity.H()) // scroll to the bottom
+// setActivityEntries replaces the entries of the activity view, which are
+// HTML, without writing them to the activity log file.
+func setActivityEntries(entries []string) {
+	activityMu.Lock()
+	activityEntries = entries
+	activityMu.Unlock()
 }
 
 // isPortrait returns true if the screen is taller than it is wide. It returns
@@ -98,98 +147,45 @@ type ScannerDevice struct {
 // 	return results, err
 // }
 
-// Parses the output of scanimage v1.3.1 to retrieve options. Example CLI
-// output:
-//
-//	`
-//	mode 24bit Color[Fast]|Black & White|True Gray|Gray[Error Diffusion] [24bit Color[Fast]]
-//	resolution 100|150|200|300|400|600|1200dpi [100]
-//	source Automatic Document Feeder(left aligned) [Automatic Document Feeder(left aligned)]
-//	`
-func parseDeviceOptionConstraints(out []string) (map[string][]string, map[string]string) {
-	r, err := regexp.Compile(`^(.*) \[(.*)\]$`)
-	if err != nil {
-		log.Fatalf("failed to compile regexp: %v", err.Error())
-	}
-
-	results := make(map[string][]string)
-	defaults := make(map[string]string)
-	for _, opt := range out {
-		opt = strings.TrimSpace(opt)
-		expanded := strings.Split(opt, " ")
-		parsedOpt := expanded[0]
-
-		if len(expanded) <= 1 {
-			continue
-		}
-
-		withoutOpt := strings.Split(opt, parsedOpt)[1]
-
-		constraints := strings.Split(withoutOpt, "|")
-		if len(constraints) == 0 {
-			continue
-		}
-
-		results[parsedOpt] = []string{}
-
-		// try to identify the supported constraints for each option, including
-		// the currently selected one
-		for i, constraint := range constraints {
-			// the last constraint will always contain the currently set value of
-			// the option, such as "1200dpi [100]"
-			if i == len(constraints)-1 {
-				matches := r.FindStringSubmatch(constraint)
-				log.Printf("%v matches: %v", len(matches), matches)
-				if len(matches) != 3 {
-					continue
-				}
-
-				constraint = matches[1]
-				defaults[parsedOpt] = matches[2]
-			}
-
-			results[parsedOpt] = append(results[parsedOpt], strings.TrimSpace(constraint))
-		}
-	}
+// getDeviceOptionsConstraints runs scanimage (located at bin) to retrieve all of
+// the options for the device, including their constraints and current values.
+// The settings are applied first, since they can change which options are
+// active and what their constraints are.
+func getDeviceOptionsConstraints(bin string, dev string, deviceSettings map[string]string) ([]DeviceOption, error) {
+	var ob bytes.Buffer
+	var eb bytes.Buffer
 
-	return results, defaults
-}
+	args := append(getSettingsArgs(deviceSettings, dev), "-A")
 
-func getDeviceOptionsConstraints(dev string) (map[string][]string, map[string]string, error) {
-	args := []string{
-		"-c",
-		fmt.Sprintf(`scanimage --device='%v' -A | grep -v '\[inactive\]' | grep -v '\[advanced\]' | grep '\-\-' | tr -d '\-\-'`, dev),
-	}
+	Debugf("running command %v with args %v", bin, args)
 
-	cmd := exec.Command("/bin/bash", args...)
-	o, err := cmd.Output()
+	_, err := RunCommand(bin, args, []string{}, nil, &ob, &eb)
 	if err != nil {
-		return map[string][]string{}, map[string]string{}, fmt.Errorf("failed to get device option constraints via scanimage cli: %w", err)
+		Debugf("stderr for scanimage: %v", eb.String())
+		return []DeviceOption{}, fmt.Errorf("failed to get device option constraints via scanimage cli: %w", err)
 	}
 
-	out := strings.Split(string(o), "\n")
-	results, defaults := parseDeviceOptionConstraints(out)
-
-	return results, defaults, err
+	return parseDeviceOptions(strings.Split(ob.String(), "\n")), nil
 }
 
-// getDevices retrieves a list of scanner devices as a string slice.
-func getDevices() ([]ScannerDevice, error) {
+// getDevices retrieves a list of scanner devices by running scanimage, which is
+// located at bin.
+func getDevices(bin string) ([]ScannerDevice, error) {
 	// in the event that the sane library doesn't work, here's how to do it
 	// via command line:
 
 	var ob bytes.Buffer
 	var eb bytes.Buffer
 
-	command := "scanimage"
+	command := bin
 	args := []string{`--formatted-device-list=%d||%v||%m||%t||%i;;;`, "--list-devices"}
 
-	log.Printf("running command %v with args %v", command, args)
+	Debugf("running command %v with args %v", command, args)
 
 	_, err := RunCommand(command, args, []string{}, nil, &ob, &eb)
 	if err != nil {
-		log.Printf("stdout for convert: %v", ob.String())
-		log.Printf("stderr for convert: %v", eb.String())
+		Debugf("stdout for scanimage: %v", ob.String())
+		Debugf("stderr for scanimage: %v", eb.String())
 		return []ScannerDevice{}, err
 	}
 
@@ -197,8 +193,12 @@ func getDevices() ([]ScannerDevice, error) {
 
 	outLines := strings.Split(ob.String(), ";;;")
 	for _, outLine := range outLines {
-		// split based on the || pattern from above
-		values := strings.Split(outLine, "||")
+		// split based on the || pattern from above; anything that doesn't
+		// have all of the fields isn't a device
+		values := strings.Split(strings.TrimSpace(outLine), "||")
+		if len(values) != 5 {
+			continue
+		}
 
 		newScanner := ScannerDevice{}
 		for i := range values {
@@ -244,26 +244,154 @@ func getDevices() ([]ScannerDevice, error) {
 	// return scanners, nil
 }
 
-// ScanImage runs a /bin/bash command to scan an image.
-func ScanImage(filename string, deviceSettings map[string]string, format string, dev string) (string, error) {
-	// scanimage --device='brother5:bus2;dev1' --resolution 300 --progress --format=pdf > scanned_doc_$(date +%s).pdf
+// getSettingsArgs builds the scanimage arguments for using the device with the
+// provided settings. Settings are sorted by name so that the arguments are
+// always in the same order. Single-letter options such as the -l/-t/-x/-y
+// geometry options are passed as short options.
+func getSettingsArgs(deviceSettings map[string]string, dev string) []string {
+	keys := make([]string, 0, len(deviceSettings))
+	for k := range deviceSettings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 
-	sb := new(strings.Builder)
-	for k, v := range deviceSettings {
+	args := []string{fmt.Sprintf("--device=%v", dev)}
+	for _, k := range keys {
+		v := deviceSettings[k]
 		if v == "" {
 			continue
 		}
 
-		sb.WriteString(fmt.Sprintf("--%v='%v' ", k, v))
+		if len(k) == 1 {
+			args = append(args, fmt.Sprintf("-%v", k), v)
+			continue
+		}
+
+		args = append(args, fmt.Sprintf("--%v=%v", k, v))
 	}
 
-	args := []string{
-		"-c",
-		fmt.Sprintf(`scanimage --device='%v' %v--format=%v > %v`, dev, sb.String(), format, filename),
+	return args
+}
+
+// getScanArgs builds the scanimage arguments for scanning from the device with
+// the provided settings. The format may be a file extension such as "jpg",
+// which is passed on as the name that scanimage knows it by.
+func getScanArgs(deviceSettings map[string]string, format string, dev string) []string {
+	return append(getSettingsArgs(deviceSettings, dev), fmt.Sprintf("--format=%v", normalizeScanFormat(format)), "--progress")
+}
+
+// ScanImage runs scanimage (located at bin) to scan an image, streaming the
+// image to a temporary file that is renamed to filename once the image is
+// complete and valid. If the scan fails part way through, such as when the
+// paper jams, filename is left alone and the partial image is kept next to it
+// with PARTIAL_SUFFIX, unless the scan was cancelled. Anything that scanimage
+// writes to stderr is returned.
+func ScanImage(ctx context.Context, bin string, filename string, deviceSettings map[string]string, format string, dev string, onProgress func(p ScanProgress)) (string, error) {
+	// scanimage --device='brother5:bus2;dev1' --resolution 300 --progress --format=pdf > scanned_doc_$(date +%s).pdf
+	args := getScanArgs(deviceSettings, format, dev)
+
+	f, err := createScanTemp(filename)
+	if err != nil {
+		return "", err
+	}
+
+	Debugf("running command %v with args %v", bin, args)
+
+	pw := newProgressWriter(onProgress)
+	_, err = RunCommandContext(ctx, bin, args, []string{}, nil, f, pw)
+	err = errors.Join(err, f.Close())
+	if err != nil {
+		partial := discardPartialScan(f.Name(), filename, ctx.Err() == nil)
+		if partial != "" {
+			err = fmt.Errorf("%w; the partial scan was kept at %v", err, partial)
+		}
+		return pw.String(), err
+	}
+
+	return pw.String(), commitScanFile(f.Name(), filename, format)
+}
+
+// ScanBatch runs scanimage (located at bin) in batch mode, which scans pages
+// until the document feeder runs out. Each page is written to a file named
+// after pattern, where %d is replaced by the page number, and onPage (if not
+// nil) is called once each page has been written. The files of the scanned
+// pages are returned, along with anything that scanimage wrote to stderr. If
+// the scan fails part way through a page, that page is kept with
+// PARTIAL_SUFFIX, unless the scan was cancelled.
+func ScanBatch(ctx context.Context, bin string, pattern string, deviceSettings map[string]string, format string, dev string, onPage func(page int, filename string), onProgress func(p ScanProgress)) ([]string, string, error) {
+	args := append(getScanArgs(deviceSettings, format, dev), fmt.Sprintf("--batch=%v", pattern), "--batch-print")
+
+	Debugf("running command %v with args %v", bin, args)
+
+	// --batch-print makes scanimage print the name of each file once the page
+	// has been scanned
+	pages := []string{}
+	w := &lineWriter{onLine: func(line string) {
+		pages = append(pages, line)
+		if onPage != nil {
+			onPage(len(pages), line)
+		}
+	}}
+
+	pw := newProgressWriter(onProgress)
+	started := time.Now()
+	_, err := RunCommandContext(ctx, bin, args, []string{}, nil, w, pw)
+	w.Flush()
+
+	// scanimage writes straight to the file of each page, so the page that
+	// it was scanning when it failed is incomplete. It only counts if it was
+	// written by this scan, rather than being left over from an earlier one
+	if err != nil {
+		next := fmt.Sprintf(pattern, len(pages)+1)
+		info, serr := os.Stat(next)
+		if serr == nil && !info.ModTime().Before(started.Truncate(time.Second)) {
+			partial := discardPartialScan(next, next, ctx.Err() == nil)
+			if partial != "" {
+				err = fmt.Errorf("%w; the partial page was kept at %v", err, partial)
+			}
+		}
+	}
+
+	if err == nil && len(pages) == 0 {
+		err = fmt.Errorf("no pages were scanned")
+	}
+
+	return pages, pw.String(), err
+}
+
+// lineWriter is an io.Writer that calls onLine for each non-empty line that is
+// written to it, without the trailing newline.
+type lineWriter struct {
+	onLine func(line string)
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := strings.TrimSpace(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+		if line != "" {
+			w.onLine(line)
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush calls onLine for any remaining text that didn't end with a newline.
+func (w *lineWriter) Flush() {
+	line := strings.TrimSpace(string(w.buf))
+	w.buf = nil
+	if line != "" {
+		w.onLine(line)
 	}
-	cmd := exec.Command("/bin/bash", args...)
-	out, err := cmd.CombinedOutput()
-	return string(out), err
 }
 
 // Runs a command with the provided command (such as `/bin/sh`) and args (such
@@ -273,8 +401,20 @@ func ScanImage(filename string, deviceSettings map[string]string, format string,
 //
 // Returns the exit code of the command when it finishes.
 func RunCommand(command string, args []string, env []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
-	cmd := exec.Command(command, args...)
+	return RunCommandContext(context.Background(), command, args, env, stdin, stdout, stderr)
+}
+
+// RunCommandContext is RunCommand, but the command is interrupted when ctx is
+// cancelled. scanimage stops scanning and releases the device when it is
+// interrupted, so it is only killed if it doesn't exit within
+// COMMAND_WAIT_DELAY after that.
+func RunCommandContext(ctx context.Context, command string, args []string, env []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	cmd := exec.CommandContext(ctx, command, args...)
 	cmd.Env = append(cmd.Env, env...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = COMMAND_WAIT_DELAY
 
 	if stdin != nil {
 		cmd.Stdin = stdin
@@ -285,11 +425,15 @@ func RunCommand(command string, args []string, env []string, stdin io.Reader, st
 	}
 
 	if stderr != nil {
-		cmd.Stderr = stdout
+		cmd.Stderr = stderr
 	}
 
 	err := cmd.Run()
 	if err != nil {
+		// the process state is nil if the command could not be started
+		if cmd.ProcessState == nil {
+			return -1, err
+		}
 		return cmd.ProcessState.ExitCode(), err
 	}
 
@@ -322,11 +466,11 @@ func getShortcut(i int) int {
 	}
 }
 
-// getFileType returns "png", "pdf", "jpeg", or other similar formats that are
-// in scope for this application. If the filetype isn't supported, it returns an
-// empty string.
+// getFileType returns ".png", ".pdf", ".jpeg", or other similar extensions that
+// are in scope for this application, in lowercase whatever the case of s. If the
+// filetype isn't supported, it returns an empty string.
 func getFileType(s string) string {
-	ext := filepath.Ext(s)
+	ext := strings.ToLower(filepath.Ext(s))
 	switch ext {
 	case ".png":
 		return ext
@@ -1,64 +1,309 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 )
 
-func TestParseDeviceOptionConstraints(t *testing.T) {
+// fakeScanimage returns the absolute path to the fake scanimage script in
+// testdata, configured to behave according to mode (see the script for the
+// available modes).
+func fakeScanimage(t *testing.T, mode string) string {
+	t.Helper()
+
+	t.Setenv("FAKE_SCANIMAGE_MODE", mode)
+
+	p, err := filepath.Abs(filepath.Join("testdata", "fake-scanimage"))
+	if err != nil {
+		t.Fatalf("failed to get path to fake scanimage: %v", err)
+	}
+
+	return p
+}
+
+func TestGetDevices(t *testing.T) {
 	tests := []struct {
-		input []string
-		// Expected results value map
-		expectedr map[string][]string
-		// Expected default value map
-		expectedd map[string]string
+		mode     string
+		expected []ScannerDevice
+		wantErr  bool
 	}{
 		{
-			input: []string{
-				"mode 24bit Color[Fast]|Black & White|True Gray|Gray[Error Diffusion] [24bit Color[Fast]]",
-				"resolution 100|150|200|300|400|600|1200dpi [100]",
-				"source Automatic Document Feeder(left aligned) [Automatic Document Feeder(left aligned)]",
-			},
-			expectedr: map[string][]string{
-				"mode":       {"24bit Color[Fast]", "Black & White", "True Gray", "Gray[Error Diffusion]"},
-				"resolution": {"100", "150", "200", "300", "400", "600", "1200dpi"},
-				"source":     {"Automatic Document Feeder(left aligned)"},
+			mode: "",
+			expected: []ScannerDevice{
+				{Device: "brother5:bus2;dev1", Vendor: "Brother", Model: "ADS-1700W", Type: "USB scanner", Index: "0"},
+				{Device: "test:0", Vendor: "Noname", Model: "frontend-tester", Type: "virtual device", Index: "1"},
 			},
+		},
+		{mode: "fail", expected: []ScannerDevice{}, wantErr: true},
+		{mode: "garbage", expected: []ScannerDevice{}},
+	}
+
+	for _, test := range tests {
+		got, err := getDevices(fakeScanimage(t, test.mode))
+		if test.wantErr && err == nil {
+			t.Errorf("mode %q: expected an error but got nil", test.mode)
+		}
+		if !test.wantErr && err != nil {
+			t.Errorf("mode %q: unexpected error: %v", test.mode, err)
+		}
+
+		if len(got) != len(test.expected) {
+			t.Errorf("mode %q: device count mismatch: got %v, wanted %v", test.mode, len(got), len(test.expected))
+			continue
+		}
+
+		for i := range got {
+			if got[i] != test.expected[i] {
+				t.Errorf("mode %q: device mismatch: got %v, wanted %v", test.mode, got[i], test.expected[i])
+			}
+		}
+	}
+}
+
+func TestGetScanArgs(t *testing.T) {
+	settings := map[string]string{
+		"mode":   "Gray[Error Diffusion]",
+		"source": "it's a feeder; rm -rf ~",
+		"l":      "10",
+		"empty":  "",
+	}
+	expected := []string{
+		"--device=brother5:bus2;dev1",
+		"-l", "10",
+		"--mode=Gray[Error Diffusion]",
+		"--source=it's a feeder; rm -rf ~",
+		"--format=png",
+		"--progress",
+	}
+
+	got := getScanArgs(settings, "png", "brother5:bus2;dev1")
+	if len(got) != len(expected) {
+		t.Fatalf("arg count mismatch: got %v, wanted %v", got, expected)
+	}
+
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Errorf("arg mismatch: got %v, wanted %v", got[i], expected[i])
+		}
+	}
+
+	// scanimage only knows the jpg extension by its full name
+	for ext, format := range map[string]string{"jpg": "jpeg", "JPG": "jpeg", "jpeg": "jpeg"} {
+		got := getScanArgs(nil, ext, "brother5:bus2;dev1")
+		if got[len(got)-2] != "--format="+format {
+			t.Errorf("%v: got %v, wanted --format=%v", ext, got[len(got)-2], format)
+		}
+	}
+}
+
+func TestGetDevicesMissingBinary(t *testing.T) {
+	_, err := getDevices(filepath.Join(t.TempDir(), "scanimage"))
+	if err == nil {
+		t.Error("expected an error for a missing scanimage binary but got nil")
+	}
+}
+
+func TestGetDeviceOptionsConstraints(t *testing.T) {
+	tests := []struct {
+		mode      string
+		expectedd map[string]string
+		wantErr   bool
+	}{
+		{
+			mode: "",
 			expectedd: map[string]string{
 				"mode":       "24bit Color[Fast]",
 				"resolution": "100",
 				"source":     "Automatic Document Feeder(left aligned)",
+				"l":          "0",
+				"t":          "0",
+				"x":          "215.88",
+				"y":          "355.567",
 			},
 		},
+		{mode: "fail", expectedd: map[string]string{}, wantErr: true},
+		{mode: "garbage", expectedd: map[string]string{}},
 	}
 
 	for _, test := range tests {
-		gotr, gotd := parseDeviceOptionConstraints(test.input)
+		opts, err := getDeviceOptionsConstraints(fakeScanimage(t, test.mode), "brother5:bus2;dev1", nil)
+		if test.wantErr && err == nil {
+			t.Errorf("mode %q: expected an error but got nil", test.mode)
+		}
+		if !test.wantErr && err != nil {
+			t.Errorf("mode %q: unexpected error: %v", test.mode, err)
+		}
 
-		if gotr == nil {
-			t.Error("nil pointer for map")
+		gotd := getDeviceSettings(opts)
+		if len(gotd) != len(test.expectedd) {
+			t.Errorf("mode %q: default count mismatch: got %v, wanted %v", test.mode, gotd, test.expectedd)
 		}
 
-		for k, v := range gotr {
-			for kk, vv := range test.expectedr {
-				if k != kk {
-					continue
-				}
-				if len(v) != len(vv) {
-					t.Errorf("string slice len mismatch: got %v, wanted %v", len(v), len(vv))
-				}
-
-				for i := range v {
-					if v[i] != vv[i] {
-						t.Errorf("string slice value mismatch: got %v, wanted %v", v[i], vv[i])
-					}
-				}
+		for k, v := range test.expectedd {
+			if gotd[k] != v {
+				t.Errorf("mode %q: default mismatch for %v: got %v, wanted %v", test.mode, k, gotd[k], v)
+			}
+			found := false
+			for _, opt := range opts {
+				found = found || (opt.Name == k && opt.Kind != "")
+			}
+			if !found {
+				t.Errorf("mode %q: no constraints for %v", test.mode, k)
 			}
 		}
+	}
+}
+
+func TestGetDeviceOptionsConstraintsWithSettings(t *testing.T) {
+	argsFile := filepath.Join(t.TempDir(), "args")
+	t.Setenv("FAKE_SCANIMAGE_ARGS", argsFile)
 
-		for k, v := range gotd {
-			if v != test.expectedd[k] {
-				t.Errorf("expected default values had a mismatch: got %v, wanted %v", v, test.expectedd[k])
+	settings := map[string]string{"source": "Automatic Document Feeder(left aligned)", "mode": "True Gray"}
+	_, err := getDeviceOptionsConstraints(fakeScanimage(t, ""), "brother5:bus2;dev1", settings)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("failed to read args: %v", err)
+	}
+
+	expected := "--device=brother5:bus2;dev1\n--mode=True Gray\n--source=Automatic Document Feeder(left aligned)\n-A\n"
+	if string(args) != expected {
+		t.Errorf("args mismatch: got %q, wanted %q", args, expected)
+	}
+}
+
+func TestScanImage(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "scanimage", "image.png"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	tests := []struct {
+		mode     string
+		format   string
+		expected []byte
+		wantErr  bool
+	}{
+		{mode: "", format: "png", expected: fixture},
+		{mode: "", format: "tiff", wantErr: true},
+		{mode: "fail", format: "png", wantErr: true},
+	}
+
+	for _, test := range tests {
+		// the filename and settings would have broken out of a shell command
+		argsFile := filepath.Join(t.TempDir(), "args")
+		t.Setenv("FAKE_SCANIMAGE_ARGS", argsFile)
+		filename := filepath.Join(t.TempDir(), "a scan; touch pwned '."+test.format)
+		settings := map[string]string{"resolution": "300", "mode": "Gray'[Error Diffusion]"}
+		out, err := ScanImage(context.Background(), fakeScanimage(t, test.mode), filename, settings, test.format, "brother5:bus2;dev1", nil)
+
+		args, aerr := os.ReadFile(argsFile)
+		if aerr != nil {
+			t.Errorf("mode %q format %v: failed to read args: %v", test.mode, test.format, aerr)
+		} else if !strings.Contains(string(args), "\n--mode=Gray'[Error Diffusion]\n") {
+			t.Errorf("mode %q format %v: mode was not passed as a single arg: %q", test.mode, test.format, args)
+		}
+
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("mode %q format %v: expected an error but got nil", test.mode, test.format)
+			}
+			if !strings.Contains(out, "scanimage:") {
+				t.Errorf("mode %q format %v: expected scanimage error output, got %q", test.mode, test.format, out)
 			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("mode %q format %v: unexpected error: %v (output: %v)", test.mode, test.format, err, out)
+			continue
+		}
+
+		got, err := os.ReadFile(filename)
+		if err != nil {
+			t.Errorf("mode %q format %v: failed to read scanned file: %v", test.mode, test.format, err)
+			continue
 		}
+
+		if !bytes.Equal(got, test.expected) {
+			t.Errorf("mode %q format %v: scanned file does not match fixture", test.mode, test.format)
+		}
+	}
+}
+
+// useActivityEntries empties the messages of the activity view, restoring them
+// once the test is done.
+func useActivityEntries(t *testing.T) {
+	t.Helper()
+
+	activityMu.Lock()
+	old := activityEntries
+	activityMu.Unlock()
+	t.Cleanup(func() { setActivityEntries(old) })
+
+	setActivityEntries(nil)
+}
+
+func TestLogConcurrent(t *testing.T) {
+	useActivityEntries(t)
+
+	// without an activity view, only the text buffer is updated
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				Log("page", i)
+			} else {
+				Logf("page %v", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	got := getActivityText()
+	if n := strings.Count(got, "<p>"); n != 50 {
+		t.Errorf("expected 50 paragraphs, got %v: %v", n, got)
+	}
+	if !strings.Contains(got, "<p>page 2</p>") {
+		t.Errorf("Log didn't join its values: %v", got)
+	}
+}
+
+func TestActivityPlaceholder(t *testing.T) {
+	useActivityEntries(t)
+
+	if got := getActivityText(); got != ACTIVITY_PLACEHOLDER {
+		t.Errorf("empty: got %q", got)
+	}
+
+	Logf("scanning")
+	if got := getActivityText(); got != "<p>scanning</p>" {
+		t.Errorf("the placeholder wasn't replaced: %q", got)
+	}
+}
+
+func TestLogKeepsLatestEntries(t *testing.T) {
+	useActivityEntries(t)
+
+	for i := 0; i < MAX_ACTIVITY_ENTRIES+10; i++ {
+		Logf("entry %v", i)
+	}
+
+	got := getActivityText()
+	if n := strings.Count(got, "<p>"); n != MAX_ACTIVITY_ENTRIES {
+		t.Errorf("expected %v paragraphs, got %v", MAX_ACTIVITY_ENTRIES, n)
+	}
+	if strings.Contains(got, "<p>entry 9</p>") || !strings.HasPrefix(got, "<p>entry 10</p>") {
+		t.Errorf("the oldest entries weren't dropped: %.40v", got)
 	}
 }
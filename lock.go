@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// errConfigLocked is returned by lockFile when another process holds the lock.
+var errConfigLocked = errors.New("the config file is locked by another process")
+
+// configLock is the open lock file of the config file, which holds the lock
+// until it is closed or the app exits.
+var configLock *os.File
+
+// getConfigLockPath returns the path of the lock file of the config file at
+// path. The config file itself can't be locked, since saving replaces it.
+func getConfigLockPath(path string) string {
+	return path + ".lock"
+}
+
+// lockConfig locks the config file for as long as the app runs, so that two
+// running instances don't overwrite each other's settings. If another instance
+// already holds the lock, the settings of this one won't be saved. If locking
+// isn't possible at all, such as on a read-only file system, the config is used
+// without the lock.
+func lockConfig() {
+	unlockConfig()
+
+	if configFilePath == "" {
+		return
+	}
+
+	lockPath := getConfigLockPath(configFilePath)
+	f, err := openLockFile(lockPath)
+	if errors.Is(err, errConfigLocked) {
+		configProblems = append(configProblems, "another instance of the app is using the config file, so the settings won't be saved from this one")
+		configFilePath = ""
+		return
+	}
+	if err != nil {
+		log.Printf("failed to lock the config file, continuing without the lock: %v", err.Error())
+		return
+	}
+
+	configLock = f
+}
+
+// unlockConfig releases the lock of the config file, if it's held.
+func unlockConfig() {
+	if configLock == nil {
+		return
+	}
+
+	configLock.Close()
+	configLock = nil
+}
+
+// openLockFile opens the lock file at path, creating it and its directory if
+// needed, and takes an exclusive lock on it without waiting.
+func openLockFile(path string) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the directory of %v: %w", path, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %w", path, err)
+	}
+
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile does nothing on systems without flock, where running two instances
+// at once can still overwrite each other's settings.
+func lockFile(f *os.File) error {
+	return nil
+}
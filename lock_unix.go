@@ -0,0 +1,24 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive advisory lock on f without waiting. The lock is
+// released when f is closed, including when the process exits for any reason.
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errConfigLocked
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock %v: %w", f.Name(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLockConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte("version: 2\nselecteddir: /scans\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	useConfigFile(t, path)
+
+	loadConfig()
+	if configLock == nil || configFilePath != path {
+		t.Fatalf("the config wasn't locked: %v", configProblems)
+	}
+
+	// another instance, which opens the lock file separately
+	_, err := openLockFile(getConfigLockPath(path))
+	if !errors.Is(err, errConfigLocked) {
+		t.Errorf("expected the lock to be held, got %v", err)
+	}
+
+	// loading the config again, such as in a test, keeps the lock
+	loadConfig()
+	if configLock == nil || len(configProblems) != 0 {
+		t.Errorf("reloading lost the lock: %v", configProblems)
+	}
+
+	unlockConfig()
+	f, err := openLockFile(getConfigLockPath(path))
+	if err != nil {
+		t.Fatalf("the lock wasn't released: %v", err)
+	}
+	defer f.Close()
+
+	// while another instance holds the lock, the config is still loaded, but
+	// not saved
+	useConfigFile(t, path)
+	loadConfig()
+	if appConf.SelectedDir != "/scans" {
+		t.Errorf("the config wasn't loaded: %+v", appConf)
+	}
+	if configFilePath != "" || len(configProblems) != 1 || !strings.Contains(configProblems[0], "another instance") {
+		t.Errorf("expected the config not to be saved: %q, %v", configFilePath, configProblems)
+	}
+}
+
+func TestLoadConfigLockedKeepsActivity(t *testing.T) {
+	store := useActivityStore(t)
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte("version: 1\nlog: <p>scanned a.png</p>\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// while another instance holds the lock, the config can't be upgraded, so
+	// the activity stays in it
+	f, err := openLockFile(getConfigLockPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		useConfigFile(t, path)
+		loadConfig()
+	}
+	f.Close()
+
+	if entries, _ := store.Tail(10); len(entries) != 0 {
+		t.Errorf("the activity was moved without upgrading the config: %+v", entries)
+	}
+
+	// once the config is upgraded, it's moved once
+	for range 2 {
+		useConfigFile(t, path)
+		loadConfig()
+	}
+
+	entries, err := store.Tail(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Message != "scanned a.png" {
+		t.Errorf("unexpected activity: %+v", entries)
+	}
+}
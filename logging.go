@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The level of the messages that are logged, which the -log-level and -v
+// flags set. The activity view, the activity log file and stderr all use it.
+var logLevel = new(slog.LevelVar)
+
+// logger sends each message to the activity view, the activity log file and
+// stderr. It isn't the default logger of slog, so that the diagnostics that
+// are written with the log package stay on stderr.
+var logger *slog.Logger
+
+func init() {
+	// the activity log file logs its own problems, so the logger can only be
+	// created once the package's variables are
+	logger = slog.New(fanoutHandler{
+		newEntryHandler(logLevel, appendActivity),
+		newEntryHandler(logLevel, writeActivityStore),
+		slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}),
+	})
+}
+
+// The colors of the levels in the activity view. Messages at the info level
+// use the default color.
+var activityLevelColors = map[slog.Level]string{
+	slog.LevelDebug: "#808080",
+	slog.LevelWarn:  "#a05a00",
+	slog.LevelError: "#c00000",
+}
+
+// getLevelColor returns the color of messages at level in the activity view,
+// or an empty string for the default color.
+func getLevelColor(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return activityLevelColors[slog.LevelError]
+	case level >= slog.LevelWarn:
+		return activityLevelColors[slog.LevelWarn]
+	case level < slog.LevelInfo:
+		return activityLevelColors[slog.LevelDebug]
+	}
+
+	return ""
+}
+
+// renderActivityEntry returns the HTML of the entry in the activity view. The
+// message is escaped, so that output such as scanimage's "[Fast]" or "<none>"
+// is shown as it is, and colored according to its level.
+func renderActivityEntry(e activityEntry) string {
+	msg := html.EscapeString(strings.TrimRight(e.Message, "\n"))
+	msg = strings.ReplaceAll(msg, "\n", "<br>")
+
+	color := getLevelColor(e.Level)
+	if color == "" {
+		return msg
+	}
+
+	return fmt.Sprintf(`<font color="%v">%v</font>`, color, msg)
+}
+
+// writeActivityStore writes the entry to the activity log file, if it's open.
+func writeActivityStore(e activityEntry) {
+	if activityStore == nil {
+		return
+	}
+
+	// failing to write is only reported on stderr: logging it would write to
+	// the activity log again, and fail again, without end
+	err := activityStore.Write(e)
+	if err != nil {
+		log.Printf("failed to write to the activity log: %v", err.Error())
+	}
+}
+
+// entryHandler is a slog.Handler that turns records into activity entries,
+// with their attributes after the message as key=value pairs, and passes them
+// to write.
+type entryHandler struct {
+	level slog.Leveler
+	write func(e activityEntry)
+	// The attributes of WithAttrs, already formatted.
+	attrs string
+	// The prefix of the keys of attributes, from WithGroup.
+	group string
+}
+
+func newEntryHandler(level slog.Leveler, write func(e activityEntry)) *entryHandler {
+	return &entryHandler{level: level, write: write}
+}
+
+func (h *entryHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *entryHandler) Handle(_ context.Context, r slog.Record) error {
+	var sb strings.Builder
+	sb.WriteString(r.Message)
+	sb.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&sb, h.group, a)
+		return true
+	})
+
+	h.write(activityEntry{Time: r.Time, Level: r.Level, Message: sb.String()})
+
+	return nil
+}
+
+func (h *entryHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var sb strings.Builder
+	sb.WriteString(h.attrs)
+	for _, a := range attrs {
+		appendAttr(&sb, h.group, a)
+	}
+
+	h2 := *h
+	h2.attrs = sb.String()
+
+	return &h2
+}
+
+func (h *entryHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	h2 := *h
+	h2.group = h.group + name + "."
+
+	return &h2
+}
+
+// appendAttr writes the attribute to sb as " key=value", with the keys of
+// groups joined by dots. Values with spaces or quotes are quoted.
+func appendAttr(sb *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix = prefix + a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			appendAttr(sb, prefix, ga)
+		}
+		return
+	}
+
+	v := a.Value.String()
+	if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+		v = strconv.Quote(v)
+	}
+
+	fmt.Fprintf(sb, " %v%v=%v", prefix, a.Key, v)
+}
+
+// fanoutHandler is a slog.Handler that passes each record on to all of its
+// handlers that are enabled for the record's level.
+type fanoutHandler []slog.Handler
+
+func (h fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, handler := range h {
+		if handler.Enabled(ctx, r.Level) {
+			errs = append(errs, handler.Handle(ctx, r.Clone()))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (h fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(fanoutHandler, 0, len(h))
+	for _, handler := range h {
+		handlers = append(handlers, handler.WithAttrs(attrs))
+	}
+
+	return handlers
+}
+
+func (h fanoutHandler) WithGroup(name string) slog.Handler {
+	handlers := make(fanoutHandler, 0, len(h))
+	for _, handler := range h {
+		handlers = append(handlers, handler.WithGroup(name))
+	}
+
+	return handlers
+}
+
+// setLogLevel sets the level of the messages that are logged. verbose lowers
+// it to the debug level.
+func setLogLevel(level slog.Level, verbose bool) {
+	if verbose && level > slog.LevelDebug {
+		level = slog.LevelDebug
+	}
+
+	logLevel.Set(level)
+}
+
+// logAt formats the message and logs it at level, if that level is enabled.
+func logAt(level slog.Level, format string, v ...any) {
+	ctx := context.Background()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+
+	logger.Log(ctx, level, strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"))
+}
+
+// Log logs its values at the info level, separated by spaces like
+// fmt.Sprintln does, to the activity view, the activity log file and stderr.
+func Log(v ...any) {
+	logAt(slog.LevelInfo, "%v", strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// Logf logs a message at the info level to the activity view, the activity
+// log file and stderr.
+func Logf(format string, v ...any) {
+	logAt(slog.LevelInfo, format, v...)
+}
+
+// Debugf logs a message at the debug level, which is only shown with -v or
+// -log-level debug.
+func Debugf(format string, v ...any) {
+	logAt(slog.LevelDebug, format, v...)
+}
+
+// Warnf logs a message at the warning level, for things that went wrong but
+// that the app worked around.
+func Warnf(format string, v ...any) {
+	logAt(slog.LevelWarn, format, v...)
+}
+
+// Errorf logs a message at the error level, for things that failed.
+func Errorf(format string, v ...any) {
+	logAt(slog.LevelError, format, v...)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderActivityEntry(t *testing.T) {
+	tests := []struct {
+		name     string
+		entry    activityEntry
+		expected string
+	}{
+		{
+			name:     "escaped",
+			entry:    activityEntry{Level: slog.LevelInfo, Message: "--mode Color|Gray [Fast] <none> & more"},
+			expected: "--mode Color|Gray [Fast] &lt;none&gt; &amp; more",
+		},
+		{
+			name:     "line breaks",
+			entry:    activityEntry{Level: slog.LevelInfo, Message: "scanimage: warning\nscanimage: done\n"},
+			expected: "scanimage: warning<br>scanimage: done",
+		},
+		{
+			name:     "warning",
+			entry:    activityEntry{Level: slog.LevelWarn, Message: "skipped a setting"},
+			expected: `<font color="#a05a00">skipped a setting</font>`,
+		},
+		{
+			name:     "error",
+			entry:    activityEntry{Level: slog.LevelError + 4, Message: `<font color="red">`},
+			expected: `<font color="#c00000">&lt;font color=&#34;red&#34;&gt;</font>`,
+		},
+		{
+			name:     "debug",
+			entry:    activityEntry{Level: slog.LevelDebug, Message: "running scanimage"},
+			expected: `<font color="#808080">running scanimage</font>`,
+		},
+	}
+
+	for _, test := range tests {
+		if got := renderActivityEntry(test.entry); got != test.expected {
+			t.Errorf("%v: got %q, wanted %q", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestEntryHandler(t *testing.T) {
+	var got []activityEntry
+	level := new(slog.LevelVar)
+	l := slog.New(newEntryHandler(level, func(e activityEntry) {
+		got = append(got, e)
+	}))
+
+	when := time.Now()
+	l.Info("scanned", "page", 2, "file", "/scans/my doc.png")
+	l.With("job", 3).WithGroup("scan").Warn("cancelled", slog.Group("by", "reason", "user"), "empty", "")
+	l.Debug("not logged")
+
+	if len(got) != 2 {
+		t.Fatalf("got %v entries: %+v", len(got), got)
+	}
+	if got[0].Message != `scanned page=2 file="/scans/my doc.png"` || got[0].Level != slog.LevelInfo || got[0].Time.Before(when) {
+		t.Errorf("got %+v", got[0])
+	}
+	if got[1].Message != `cancelled job=3 scan.by.reason=user scan.empty=""` || got[1].Level != slog.LevelWarn {
+		t.Errorf("got %+v", got[1])
+	}
+
+	level.Set(slog.LevelDebug)
+	l.Debug("logged")
+	if len(got) != 3 || got[2].Message != "logged" {
+		t.Errorf("the level wasn't lowered: %+v", got)
+	}
+}
+
+func TestFanoutHandler(t *testing.T) {
+	var debug, warn []string
+	l := slog.New(fanoutHandler{
+		newEntryHandler(slog.LevelDebug, func(e activityEntry) { debug = append(debug, e.Message) }),
+		newEntryHandler(slog.LevelWarn, func(e activityEntry) { warn = append(warn, e.Message) }),
+	})
+
+	l.Debug("a")
+	l.With("k", "v").Warn("b")
+	l.Log(context.Background(), slog.LevelDebug-4, "c")
+
+	if strings.Join(debug, ",") != "a,b k=v" || strings.Join(warn, ",") != "b k=v" {
+		t.Errorf("got %q and %q", debug, warn)
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	useActivityEntries(t)
+
+	old := logLevel.Level()
+	t.Cleanup(func() { logLevel.Set(old) })
+
+	setLogLevel(slog.LevelWarn, false)
+	Debugf("debug %v", 1)
+	Logf("info %v", 2)
+	Warnf("warn %v", 3)
+	Errorf("error %v", 4)
+
+	got := getActivityText()
+	if strings.Contains(got, "debug 1") || strings.Contains(got, "info 2") {
+		t.Errorf("messages below the level were logged: %v", got)
+	}
+	if !strings.Contains(got, `<font color="#a05a00">warn 3</font>`) || !strings.Contains(got, `<font color="#c00000">error 4</font>`) {
+		t.Errorf("missing warning or error: %v", got)
+	}
+
+	// -v lowers the level, but doesn't raise it
+	setLogLevel(slog.LevelInfo, true)
+	if logLevel.Level() != slog.LevelDebug {
+		t.Errorf("-v: got %v", logLevel.Level())
+	}
+	setLogLevel(slog.LevelDebug-4, true)
+	if logLevel.Level() != slog.LevelDebug-4 {
+		t.Errorf("-v with a lower level: got %v", logLevel.Level())
+	}
+
+	setLogLevel(slog.LevelDebug, false)
+	Log("[Fast]", "<none>")
+	if !strings.Contains(getActivityText(), "<p>[Fast] &lt;none&gt;</p>") {
+		t.Errorf("Log wasn't escaped: %v", getActivityText())
+	}
+}
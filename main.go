@@ -1,20 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"maps"
 	"os"
 	"os/signal"
-	"path"
-	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/adrg/xdg"
 	"github.com/pwiecz/go-fltk"
-	"gopkg.in/yaml.v3"
 )
 
 var (
@@ -30,27 +29,21 @@ var (
 	// Data is stored between runs of this application in this yml config file.
 	configFilePath string
 	appConf        AppConfig
-)
 
-type AppConfig struct {
-	// The currently selected output directory for scanned images
-	SelectedDir      string
-	FilenameTemplate string
-	Scanners         []ScannerDevice
-	// The device that will perform the scanning operation
-	Device string
-	// Contains all of the options available for the device, as well as the
-	// constraints for each option (for example, the "resolution" option may
-	// have constraints of 100,200,300 dpi)
-	DeviceMap map[string][]string
-	// Contains the current settings for the device. Each key is the same
-	// as a value from deviceMap, although empty values may get removed before
-	// scanning occurs.
-	DeviceSettings map[string]string
-	// When the app is closed, the data from the activity feed is saved to this
-	// variable.
-	Log string
-}
+	// The path to the scanimage binary, as provided via flags.
+	scanimagePath string
+	// The backend that is used for discovering devices and scanning images.
+	backend Backend
+	// Runs the scans that the user asked for, one at a time.
+	jobs *JobManager
+	// The address that the HTTP API is served on alongside the interface, as
+	// provided via flags, and its server once it's started.
+	listenAddr string
+	apiSrv     *apiServer
+	// The file that activity is written to, which is nil if it couldn't be
+	// opened, and for the commands.
+	activityStore *activityLog
+)
 
 // Buttons, inputs, widgets, etc that need to be repositioned in a
 // responsive manner
@@ -58,23 +51,67 @@ var (
 	getDevicesBtn *fltk.Button
 	directoryBtn  *fltk.Button
 	scanBtn       *fltk.Button
+	// Scans a quick preview, on which the region to scan can be selected.
+	previewBtn    *fltk.Button
 	devicesChoice *fltk.Choice
-	// The options available for the device, such as resolution - as presented
-	// by sane. This is an FLTK choice picker for them.
-	optChoice *fltk.Choice
-	// The constraints for each device option, as presented by sane. This is an
-	// FLTK choice picker for them.
-	constChoice   *fltk.Choice
-	fileTmplInput *fltk.Input
-	activity      *fltk.HelpView
-	activityText  string
+	// A scrollable panel that lists all of the options available for the
+	// device, such as resolution - as presented by sane. Each option is a row
+	// in optionsPack with an editor that fits the option's constraint.
+	optionsScroll *fltk.Scroll
+	optionsPack   *fltk.Pack
+	// Toggles whether advanced and inactive options are shown in the panel.
+	advancedCheck *fltk.CheckButton
+	// Toggles whether scans take every page from the document feeder.
+	batchCheck *fltk.CheckButton
+	// The page size of PDFs, and whether scans are appended to existing PDFs.
+	pageSizeChoice *fltk.Choice
+	appendCheck    *fltk.CheckButton
+	fileTmplInput  *fltk.Input
+	// Shows the file that the next scan writes to, or what is wrong with the
+	// filename template.
+	filenamePreview *fltk.Box
+	// Applies, saves and deletes scan profiles.
+	profileChoice *fltk.Choice
+	// The value of the {label} token in the filename template.
+	labelInput *fltk.Input
+	// What happens when a scan would write to a file that already exists.
+	collisionChoice *fltk.Choice
+	activity        *fltk.HelpView
+	// Lists the queued, running and finished scans; the selected one (or the
+	// running one) is cancelled by cancelBtn.
+	jobsBrowser *fltk.HoldBrowser
+	cancelBtn   *fltk.Button
+	// Shows how far along the running scan is.
+	progressBar *fltk.Progress
+	// A strip of thumbnails of the files that were scanned, along with the
+	// actions that apply to the selected one.
+	galleryScroll    *fltk.Scroll
+	galleryPack      *fltk.Pack
+	galleryOpenBtn   *fltk.Button
+	galleryRenameBtn *fltk.Button
+	galleryDeleteBtn *fltk.Button
+	galleryRescanBtn *fltk.Button
+	galleryDirCheck  *fltk.CheckButton
+	// Opens the menu for clearing and exporting the activity log.
+	activityMenuBtn *fltk.MenuButton
+	// The HTML of the entries that the activity view shows, the latest last.
+	// Only use it through appendActivity, getActivityText and
+	// setActivityEntries, which are safe for concurrent use.
+	activityEntries []string
 )
 
 func parseFlags() {
 	flag.BoolVar(&forcePortrait, "portrait", false, "force portrait orientation for the interface")
 	flag.BoolVar(&forceLandscape, "landscape", false, "force landscape orientation for the interface")
 	flag.StringVar(&configFilePath, "f", "", "the config file to write to, instead of the default provided by XDG config directories")
+	flag.StringVar(&scanimagePath, "scanimage", "", "the path to the scanimage binary, instead of looking it up in $PATH")
+	var level slog.Level
+	flag.TextVar(&level, "log-level", slog.LevelInfo, "the lowest level of messages to log: debug, info, warn or error")
+	flag.StringVar(&listenAddr, "listen", "", "serve the HTTP API on this `address`, such as 127.0.0.1:8080, alongside the interface")
+	verbose := flag.Bool("v", false, "log debug messages too, such as the scanimage commands that are run; the same as -log-level debug")
 	flag.Parse()
+
+	setLogLevel(level, *verbose)
 }
 
 func main() {
@@ -86,36 +123,27 @@ func main() {
 
 	parseFlags()
 
-	var err error
+	backend = &ScanimageBackend{Path: scanimagePath}
 
-	if configFilePath == "" {
-		configFilePath, err = xdg.SearchConfigFile("go-fltk-sane/config.yml")
-		if err != nil {
-			log.Printf("failed to get xdg config dir: %v", err.Error())
-		}
-	}
-
-	if configFilePath != "" {
-		bac, err := os.ReadFile(configFilePath)
-		if err != nil {
-			log.Printf("config file not readable at %v", configFilePath)
-		}
+	// the activity log is opened first, so that upgrading an old config file
+	// can move the activity that it kept into it
+	openActivityStore()
+	loadConfig()
 
-		err = yaml.Unmarshal(bac, &appConf)
-		if err != nil {
-			log.Printf("config file %v failed to parse: %v", configFilePath, err.Error())
+	if flag.NArg() > 0 {
+		// the commands don't add to the activity log
+		if activityStore != nil {
+			activityStore.Close()
+			activityStore = nil
 		}
 
-		log.Printf("loaded config: %v", appConf)
-	} else {
-		if xdg.ConfigHome != "" {
-			configFilePath = path.Join(xdg.ConfigHome, "go-fltk-sane", "config.yml")
-			log.Printf("using %v for config file path", configFilePath)
-		} else {
-			log.Println("unable to automatically identify any suitable config dirs; configuration will not be saved")
+		for _, problem := range configProblems {
+			fmt.Fprintf(os.Stderr, "warning: config file: %v\n", problem)
 		}
+		os.Exit(runCLI(flag.Args(), os.Stdout, os.Stderr))
 	}
 
+	var err error
 	portrait, err = isPortrait()
 	if err != nil {
 		log.Fatalf("failed to determine screen size: %v", err.Error())
@@ -135,6 +163,9 @@ func main() {
 		portrait = false
 	}
 
+	// enables fltk.Awake, which is how other goroutines update the widgets
+	fltk.Lock()
+
 	win := fltk.NewWindow(windowWidth, windowHeight)
 	fltk.SetScheme("gtk+")
 	win.SetLabel("Main Window")
@@ -143,19 +174,74 @@ func main() {
 	getDevicesBtn = fltk.NewButton(0, 0, 0, 0, "Get Devices")
 	directoryBtn = fltk.NewButton(0, 0, 0, 0, "Choose directory...")
 	scanBtn = fltk.NewButton(0, 0, 0, 0, "Scan")
+	previewBtn = fltk.NewButton(0, 0, 0, 0, "Preview")
+	cancelBtn = fltk.NewButton(0, 0, 0, 0, "Cancel")
 	devicesChoice = fltk.NewChoice(0, 0, 0, 0)
-	optChoice = fltk.NewChoice(0, 0, 0, 0)
-	constChoice = fltk.NewChoice(0, 0, 0, 0)
+	profileChoice = fltk.NewChoice(0, 0, 0, 0)
+	advancedCheck = fltk.NewCheckButton(0, 0, 0, 0, "Show advanced options")
+	batchCheck = fltk.NewCheckButton(0, 0, 0, 0, "Scan all pages in feeder")
+	pageSizeChoice = fltk.NewChoice(0, 0, 0, 0)
+	appendCheck = fltk.NewCheckButton(0, 0, 0, 0, "Append to existing PDF")
+	optionsScroll = fltk.NewScroll(0, 0, 0, 0)
+	optionsScroll.SetType(fltk.SCROLL_VERTICAL)
+	optionsScroll.SetBox(fltk.DOWN_BOX)
+	optionsScroll.End()
 	fileTmplInput = fltk.NewInput(0, 0, 0, 0)
+	filenamePreview = fltk.NewBox(fltk.NO_BOX, 0, 0, 0, 0)
+	filenamePreview.SetAlign(fltk.ALIGN_INSIDE | fltk.ALIGN_LEFT | fltk.ALIGN_CLIP)
+	filenamePreview.SetLabelSize(12)
+	labelInput = fltk.NewInput(0, 0, 0, 0, "Label:")
+	collisionChoice = fltk.NewChoice(0, 0, 0, 0)
 	activity = fltk.NewHelpView(0, 0, 0, 0)
+	activityMenuBtn = fltk.NewMenuButton(0, 0, 0, 0, "Log")
+	jobsBrowser = fltk.NewHoldBrowser(0, 0, 0, 0)
+	progressBar = fltk.NewProgress(0, 0, 0, 0)
+	progressBar.SetMinimum(0)
+	progressBar.SetMaximum(100)
+	progressBar.SetSelectionColor(fltk.BLUE)
+	galleryScroll = fltk.NewScroll(0, 0, 0, 0)
+	galleryScroll.SetType(fltk.SCROLL_HORIZONTAL)
+	galleryScroll.SetBox(fltk.DOWN_BOX)
+	galleryScroll.End()
+	galleryOpenBtn = fltk.NewButton(0, 0, 0, 0, "Open")
+	galleryRenameBtn = fltk.NewButton(0, 0, 0, 0, "Rename")
+	galleryDeleteBtn = fltk.NewButton(0, 0, 0, 0, "Delete")
+	galleryRescanBtn = fltk.NewButton(0, 0, 0, 0, "Re-scan")
+	galleryDirCheck = fltk.NewCheckButton(0, 0, 0, 0, "Show whole directory")
+
+	jobs = NewJobManager(func(job ScanJob) {
+		onUI(refreshJobsBrowser)
+	})
+
+	cancelBtn.Deactivate()
+	cancelBtn.SetCallback(cancelJob)
 
+	previewBtn.SetCallback(startPreview)
+
+	galleryOpenBtn.SetCallback(openGalleryFile)
+	galleryRenameBtn.SetCallback(renameGalleryFile)
+	galleryDeleteBtn.SetCallback(deleteGalleryFile)
+	galleryRescanBtn.SetCallback(rescanGalleryFile)
+	galleryDirCheck.SetValue(appConf.GalleryShowDir)
+	galleryDirCheck.SetCallback(func() {
+		appConf.GalleryShowDir = galleryDirCheck.Value()
+		requestConfigSave()
+		refreshGallery()
+	})
+
+	// the preview of the filename follows along with each keystroke
+	fileTmplInput.SetCallbackCondition(fltk.WhenChanged)
 	fileTmplInput.SetCallback(func() {
-		f := fileTmplInput.Value()
+		appConf.FilenameTemplate = fileTmplInput.Value()
+		requestConfigSave()
+		updateFilenamePreview()
+	})
 
-		ext := getFileType(f)
-		if ext == "" {
-			fltk.MessageBox("Warning", "This application only supports png, jpg, and pdf formats.")
-		}
+	labelInput.SetCallbackCondition(fltk.WhenChanged)
+	labelInput.SetCallback(func() {
+		appConf.FilenameLabel = labelInput.Value()
+		requestConfigSave()
+		updateFilenamePreview()
 	})
 
 	scanBtn.SetCallback(func() {
@@ -168,9 +254,10 @@ func main() {
 			return
 		}
 
-		ext := strings.ToLower(getFileType(fileTmplInput.Value()))
-		if ext == "" {
-			fltk.MessageBox("Error", "This application only supports png, jpg, and pdf formats.")
+		vars := getCurrentTemplateVars(time.Now())
+		filename, pattern, err := scanFilenames(appConf.FilenameTemplate, appConf.SelectedDir, vars, appConf.BatchScan)
+		if err != nil {
+			fltk.MessageBox("Error", fmt.Sprintf("Unable to use the filename template: %v", err.Error()))
 			return
 		}
 
@@ -193,102 +280,33 @@ func main() {
 		// }
 		// }
 
-		go func() {
-			scanBtn.Deactivate()
-			scanBtn.SetLabel("Scanning...")
-			defer scanBtn.SetLabel("Scan")
-			defer scanBtn.Activate()
-
-			file := strings.ReplaceAll(fileTmplInput.Value(), "%t", fmt.Sprint(time.Now().Unix()))
-			pathToWrite := path.Join(appConf.SelectedDir, file)
-
-			// if useScanImage {
-			// conn.Close()
-			Logf("reading image using scanimage binary...")
-			out, err := ScanImage(pathToWrite, appConf.DeviceSettings, strings.TrimPrefix(ext, "."), appConf.Device)
-			if out != "" {
-				Log(out)
-			}
-			if err != nil {
-				fltk.MessageBox("Error", fmt.Sprintf("Failed to scan to file %v: %v", pathToWrite, err.Error()))
-				return
-			}
-
-			Logf("successfully wrote scanned image/document to %v", pathToWrite)
-
-			// 	return
-			// }
-
-			// Logf("reading image using sane lib...")
-
-			// img, err := conn.ReadImage()
-			// if err != nil {
-			// 	fltk.MessageBox("Error", fmt.Sprintf("Failed to read image: %v", err.Error()))
-			// 	return
-			// }
-
-			// switch ext {
-			// case ".pdf":
-			// 	f, err := os.Create(pathToWrite)
-			// 	if err != nil {
-			// 		fltk.MessageBox("Error", fmt.Sprintf("Failed to create pdf file %v: %v", pathToWrite, err.Error()))
-			// 		return
-			// 	}
-			// 	defer f.Close()
-
-			// 	Logf("preparing pdf...")
-			// 	pdf := gofpdf.New("P", "mm", "A4", "")
-			// 	defer pdf.Close()
-			// 	pdf.AddPage()
-
-			// 	Logf("encoding image for pdf...")
-			// 	buf := &bytes.Buffer{}
-			// 	err = png.Encode(buf, img)
-			// 	if err != nil {
-			// 		fltk.MessageBox("Error", fmt.Sprintf("Failed to convert to png: %v", err.Error()))
-			// 		return
-			// 	}
-
-			// 	imageInfo := pdf.RegisterImageOptionsReader("image", gofpdf.ImageOptions{
-			// 		ImageType: "PNG",
-			// 		ReadDpi:   false,
-			// 	}, buf)
-
-			// 	imageInfo.SetDpi(float64(selectedRes))
-
-			// 	Logf("imageInfo: h=%v w=%v", imageInfo.Height(), imageInfo.Width())
-
-			// 	pdf.ImageOptions("image", 0, 0, -1, -1, false, gofpdf.ImageOptions{
-			// 		ImageType: "PNG",
-			// 		ReadDpi:   false,
-			// 	}, 0, "")
+		req := scanRequest{
+			Filename:    filename,
+			PagePattern: pattern,
+			Device:      appConf.Device,
+			Settings:    maps.Clone(appConf.DeviceSettings),
+			Layout: pdfLayout{
+				DPI:      getScanResolution(appConf.DeviceOptions, appConf.DeviceSettings),
+				PageSize: appConf.PDFPageSize,
+			},
+			Batch:     appConf.BatchScan,
+			AppendPDF: appConf.AppendPDF,
+		}
 
-			// 	// Save the PDF
-			// 	err = pdf.Output(f)
-			// 	if err != nil {
-			// 		fltk.MessageBox("Error", fmt.Sprintf("Failed to write pdf to disk: %v", err.Error()))
-			// 		return
-			// 	}
-			// 	Logf("successfully wrote pdf file to %v", pathToWrite)
-			// case ".png":
-			// 	f, err := os.Create(pathToWrite)
-			// 	if err != nil {
-			// 		fltk.MessageBox("Error", fmt.Sprintf("Failed to create png file %v: %v", pathToWrite, err.Error()))
-			// 		return
-			// 	}
-			// 	defer f.Close()
+		req, ok := resolveCollisions(req)
+		if !ok {
+			return
+		}
 
-			// 	Logf("preparing png...")
-			// 	err = png.Encode(f, img)
-			// 	if err != nil {
-			// 		fltk.MessageBox("Error", fmt.Sprintf("Failed to write png to disk: %v", err.Error()))
-			// 		return
-			// 	}
-			// 	Logf("successfully scanned image to %v", pathToWrite)
-			// }
+		err = submitScan(req)
+		if err != nil {
+			fltk.MessageBox("Error", fmt.Sprintf("Unable to queue the scan: %v", err.Error()))
+			return
+		}
 
-			// defer runtime.GC()
-		}()
+		appConf.FilenameCounter = nextFilenameCounter(appConf.FilenameTemplate, vars.Counter)
+		requestConfigSave()
+		updateFilenamePreview()
 	})
 
 	directoryBtn.SetCallback(func() {
@@ -305,104 +323,11 @@ func main() {
 			}
 			appConf.SelectedDir = dir
 			Logf("will save scanned files to directory: %v", appConf.SelectedDir)
+			requestConfigSave()
+			refreshGallery()
 		}
 	})
 
-	deviceOptConstrChoiceCallback := func(option string, constraint string) func() {
-		return func() {
-			Logf("setting option %v to %v", option, constraint)
-			appConf.DeviceSettings[option] = constraint
-
-			// Logf("setting option %v to %v", options[j].Name, options[j].ConstrSet[k])
-			// _, err := conn.SetOption(options[j].Name, options[j].ConstrSet[k])
-			// if err != nil {
-			// 	fltk.MessageBox("Error", fmt.Sprintf("Failed to set %v to %v: %v", options[j].Name, options[j].ConstrSet[k], err.Error()))
-			// 	return
-			// }
-
-			// update the stored resolution value
-			// if strings.ToLower(options[j].Name) == "resolution" {
-			// 	r, ok := options[j].ConstrSet[k].(int)
-			// 	if !ok {
-			// 		Logf("failed to cast resolution dpi %v as int", options[j].ConstrSet[k])
-			// 	} else {
-			// 		selectedRes = r
-			// 		Logf("updated selected resolution to %v", selectedRes)
-			// 	}
-			// }
-		}
-	}
-
-	deviceOptChoiceCallback := func(option string, constraints []string) func() {
-		return func() {
-			// clear out the constChoice options
-			// iterate through all the constraints for this option
-			// and add each of them to the constChoice items
-
-			if constChoice == nil {
-				fltk.MessageBox("Error", "Unable to populate the device constraints choice widget.")
-				return
-			}
-
-			constChoice.Clear()
-			constChoice.Redraw()
-
-			// Logf("constraints for option %v: %v", options[j].Name, options[j].ConstrSet)
-			Logf("constraints for option %v: %v", option, constraints)
-
-			// get the current value
-			// current, err := conn.GetOption(options[j].Name)
-			// if err != nil {
-			// 	Logf("failed to get the currently selected option: %v", err.Error())
-			// 	return
-			// }
-
-			selectedIndex := 0
-
-			// for k := range options[j].ConstrSet {
-			for k, constraint := range constraints {
-				// k := k
-				// Logf("adding option %v constraint %v choice...", options[j].Name, options[j].ConstrSet[k])
-				// l := fmt.Sprint(options[j].ConstrSet[k])
-				// constChoice.Add(l, func() {
-				constChoice.Add(constraint, deviceOptConstrChoiceCallback(option, constraint))
-
-				// set a default value for the resolution (seems like sane usually just picks
-				// the first value)
-				// if selectedRes == 0 && strings.ToLower(options[j].Name) == "resolution" {
-				// 	r, ok := options[j].ConstrSet[k].(int)
-				// 	if !ok {
-				// 		Logf("failed to cast resolution dpi %v as int", options[j].ConstrSet[k])
-				// 	} else {
-				// 		selectedRes = r
-				// 		Logf("updated selected resolution to %v", selectedRes)
-				// 	}
-				// }
-
-				// if l == fmt.Sprint(current) && l != "" {
-				// 	selectedIndex = k
-				// }
-
-				c, ok := appConf.DeviceSettings[option]
-				if !ok || c == "" {
-					return
-				}
-				if c == constraint {
-					selectedIndex = k
-				}
-			}
-
-			// if len(options[j].ConstrSet) == 0 {
-			if len(constraints) == 0 {
-				constChoice.Deactivate()
-			} else {
-				constChoice.Activate()
-				constChoice.SetValue(selectedIndex)
-				constChoice.Redraw()
-			}
-		}
-	}
-
 	getDeviceOptsCallback := func(i int, scanner ScannerDevice) func() {
 		return func() {
 			// if conn != nil {
@@ -426,8 +351,7 @@ func main() {
 			// }
 			// }
 
-			appConf.Device = scanner.Device
-			Log(appConf.Device)
+			Log(scanner.Device)
 			// conn, err = sane.Open(device)
 			// if err != nil {
 			// 	fltk.MessageBox("Error", fmt.Sprintf("Failed to connect to device %v: %v", device, err.Error()))
@@ -441,53 +365,17 @@ func main() {
 
 			// options := conn.Options()
 
-			appConf.DeviceMap, appConf.DeviceSettings, err = getDeviceOptionsConstraints(appConf.Device)
+			err := selectDevice(scanner.Device)
 			if err != nil {
 				fltk.MessageBox("Error", fmt.Sprintf("Unable to get device options: %v", err.Error()))
 				return
 			}
 
-			optChoice.Clear()
-			constChoice.Clear()
-			optChoice.Redraw()
-			constChoice.Redraw()
-			// for j := range options {
-			for option, constraints := range appConf.DeviceMap {
-				// j := j
-				// Logf("device option: %v, values: %v", options[j].Name, options[j].ConstrSet)
-				// optLabel := options[j].Name
-				// if len(options[j].ConstrSet) == 0 {
-				// optLabel = fmt.Sprintf("%v [no options]", optLabel)
-				// }
-				optLabel := option
-				if len(constraints) == 0 {
-					optLabel = fmt.Sprintf("%v [no options]", optLabel)
-				}
-
-				optChoice.Add(optLabel, deviceOptChoiceCallback(option, constraints))
-
-				// switch option.Name {
-				// case "resolution":
-				// 	for _, resolution := range option.ConstrSet {
-				// 		r, ok := resolution.(int)
-				// 		if !ok {
-				// 			Logf("failed to cast %v as string", resolution)
-				// 			continue
-				// 		}
-				// 		optChoice.Add(fmt.Sprintf("%v dpi", r), func() {
-				// 			Logf("setting device resolution to %v", r)
-				// 			// selectedRes = r
-				// 			info, err := conn.SetOption(option.Name, resolution)
-				// 			if err != nil {
-				// 				fltk.MessageBox("Error", fmt.Sprintf("Failed to set %v to %v: %v", option.Name, resolution, err.Error()))
-				// 				return
-				// 			}
-
-				// 			Logf("info: %v", info)
-				// 		})
-				// 	}
-				// }
-			}
+			requestConfigSave()
+			rebuildOptionsPanel()
+			// the options depend on the restored settings, such as the
+			// resolutions of each source
+			requestDeviceOptionsRefresh()
 
 			// res, err := conn.GetOption("resolution")
 			// if err != nil {
@@ -503,6 +391,7 @@ func main() {
 			// Logf("current resolution for this device: %v", res)
 
 			scanBtn.Activate()
+			previewBtn.Activate()
 		}
 	}
 
@@ -522,44 +411,61 @@ func main() {
 			// }
 
 			Log("please wait, scanning devices...")
-			var err error
-			appConf.Scanners, err = getDevices()
-			if err != nil {
-				fltk.MessageBox("Error", fmt.Sprintf("Failed to get scanner devices: %v", err.Error()))
-				return
-			}
+			scanners, err := backend.ListDevices()
 
-			if devicesChoice != nil {
-				devicesChoice.Clear()
-			}
+			onUI(func() {
+				getDevicesBtn.Activate()
+				getDevicesBtn.SetValue(false)
+				getDevicesBtn.SetLabel("Get Devices")
 
-			for i, scanner := range appConf.Scanners {
-				Logf("scanner device: %v, model: %v", scanner.Device, scanner.Model)
-				devicesChoice.AddEx(
-					strings.ReplaceAll(fmt.Sprintf("%v (%v) [%v]", scanner.Model, scanner.Device, scanner.Type), "/", "\\/"),
-					getShortcut(i),
-					getDeviceOptsCallback(i, scanner),
-					fltk.MENU_VALUE,
-				)
-			}
+				if err != nil {
+					fltk.MessageBox("Error", fmt.Sprintf("Failed to get scanner devices: %v", err.Error()))
+					return
+				}
+
+				appConf.Scanners = scanners
+				requestConfigSave()
+				devicesChoice.Clear()
 
-			getDevicesBtn.Activate()
-			getDevicesBtn.SetValue(false)
-			getDevicesBtn.SetLabel("Get Devices")
+				for i, scanner := range appConf.Scanners {
+					Logf("scanner device: %v, model: %v", scanner.Device, scanner.Model)
+					devicesChoice.AddEx(
+						menuLabel(fmt.Sprintf("%v (%v) [%v]", scanner.Model, scanner.Device, scanner.Type)),
+						getShortcut(i),
+						getDeviceOptsCallback(i, scanner),
+						fltk.MENU_VALUE,
+					)
+				}
+			})
 		}()
 	}
 
 	getDevicesBtn.SetCallback(getDevicesCallback)
 
 	devicesChoice.SetTooltip("Discovered devices will show up here. Press the Get Devices button below first.")
-	optChoice.SetTooltip("Device options will appear here, once a device is chosen")
-	constChoice.SetTooltip("Choose a configurable parameter from the left dropdown, and the available options will be shown here")
-	fileTmplInput.SetTooltip("Set the templated filename. %t=unix epoch seconds")
+	profileChoice.SetTooltip("Profiles switch the device, its settings, the output directory and the filename template all at once. Alt+1 to Alt+9 apply the first nine profiles, and Alt+S saves the current choices as a profile")
+	advancedCheck.SetTooltip("Also show the options that are meant for advanced users, and the options that are inactive with the current settings")
+	batchCheck.SetTooltip("Scan every page in the automatic document feeder. Each page is saved to its own file, and the pages are also combined into a single PDF document")
+	pageSizeChoice.SetTooltip("The page size of PDFs. Scans are placed in the top-left corner of fixed page sizes at their true size, according to the resolution they were scanned at")
+	appendCheck.SetTooltip("When scanning to a PDF that already exists, add the pages to the end of it instead of replacing it. Use a filename template without %t so that each scan goes to the same PDF")
+	previewBtn.SetTooltip("Scan a quick, low resolution preview of the whole area of the device, and drag a rectangle on it to choose the region to scan. Note that a document feeder will take a page for the preview")
+	cancelBtn.SetTooltip("Cancel the selected scan, or the running scan if none is selected")
+	jobsBrowser.SetTooltip("Scans that are queued, running, or finished")
+	galleryScroll.SetTooltip("The files that were scanned during this session, newest first. Double click a file to open it")
+	galleryOpenBtn.SetTooltip("Open the selected file in its default application")
+	galleryRenameBtn.SetTooltip("Rename the selected file")
+	galleryDeleteBtn.SetTooltip("Delete the selected file")
+	galleryRescanBtn.SetTooltip("Scan the selected file again with the settings it was scanned with, replacing it. Only single page scans that weren't appended to a PDF can be scanned again")
+	galleryDirCheck.SetTooltip("Also show the other images and documents in the output directory")
+	fileTmplInput.SetTooltip(fmt.Sprintf("Set the templated filename. The tokens are:\n\n%v", FILENAME_TEMPLATE_HELP))
+	labelInput.SetTooltip("A label for the {label} token in the filename template, such as receipts")
+	activityMenuBtn.SetTooltip(fmt.Sprintf("Clear the activity log, or export all of it to a file. The log is kept in the XDG state directory, and only the latest %v entries are shown here", MAX_ACTIVITY_ENTRIES))
+	collisionChoice.SetTooltip("What to do when the next scan's file already exists: add a number to the new file's name, replace the existing file, or ask each time")
 
 	if len(appConf.Scanners) != 0 {
 		for i, scanner := range appConf.Scanners {
 			devicesChoice.AddEx(
-				strings.ReplaceAll(fmt.Sprintf("%v (%v) [%v]", scanner.Model, scanner.Device, scanner.Type), "/", "\\/"),
+				menuLabel(fmt.Sprintf("%v (%v) [%v]", scanner.Model, scanner.Device, scanner.Type)),
 				getShortcut(i),
 				getDeviceOptsCallback(i, scanner),
 				fltk.MENU_VALUE,
@@ -573,87 +479,123 @@ func main() {
 		devicesChoice.Add("Discovered devices will show up here. Click here or press the Get Devices button below first.", getDevicesCallback)
 	}
 
-	if appConf.DeviceMap != nil && len(appConf.DeviceMap) != 0 {
-		validSettings := appConf.DeviceSettings != nil && len(appConf.DeviceSettings) != 0
-		for option, constraints := range appConf.DeviceMap {
-			optLabel := option
-			if len(constraints) == 0 {
-				optLabel = fmt.Sprintf("%v [no options]", optLabel)
-			}
+	advancedCheck.SetValue(appConf.ShowAdvanced)
+	advancedCheck.SetCallback(func() {
+		appConf.ShowAdvanced = advancedCheck.Value()
+		requestConfigSave()
+		rebuildOptionsPanel()
+	})
 
-			optChoice.Add(optLabel, deviceOptChoiceCallback(option, constraints))
-			optChoice.SetValue(0)
-			for i, constraint := range constraints {
-				constChoice.Add(constraint, deviceOptConstrChoiceCallback(option, constraint))
-				if validSettings {
-					presetConstraint, ok := appConf.DeviceSettings[option]
-					if ok && presetConstraint == constraint {
-						constChoice.SetValue(i)
-					}
-				}
-			}
-		}
-	} else {
-		optChoice.Add("Device options will appear here, once a device is chosen", nil)
-	}
+	batchCheck.SetValue(appConf.BatchScan)
+	batchCheck.SetCallback(func() {
+		appConf.BatchScan = batchCheck.Value()
+		requestConfigSave()
+		updateFilenamePreview()
+	})
 
-	if appConf.DeviceSettings == nil || len(appConf.DeviceSettings) == 0 {
-		constChoice.Add("Choose a configurable parameter from the left dropdown, and the available options will be shown here", nil)
+	for _, name := range pdfPageSizeNames {
+		pageSizeChoice.Add(fmt.Sprintf("PDF page size: %v", name), func() {
+			appConf.PDFPageSize = name
+			requestConfigSave()
+		})
 	}
+	pageSizeChoice.SetValue(indexOf(pdfPageSizeNames, appConf.PDFPageSize))
 
-	if appConf.Log != "" {
-		activityText = appConf.Log
-	} else {
-		activityText = "<i>Information will appear here.</i><br/>"
+	for _, policy := range collisionPolicies {
+		collisionChoice.Add(fmt.Sprintf("If it exists: %v", collisionPolicyNames[policy]), func() {
+			appConf.CollisionPolicy = policy
+			requestConfigSave()
+		})
 	}
-	activity.SetValue(activityText)
+	collisionChoice.SetValue(indexOf(collisionPolicies, getCollisionPolicy(appConf.CollisionPolicy)))
 
-	if appConf.FilenameTemplate != "" {
-		fileTmplInput.SetValue(appConf.FilenameTemplate)
-	} else {
-		fileTmplInput.SetValue("scanned-doc-%t.png")
+	appendCheck.SetValue(appConf.AppendPDF)
+	appendCheck.SetCallback(func() {
+		appConf.AppendPDF = appendCheck.Value()
+		requestConfigSave()
+	})
+
+	rebuildOptionsPanel()
+	rebuildProfileChoice()
+	refreshGallery()
+
+	loadActivity()
+	activity.SetValue(getActivityText())
+
+	activityMenuBtn.Add("Clear log", clearActivity)
+	activityMenuBtn.Add("Export log...", exportActivity)
+
+	if appConf.FilenameTemplate == "" {
+		appConf.FilenameTemplate = DEFAULT_FILENAME_TEMPLATE
 	}
+	fileTmplInput.SetValue(appConf.FilenameTemplate)
+	labelInput.SetValue(appConf.FilenameLabel)
+	updateFilenamePreview()
 
 	if appConf.SelectedDir == "" || appConf.Device == "" {
 		scanBtn.Deactivate()
 	}
+	if appConf.Device == "" {
+		previewBtn.Deactivate()
+	}
 	activity.SetCallback(nil)
 
-	gracefulExit := func() {
-		Log("closing app and saving config, please wait a moment...")
+	finishExit := func() {
 		// if conn != nil {
 		// 	conn.Close()
 		// }
 		// sane.Exit()
 
-		if configFilePath != "" {
-			// push the activity log to the config
-			if activity != nil {
-				appConf.Log = activity.Value()
-			}
-
-			// write the config
-			b, err := yaml.Marshal(appConf)
-			if err != nil {
-				log.Printf("failed to marshal app config to yaml: %v", err.Error())
-			} else {
-				dir, _ := filepath.Split(configFilePath)
-				err := os.MkdirAll(dir, 0o755)
-				if err != nil {
-					log.Printf("failed to create app config parent dir %v: %v", dir, err.Error())
-				}
-				err = os.WriteFile(configFilePath, b, 0o644)
-				if err != nil {
-					log.Printf("failed to save app config to %v: %v", configFilePath, err.Error())
-				}
-			}
+		rememberDeviceSettings()
 
+		// stop any scans, so that scanimage isn't left running
+		ctx, cancel := context.WithTimeout(context.Background(), COMMAND_WAIT_DELAY*2)
+		err := jobs.Close(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("failed to stop the running scan: %v", err.Error())
 		}
 
+		// the config is saved right away instead
+		configSaver.Stop()
+		saveConfig()
+
 		Log("done, exiting now.")
+		if activityStore != nil {
+			activityStore.Close()
+		}
 		os.Exit(0)
 	}
 
+	exiting := false
+	gracefulExit := func() {
+		if exiting {
+			return
+		}
+		exiting = true
+
+		Log("closing app and saving config, please wait a moment...")
+
+		if apiSrv == nil {
+			finishExit()
+			return
+		}
+
+		// the requests to the HTTP API wait for the UI thread, so the server
+		// is shut down in the background while the event loop keeps running
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), COMMAND_WAIT_DELAY)
+			defer cancel()
+
+			err := apiSrv.Shutdown(ctx)
+			if err != nil {
+				log.Printf("failed to stop the HTTP API: %v", err.Error())
+			}
+
+			onUI(finishExit)
+		}()
+	}
+
 	win.SetCallback(gracefulExit)
 
 	fltk.EnableTooltips()
@@ -674,14 +616,33 @@ func main() {
 	win.End()
 	win.Show()
 
-	go fltk.Run()
+	if len(configProblems) > 0 {
+		for _, problem := range configProblems {
+			Warnf("config file: %v", problem)
+		}
+		fltk.MessageBox("Config file", fmt.Sprintf("There were problems with the config file:\n\n%v", strings.Join(configProblems, "\n")))
+	}
+
+	if listenAddr != "" {
+		apiSrv, err = startGUIAPIServer(listenAddr)
+		if err != nil {
+			Errorf("%v", err.Error())
+			fltk.MessageBox("Error", fmt.Sprintf("Unable to start the HTTP API: %v", err.Error()))
+		}
+	}
 
 	// Create a channel to receive OS signals
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// Block until a signal is received
-	<-signalChan
+	go func() {
+		// Block until a signal is received
+		<-signalChan
+
+		onUI(gracefulExit)
+	}()
 
-	gracefulExit()
+	// the event loop must run on the main thread, which this goroutine is
+	// locked to
+	fltk.Run()
 }
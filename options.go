@@ -0,0 +1,669 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OptionType is the SANE type of an option's value.
+type OptionType string
+
+const (
+	OptionTypeBool   OptionType = "bool"
+	OptionTypeInt    OptionType = "int"
+	OptionTypeFixed  OptionType = "fixed"
+	OptionTypeString OptionType = "string"
+	OptionTypeButton OptionType = "button"
+)
+
+// ConstraintKind describes how the values of an option are constrained.
+type ConstraintKind string
+
+const (
+	// The option accepts one value out of DeviceOption.Values.
+	ConstraintList ConstraintKind = "list"
+	// The option accepts a number between DeviceOption.Min and
+	// DeviceOption.Max, in steps of DeviceOption.Step.
+	ConstraintRange ConstraintKind = "range"
+	// The option accepts yes or no.
+	ConstraintBool ConstraintKind = "bool"
+	// The option accepts any value of its type.
+	ConstraintString ConstraintKind = "string"
+	// The option does not accept a value, such as a button.
+	ConstraintNone ConstraintKind = "none"
+)
+
+// Flags that scanimage prints in brackets after an option.
+const (
+	FlagInactive  = "inactive"
+	FlagAdvanced  = "advanced"
+	FlagReadOnly  = "read-only"
+	FlagHardware  = "hardware"
+	FlagEmulated  = "emulated"
+	FlagAutomatic = "automatic"
+)
+
+// The units that scanimage may append to numeric constraints. Longer units
+// come first so that they are matched before shorter ones.
+var optionUnits = []string{"dpi", "pel", "bit", "mm", "us", "%"}
+
+// fixedOptionUnits are the units of measurements, which backends keep as fixed
+// point numbers. Ranges of them are only whole numbers if their steps are.
+var fixedOptionUnits = []string{"mm", "%"}
+
+// rangeRegexp matches range constraints such as "-50..50%" or "0..215.9mm".
+var rangeRegexp = regexp.MustCompile(`^(-?[0-9.]+)\.\.(-?[0-9.]+)([a-z%]*)$`)
+
+// stepsRegexp matches the quantization that follows a range constraint.
+var stepsRegexp = regexp.MustCompile(`\s*\(in steps of ([0-9.]+)\)$`)
+
+// DeviceOption is a single option of a scanner device, as described by
+// `scanimage -A`.
+type DeviceOption struct {
+	// The name of the option without any leading dashes, such as "mode" or
+	// "l".
+	Name string
+	// The option group that the option is listed under, such as "Geometry".
+	Group string
+	Type  OptionType
+	// The unit of numeric options, such as "dpi", "mm" or "%".
+	Unit string
+	Kind ConstraintKind
+	// The constraint exactly as printed by scanimage, such as
+	// "-50..50% (in steps of 1)".
+	Constraint string
+	// The accepted values when Kind is ConstraintList.
+	Values []string
+	// The accepted range when Kind is ConstraintRange. A Step of 0 means that
+	// any value within the range is accepted.
+	Min  float64
+	Max  float64
+	Step float64
+	// True if the option holds a list of values, such as a gamma table.
+	Array bool
+	// True if the option can also be set to "auto", which lets the device
+	// choose the value, as scanimage shows with an "auto|" prefix on the
+	// constraint.
+	Auto bool
+	// The value that the device reported when the option was first
+	// discovered.
+	Default string
+	// The value that the device currently reports. This is empty when the
+	// device doesn't report one, such as for inactive options.
+	Current     string
+	Description string
+	// Flags such as FlagInactive or FlagAdvanced.
+	Flags []string
+}
+
+// HasFlag returns true if the option was printed with the flag.
+func (o DeviceOption) HasFlag(flag string) bool {
+	for _, f := range o.Flags {
+		if f == flag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Inactive returns true if the option currently can't be used, usually
+// because it depends on the value of another option.
+func (o DeviceOption) Inactive() bool {
+	return o.HasFlag(FlagInactive)
+}
+
+// Advanced returns true if the option is meant for advanced users only.
+func (o DeviceOption) Advanced() bool {
+	return o.HasFlag(FlagAdvanced)
+}
+
+// Settable returns true if the value of the option can be set by the user.
+func (o DeviceOption) Settable() bool {
+	return o.Kind != ConstraintNone && !o.HasFlag(FlagReadOnly) && !o.HasFlag(FlagHardware)
+}
+
+// Validate returns an error if the option does not accept value. Empty values
+// are always accepted, since they are never passed to the device.
+func (o DeviceOption) Validate(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	if !o.Settable() {
+		return fmt.Errorf("%v cannot be set", o.Name)
+	}
+
+	if o.Auto && value == "auto" {
+		return nil
+	}
+
+	switch o.Kind {
+	case ConstraintList:
+		for _, v := range o.Values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("%v is not one of the values accepted by %v: %v", value, o.Name, strings.Join(o.Values, ", "))
+	case ConstraintBool:
+		if value != "yes" && value != "no" {
+			return fmt.Errorf("%v must be yes or no, got %v", o.Name, value)
+		}
+	case ConstraintRange:
+		f, err := o.parseNumber(value)
+		if err != nil {
+			return err
+		}
+		if f < o.Min || f > o.Max {
+			return fmt.Errorf("%v must be between %v and %v%v, got %v", o.Name, o.Min, o.Max, o.Unit, value)
+		}
+		if o.Step != 0 {
+			// fixed point values are rounded by the device, so allow for a
+			// little imprecision
+			steps := (f - o.Min) / o.Step
+			if math.Abs(steps-math.Round(steps)) > 0.01 {
+				return fmt.Errorf("%v must be in steps of %v starting at %v, got %v", o.Name, o.Step, o.Min, value)
+			}
+		}
+	case ConstraintString:
+		if o.Array {
+			return nil
+		}
+		if o.Type == OptionTypeInt || o.Type == OptionTypeFixed {
+			_, err := o.parseNumber(value)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseNumber parses value according to the type of the option.
+func (o DeviceOption) parseNumber(value string) (float64, error) {
+	if o.Type == OptionTypeInt {
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%v must be a whole number, got %v", o.Name, value)
+		}
+		return float64(i), nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%v must be a number, got %v", o.Name, value)
+	}
+
+	return f, nil
+}
+
+// formatOptionNumber formats a number for an option of type t, so that it can
+// be passed to scanimage.
+func formatOptionNumber(f float64, t OptionType) string {
+	if t == OptionTypeInt {
+		return strconv.FormatInt(int64(math.Round(f)), 10)
+	}
+
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// isOptionFlag returns true if s is one of the flags printed by scanimage.
+func isOptionFlag(s string) bool {
+	switch s {
+	case FlagInactive, FlagAdvanced, FlagReadOnly, FlagHardware, FlagEmulated, FlagAutomatic:
+		return true
+	}
+
+	return false
+}
+
+// splitTrailingBrackets splits the trailing bracketed groups off of s, such as
+// "[24bit Color[Fast]]" and "[advanced]" in
+// "Color[Fast]|Gray [24bit Color[Fast]] [advanced]". Only groups that are
+// preceded by a space are split off, so that "Gray[Error Diffusion]" stays
+// intact. The groups are returned in the order that they appear, without their
+// outer brackets.
+func splitTrailingBrackets(s string) (string, []string) {
+	groups := []string{}
+
+	for strings.HasSuffix(s, "]") {
+		depth := 0
+		start := -1
+		for i := len(s) - 1; i >= 0; i-- {
+			switch s[i] {
+			case ']':
+				depth++
+			case '[':
+				depth--
+			}
+			if depth == 0 {
+				start = i
+				break
+			}
+		}
+
+		if start < 0 || (start > 0 && s[start-1] != ' ') {
+			break
+		}
+
+		groups = append([]string{s[start+1 : len(s)-1]}, groups...)
+		s = strings.TrimSpace(s[:start])
+	}
+
+	return s, groups
+}
+
+// splitUnit splits a known unit off of the end of s, such as "1200dpi".
+func splitUnit(s string) (string, string) {
+	for _, unit := range optionUnits {
+		if strings.HasSuffix(s, unit) {
+			return strings.TrimSuffix(s, unit), unit
+		}
+	}
+
+	return s, ""
+}
+
+// isNumber returns true if s can be parsed as a float.
+func isNumber(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+// numericType returns OptionTypeInt if all of the values are whole numbers,
+// and OptionTypeFixed otherwise.
+func numericType(values ...string) OptionType {
+	for _, v := range values {
+		if strings.Contains(v, ".") {
+			return OptionTypeFixed
+		}
+	}
+
+	return OptionTypeInt
+}
+
+// parseConstraint fills in the type, unit and constraint fields of opt based on
+// its raw constraint, such as "0..215.9mm (in steps of 0.0999908)",
+// "Lineart|Gray|Color" or "auto|-100..100".
+func parseConstraint(opt *DeviceOption) {
+	c := opt.Constraint
+	if rest, ok := strings.CutPrefix(c, "auto|"); ok {
+		opt.Auto = true
+		c = rest
+	}
+	if strings.Contains(c, ",...") {
+		opt.Array = true
+		c = strings.ReplaceAll(c, ",...", "")
+	}
+
+	switch c {
+	case "":
+		opt.Type = OptionTypeButton
+		opt.Kind = ConstraintNone
+		return
+	case "<int>":
+		opt.Type = OptionTypeInt
+		opt.Kind = ConstraintString
+		return
+	case "<float>":
+		opt.Type = OptionTypeFixed
+		opt.Kind = ConstraintString
+		return
+	case "<string>":
+		opt.Type = OptionTypeString
+		opt.Kind = ConstraintString
+		return
+	}
+
+	step := 0.0
+	withoutSteps := c
+	if m := stepsRegexp.FindStringSubmatch(c); m != nil {
+		step, _ = strconv.ParseFloat(m[1], 64)
+		withoutSteps = strings.TrimSpace(c[:len(c)-len(m[0])])
+	}
+
+	if m := rangeRegexp.FindStringSubmatch(withoutSteps); m != nil && isNumber(m[1]) && isNumber(m[2]) {
+		opt.Kind = ConstraintRange
+		opt.Min, _ = strconv.ParseFloat(m[1], 64)
+		opt.Max, _ = strconv.ParseFloat(m[2], 64)
+		opt.Step = step
+		opt.Unit = m[3]
+		opt.Type = numericType(m[1], m[2])
+		switch {
+		case step != 0 && step != float64(int64(step)):
+			opt.Type = OptionTypeFixed
+		case step == 0 && slices.Contains(fixedOptionUnits, opt.Unit):
+			// the bounds of measurements can be whole numbers, such as
+			// "0..218mm", without the values in between having to be
+			opt.Type = OptionTypeFixed
+		}
+		return
+	}
+
+	opt.Kind = ConstraintList
+	opt.Values = strings.Split(c, "|")
+
+	// numeric lists have their unit appended to the last value, such as
+	// "100|150|200dpi"
+	last, unit := splitUnit(opt.Values[len(opt.Values)-1])
+	numeric := isNumber(last)
+	for _, v := range opt.Values[:len(opt.Values)-1] {
+		numeric = numeric && isNumber(v)
+	}
+
+	if !numeric {
+		opt.Type = OptionTypeString
+		return
+	}
+
+	opt.Values[len(opt.Values)-1] = last
+	opt.Unit = unit
+	opt.Type = numericType(opt.Values...)
+}
+
+// parseDeviceOptionLine parses a single option line from `scanimage -A`, such
+// as "--mode Lineart|Gray|Color [Lineart]" or
+// "--mirror[=(yes|no)] [no] [advanced]".
+func parseDeviceOptionLine(line string) (DeviceOption, bool) {
+	line = strings.TrimLeft(strings.TrimSpace(line), "-")
+
+	end := strings.IndexAny(line, " [")
+	if end < 0 {
+		end = len(line)
+	}
+
+	opt := DeviceOption{Name: line[:end], Flags: []string{}}
+	if !nameRegexp.MatchString(opt.Name) {
+		return opt, false
+	}
+
+	rest := line[end:]
+	if r, ok := strings.CutPrefix(rest, "[=(auto|yes|no)]"); ok {
+		opt.Auto = true
+		rest = "[=(yes|no)]" + r
+	}
+	isBool := strings.HasPrefix(rest, "[=(yes|no)]")
+	if isBool {
+		rest = strings.TrimPrefix(rest, "[=(yes|no)]")
+	}
+
+	rest, groups := splitTrailingBrackets(strings.TrimSpace(rest))
+	for i, group := range groups {
+		// the first group is the current value, unless the device didn't
+		// report one
+		if i == 0 && !isOptionFlag(group) {
+			opt.Current = group
+			continue
+		}
+
+		opt.Flags = append(opt.Flags, group)
+	}
+
+	opt.Default = opt.Current
+	opt.Constraint = rest
+
+	if isBool {
+		opt.Type = OptionTypeBool
+		opt.Kind = ConstraintBool
+		opt.Values = []string{"yes", "no"}
+		return opt, true
+	}
+
+	parseConstraint(&opt)
+
+	return opt, true
+}
+
+// nameRegexp matches valid sane option names.
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+// indentation returns the number of leading spaces of s.
+func indentation(s string) int {
+	return len(s) - len(strings.TrimLeft(s, " "))
+}
+
+// parseDeviceOptions parses the full output of `scanimage -A`, including
+// inactive and advanced options, in the order that scanimage lists them.
+// Example output:
+//
+//	`
+//	All options specific to device `brother5:bus2;dev1':
+//	  Mode:
+//	    --mode 24bit Color[Fast]|Black & White|True Gray [24bit Color[Fast]]
+//	        Select the scan mode
+//	    --brightness -50..50% (in steps of 1) [inactive]
+//	        Controls the brightness of the acquired image.
+//	  Geometry:
+//	    -l 0..215.9mm (in steps of 0.0999908) [0]
+//	        Top-left x position of scan area.
+//	`
+func parseDeviceOptions(out []string) []DeviceOption {
+	results := []DeviceOption{}
+	group := ""
+	// whether the previous line was an option, so that its description can
+	// follow
+	inOption := false
+
+	for _, line := range out {
+		line = strings.TrimRight(line, " \t\r")
+		trimmed := strings.TrimSpace(line)
+		indent := indentation(line)
+
+		switch {
+		case trimmed == "":
+			continue
+		case strings.HasPrefix(trimmed, "-"):
+			opt, ok := parseDeviceOptionLine(trimmed)
+			if !ok {
+				inOption = false
+				continue
+			}
+			opt.Group = group
+			results = append(results, opt)
+			inOption = true
+		case indent == 0:
+			// such as "All options specific to device..."
+			inOption = false
+		case strings.HasSuffix(trimmed, ":") && indent <= 2:
+			group = strings.TrimSuffix(trimmed, ":")
+			inOption = false
+		case inOption:
+			opt := &results[len(results)-1]
+			opt.Description = strings.TrimSpace(opt.Description + " " + trimmed)
+		}
+	}
+
+	return results
+}
+
+// getDeviceOption returns the option with the name, if the device has it.
+func getDeviceOption(opts []DeviceOption, name string) (DeviceOption, bool) {
+	for _, opt := range opts {
+		if opt.Name == name {
+			return opt, true
+		}
+	}
+
+	return DeviceOption{}, false
+}
+
+// getSettingOrCurrent returns the setting for the option with the name,
+// falling back to the value that the device currently reports for it.
+func getSettingOrCurrent(opts []DeviceOption, settings map[string]string, name string) string {
+	v, ok := settings[name]
+	if ok {
+		return v
+	}
+
+	opt, _ := getDeviceOption(opts, name)
+
+	return opt.Current
+}
+
+// getScanResolution returns the resolution, in DPI, that the device scans at
+// with the settings, falling back to the device's current resolution. Returns
+// 0 if the resolution isn't known.
+func getScanResolution(opts []DeviceOption, settings map[string]string) float64 {
+	v := getSettingOrCurrent(opts, settings, "resolution")
+
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || f <= 0 {
+		return 0
+	}
+
+	return f
+}
+
+// getDeviceSettings returns the current value of each option that is shown by
+// the UI, which are the options that are neither inactive nor advanced.
+func getDeviceSettings(opts []DeviceOption) map[string]string {
+	settings := make(map[string]string)
+
+	for _, opt := range opts {
+		if opt.Inactive() || opt.Advanced() {
+			continue
+		}
+
+		settings[opt.Name] = opt.Current
+	}
+
+	return settings
+}
+
+// reconcileDeviceSettings returns the settings to use when restoring saved
+// settings, such as a profile's, to a device with the options opts: the
+// current value of each option, overridden by the saved settings. Settings
+// that the device doesn't have or doesn't accept, such as after a driver
+// update, are left out and their names are returned.
+func reconcileDeviceSettings(opts []DeviceOption, saved map[string]string) (map[string]string, []string) {
+	settings := getDeviceSettings(opts)
+	skipped := []string{}
+
+	names := make([]string, 0, len(saved))
+	for name := range saved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		opt, ok := getDeviceOption(opts, name)
+		if !ok || opt.Validate(saved[name]) != nil {
+			skipped = append(skipped, name)
+			continue
+		}
+
+		settings[name] = saved[name]
+	}
+
+	return settings, skipped
+}
+
+// OptionGroup is a named group of options, such as "Geometry".
+type OptionGroup struct {
+	Name    string
+	Options []DeviceOption
+}
+
+// groupDeviceOptions groups the options by their option group. Groups and the
+// options within them stay in the order that the device lists them, so that
+// the UI is laid out the same way every time. Advanced and inactive options
+// are skipped unless showAdvanced is true.
+func groupDeviceOptions(opts []DeviceOption, showAdvanced bool) []OptionGroup {
+	groups := []OptionGroup{}
+	indexes := make(map[string]int)
+
+	for _, opt := range opts {
+		if !showAdvanced && (opt.Inactive() || opt.Advanced()) {
+			continue
+		}
+
+		i, ok := indexes[opt.Group]
+		if !ok {
+			i = len(groups)
+			indexes[opt.Group] = i
+			groups = append(groups, OptionGroup{Name: opt.Group})
+		}
+
+		groups[i].Options = append(groups[i].Options, opt)
+	}
+
+	return groups
+}
+
+// diffDeviceOptions compares the options before and after a change to the
+// settings, and returns the names of the options that became inactive and the
+// names of the options that became active.
+func diffDeviceOptions(before, after []DeviceOption) ([]string, []string) {
+	wasInactive := make(map[string]bool)
+	for _, opt := range before {
+		wasInactive[opt.Name] = opt.Inactive()
+	}
+
+	deactivated := []string{}
+	activated := []string{}
+	for _, opt := range after {
+		inactive, ok := wasInactive[opt.Name]
+		switch {
+		case (!ok || !inactive) && opt.Inactive():
+			deactivated = append(deactivated, opt.Name)
+		case (!ok || inactive) && !opt.Inactive():
+			activated = append(activated, opt.Name)
+		}
+	}
+
+	return deactivated, activated
+}
+
+// diffDeviceOptionNames compares the options that a device reported before,
+// such as when it was last used, with the options that it reports now, and
+// returns the names of the options that it no longer has and the names of the
+// options that are new.
+func diffDeviceOptionNames(before, after []DeviceOption) ([]string, []string) {
+	had := make(map[string]bool)
+	for _, opt := range before {
+		had[opt.Name] = true
+	}
+
+	has := make(map[string]bool)
+	added := []string{}
+	for _, opt := range after {
+		has[opt.Name] = true
+		if !had[opt.Name] {
+			added = append(added, opt.Name)
+		}
+	}
+
+	removed := []string{}
+	for _, opt := range before {
+		if !has[opt.Name] {
+			removed = append(removed, opt.Name)
+		}
+	}
+
+	return removed, added
+}
+
+// mergeDeviceOptionDefaults carries the default values of the options over
+// from before a change to the settings, since a device describes its options
+// with the settings applied and would otherwise report them as the defaults.
+func mergeDeviceOptionDefaults(before, after []DeviceOption) []DeviceOption {
+	defaults := make(map[string]string)
+	for _, opt := range before {
+		defaults[opt.Name] = opt.Default
+	}
+
+	merged := make([]DeviceOption, len(after))
+	for i, opt := range after {
+		if d, ok := defaults[opt.Name]; ok {
+			opt.Default = d
+		}
+		merged[i] = opt
+	}
+
+	return merged
+}
@@ -0,0 +1,726 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readOptionsFixture returns the lines of the `scanimage -A` output that was
+// captured from a device using the named sane backend.
+func readOptionsFixture(t *testing.T, backend string) []string {
+	t.Helper()
+
+	b, err := os.ReadFile(filepath.Join("testdata", "options", backend+".txt"))
+	if err != nil {
+		t.Fatalf("failed to read fixture for %v: %v", backend, err)
+	}
+
+	return strings.Split(string(b), "\n")
+}
+
+func TestParseDeviceOptions(t *testing.T) {
+	tests := []struct {
+		backend string
+		// The total number of options, including inactive and advanced ones
+		count int
+		// Only the options listed here are compared in full
+		expected []DeviceOption
+	}{
+		{
+			backend: "brother",
+			count:   9,
+			expected: []DeviceOption{
+				{
+					Name:        "mode",
+					Group:       "Mode",
+					Type:        OptionTypeString,
+					Kind:        ConstraintList,
+					Constraint:  "Black & White|Gray[Error Diffusion]|True Gray|24bit Color|24bit Color[Fast]",
+					Values:      []string{"Black & White", "Gray[Error Diffusion]", "True Gray", "24bit Color", "24bit Color[Fast]"},
+					Default:     "24bit Color",
+					Current:     "24bit Color",
+					Description: "Select the scan mode",
+					Flags:       []string{},
+				},
+				{
+					Name:        "brightness",
+					Group:       "Mode",
+					Type:        OptionTypeInt,
+					Unit:        "%",
+					Kind:        ConstraintRange,
+					Constraint:  "-50..50% (in steps of 1)",
+					Min:         -50,
+					Max:         50,
+					Step:        1,
+					Description: "Controls the brightness of the acquired image.",
+					Flags:       []string{FlagInactive},
+				},
+				{
+					Name:        "t",
+					Group:       "Geometry",
+					Type:        OptionTypeFixed,
+					Unit:        "mm",
+					Kind:        ConstraintRange,
+					Constraint:  "0..355.6mm (in steps of 0.0999908)",
+					Max:         355.6,
+					Step:        0.0999908,
+					Default:     "0",
+					Current:     "0",
+					Description: "Top-left y position of scan area.",
+					Flags:       []string{},
+				},
+			},
+		},
+		{
+			backend: "epson2",
+			count:   28,
+			expected: []DeviceOption{
+				{
+					Name:        "depth",
+					Group:       "Scan Mode",
+					Type:        OptionTypeInt,
+					Kind:        ConstraintList,
+					Constraint:  "8|16",
+					Values:      []string{"8", "16"},
+					Description: `Number of bits per sample, typical values are 1 for "line-art" and 8 for multibit scans.`,
+					Flags:       []string{FlagInactive},
+				},
+				{
+					Name:       "sharpness",
+					Group:      "Scan Mode",
+					Type:       OptionTypeInt,
+					Kind:       ConstraintRange,
+					Constraint: "-2..2",
+					Min:        -2,
+					Max:        2,
+					Flags:      []string{FlagInactive},
+				},
+				{
+					Name:        "resolution",
+					Group:       "Scan Mode",
+					Type:        OptionTypeInt,
+					Unit:        "dpi",
+					Kind:        ConstraintList,
+					Constraint:  "50|60|72|75|80|90|100|120|133|144|150|160|175|180|200|216|240|266|300|320|350|360|400|480|600|720|800|900|1200|1600|1800|2400|3200dpi",
+					Values:      []string{"50", "60", "72", "75", "80", "90", "100", "120", "133", "144", "150", "160", "175", "180", "200", "216", "240", "266", "300", "320", "350", "360", "400", "480", "600", "720", "800", "900", "1200", "1600", "1800", "2400", "3200"},
+					Default:     "50",
+					Current:     "50",
+					Description: "Sets the resolution of the scanned image.",
+					Flags:       []string{},
+				},
+				{
+					Name:        "wait-for-button",
+					Group:       "Advanced",
+					Type:        OptionTypeBool,
+					Kind:        ConstraintBool,
+					Values:      []string{"yes", "no"},
+					Default:     "no",
+					Current:     "no",
+					Description: "After sending the scan command, wait until the button on the scanner is pressed to actually start the scan process.",
+					Flags:       []string{FlagAdvanced},
+				},
+				{
+					Name:        "red-gamma-table",
+					Group:       "Advanced",
+					Type:        OptionTypeInt,
+					Kind:        ConstraintRange,
+					Constraint:  "0..255,...",
+					Max:         255,
+					Array:       true,
+					Description: "Gamma-correction table for the red band.",
+					Flags:       []string{FlagInactive},
+				},
+				{
+					Name:        "cct-profile",
+					Group:       "Color correction",
+					Type:        OptionTypeFixed,
+					Kind:        ConstraintString,
+					Constraint:  "<float>,...",
+					Array:       true,
+					Description: "Color correction profile data",
+					Flags:       []string{FlagAdvanced},
+				},
+				{
+					Name:        "eject",
+					Group:       "Optional equipment",
+					Type:        OptionTypeButton,
+					Kind:        ConstraintNone,
+					Description: "Eject the sheet in the ADF",
+					Flags:       []string{FlagInactive},
+				},
+			},
+		},
+		{
+			backend: "hpaio",
+			count:   13,
+			expected: []DeviceOption{
+				{
+					Name:        "source",
+					Group:       "Scan mode",
+					Type:        OptionTypeString,
+					Kind:        ConstraintList,
+					Constraint:  "Flatbed|ADF|Duplex",
+					Values:      []string{"Flatbed", "ADF", "Duplex"},
+					Default:     "Flatbed",
+					Current:     "Flatbed",
+					Description: "Selects the scan source (such as a document-feeder).",
+					Flags:       []string{},
+				},
+				{
+					Name:        "contrast",
+					Group:       "Advanced",
+					Type:        OptionTypeInt,
+					Kind:        ConstraintRange,
+					Constraint:  "0..2000",
+					Max:         2000,
+					Default:     "1000",
+					Current:     "1000",
+					Description: "Controls the contrast of the acquired image.",
+					Flags:       []string{},
+				},
+				{
+					Name:        "sharpness",
+					Group:       "Advanced",
+					Type:        OptionTypeInt,
+					Kind:        ConstraintRange,
+					Constraint:  "auto|-100..100",
+					Min:         -100,
+					Max:         100,
+					Auto:        true,
+					Default:     "0",
+					Current:     "0",
+					Description: "Controls the sharpness of the acquired image.",
+					Flags:       []string{},
+				},
+				{
+					Name:        "auto-crop",
+					Group:       "Advanced",
+					Type:        OptionTypeBool,
+					Kind:        ConstraintBool,
+					Values:      []string{"yes", "no"},
+					Auto:        true,
+					Default:     "no",
+					Current:     "no",
+					Description: "Crops the scanned image to the edges of the page.",
+					Flags:       []string{},
+				},
+			},
+		},
+		{
+			backend: "genesys",
+			count:   21,
+			expected: []DeviceOption{
+				{
+					Name:        "scan",
+					Group:       "Buttons",
+					Type:        OptionTypeBool,
+					Kind:        ConstraintBool,
+					Values:      []string{"yes", "no"},
+					Default:     "no",
+					Current:     "no",
+					Description: "Scan button",
+					Flags:       []string{FlagHardware},
+				},
+				{
+					Name:        "calibrate",
+					Group:       "Buttons",
+					Type:        OptionTypeButton,
+					Kind:        ConstraintNone,
+					Description: "Start calibration using special sheet",
+					Flags:       []string{FlagAdvanced},
+				},
+			},
+		},
+		{
+			backend: "test",
+			count:   32,
+			expected: []DeviceOption{
+				{
+					Name:        "resolution",
+					Group:       "Scan Mode",
+					Type:        OptionTypeInt,
+					Unit:        "dpi",
+					Kind:        ConstraintRange,
+					Constraint:  "1..1200dpi (in steps of 1)",
+					Min:         1,
+					Max:         1200,
+					Step:        1,
+					Default:     "50",
+					Current:     "50",
+					Description: "Sets the resolution of the scanned image.",
+					Flags:       []string{},
+				},
+				{
+					Name:        "bool-soft-select-soft-detect-emulated",
+					Group:       "Bool test options",
+					Type:        OptionTypeBool,
+					Kind:        ConstraintBool,
+					Values:      []string{"yes", "no"},
+					Default:     "no",
+					Current:     "no",
+					Description: "(5/6) Bool test option that has soft select, soft detect, and emulated (and advanced) capabilities.",
+					Flags:       []string{FlagEmulated, FlagAdvanced},
+				},
+				{
+					Name:        "bool-hard-select",
+					Group:       "Bool test options",
+					Type:        OptionTypeBool,
+					Kind:        ConstraintBool,
+					Values:      []string{"yes", "no"},
+					Description: "(3/6) Bool test option that has hard select capabilities. That means the option can't be set by the frontend but by the user (e.g. by pressing a button at the device) and can't be read by the frontend.",
+					Flags:       []string{FlagHardware},
+				},
+				{
+					Name:        "int-constraint-word-list",
+					Group:       "Int test options",
+					Type:        OptionTypeInt,
+					Unit:        "bit",
+					Kind:        ConstraintList,
+					Constraint:  "-42|-8|0|17|42|256|65536|16777216|1073741824bit",
+					Values:      []string{"-42", "-8", "0", "17", "42", "256", "65536", "16777216", "1073741824"},
+					Default:     "42",
+					Current:     "42",
+					Description: "(3/6) Int test option with unit bits and constraint word list set.",
+					Flags:       []string{},
+				},
+				{
+					Name:        "int-constraint-array-constraint-range",
+					Group:       "Int test options",
+					Type:        OptionTypeInt,
+					Unit:        "dpi",
+					Kind:        ConstraintRange,
+					Constraint:  "4..192dpi,... (in steps of 2)",
+					Min:         4,
+					Max:         192,
+					Step:        2,
+					Array:       true,
+					Description: "(5/6) Int test option with unit dpi and using an array with a range constraint. Minimum is 4, maximum 192, and quant is 2.",
+					Flags:       []string{},
+				},
+				{
+					Name:        "fixed-constraint-range",
+					Group:       "Fixed test options",
+					Type:        OptionTypeFixed,
+					Unit:        "us",
+					Kind:        ConstraintRange,
+					Constraint:  "-42.17..32768us (in steps of 2)",
+					Min:         -42.17,
+					Max:         32768,
+					Step:        2,
+					Default:     "-42.17",
+					Current:     "-42.17",
+					Description: "(2/3) Fixed test option with unit microsecond and constraint range set. Minimum is -42.17, maximum 32767.9999, and quant is 2.0.",
+					Flags:       []string{},
+				},
+				{
+					Name:        "string",
+					Group:       "String test options",
+					Type:        OptionTypeString,
+					Kind:        ConstraintString,
+					Constraint:  "<string>",
+					Default:     "This is the contents of a string option. Fill it with any text.",
+					Current:     "This is the contents of a string option. Fill it with any text.",
+					Description: "(1/3) String test option without constraint.",
+					Flags:       []string{},
+				},
+				{
+					Name:        "button",
+					Group:       "Button test options",
+					Type:        OptionTypeButton,
+					Kind:        ConstraintNone,
+					Description: "(1/1) Button test option. Prints some text...",
+					Flags:       []string{},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got := parseDeviceOptions(readOptionsFixture(t, test.backend))
+		if len(got) != test.count {
+			t.Errorf("%v: option count mismatch: got %v, wanted %v", test.backend, len(got), test.count)
+		}
+
+		for _, want := range test.expected {
+			found := false
+			for _, opt := range got {
+				if opt.Name != want.Name {
+					continue
+				}
+
+				found = true
+				if !reflect.DeepEqual(opt, want) {
+					t.Errorf("%v: option mismatch:\ngot    %+v\nwanted %+v", test.backend, opt, want)
+				}
+			}
+
+			if !found {
+				t.Errorf("%v: option %v was not parsed", test.backend, want.Name)
+			}
+		}
+	}
+}
+
+func TestParseDeviceOptionsOrder(t *testing.T) {
+	expected := []string{"mode", "resolution", "source", "brightness", "contrast", "l", "t", "x", "y"}
+
+	got := parseDeviceOptions(readOptionsFixture(t, "brother"))
+	if len(got) != len(expected) {
+		t.Fatalf("option count mismatch: got %v, wanted %v", len(got), len(expected))
+	}
+
+	for i := range got {
+		if got[i].Name != expected[i] {
+			t.Errorf("option order mismatch at %v: got %v, wanted %v", i, got[i].Name, expected[i])
+		}
+	}
+}
+
+func TestSplitTrailingBrackets(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedRest   string
+		expectedGroups []string
+	}{
+		{
+			input:          "Color[Fast]|Gray [24bit Color[Fast]] [advanced]",
+			expectedRest:   "Color[Fast]|Gray",
+			expectedGroups: []string{"24bit Color[Fast]", "advanced"},
+		},
+		{
+			input:          "Color|Gray[Error Diffusion] [inactive]",
+			expectedRest:   "Color|Gray[Error Diffusion]",
+			expectedGroups: []string{"inactive"},
+		},
+		{
+			input:          "Color|Gray[Error Diffusion]",
+			expectedRest:   "Color|Gray[Error Diffusion]",
+			expectedGroups: []string{},
+		},
+		{
+			input:          "[no] [hardware]",
+			expectedRest:   "",
+			expectedGroups: []string{"no", "hardware"},
+		},
+	}
+
+	for _, test := range tests {
+		gotRest, gotGroups := splitTrailingBrackets(test.input)
+		if gotRest != test.expectedRest {
+			t.Errorf("%q: rest mismatch: got %q, wanted %q", test.input, gotRest, test.expectedRest)
+		}
+
+		if !reflect.DeepEqual(gotGroups, test.expectedGroups) {
+			t.Errorf("%q: groups mismatch: got %q, wanted %q", test.input, gotGroups, test.expectedGroups)
+		}
+	}
+}
+
+func TestGetDeviceSettings(t *testing.T) {
+	tests := []struct {
+		input []string
+		// Expected default value map
+		expectedd map[string]string
+	}{
+		{
+			input: []string{
+				"    --mode 24bit Color[Fast]|Black & White|True Gray|Gray[Error Diffusion] [24bit Color[Fast]]",
+				"    --resolution 100|150|200|300|400|600|1200dpi [100]",
+				"    --source Automatic Document Feeder(left aligned) [Automatic Document Feeder(left aligned)]",
+				"    --brightness -50..50% (in steps of 1) [inactive]",
+				"    --calibration-cache[=(yes|no)] [no] [advanced]",
+			},
+			expectedd: map[string]string{
+				"mode":       "24bit Color[Fast]",
+				"resolution": "100",
+				"source":     "Automatic Document Feeder(left aligned)",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		gotd := getDeviceSettings(parseDeviceOptions(test.input))
+
+		if len(gotd) != len(test.expectedd) {
+			t.Errorf("setting count mismatch: got %v, wanted %v", gotd, test.expectedd)
+		}
+
+		for k, v := range gotd {
+			if v != test.expectedd[k] {
+				t.Errorf("expected default values had a mismatch: got %v, wanted %v", v, test.expectedd[k])
+			}
+		}
+	}
+}
+
+func TestDeviceOptionValidate(t *testing.T) {
+	opts := parseDeviceOptions(readOptionsFixture(t, "test"))
+	byName := map[string]DeviceOption{}
+	for _, opt := range opts {
+		byName[opt.Name] = opt
+	}
+
+	tests := []struct {
+		option  string
+		value   string
+		wantErr bool
+	}{
+		{option: "mode", value: "Color"},
+		{option: "mode", value: "Lineart", wantErr: true},
+		{option: "mode", value: ""},
+		{option: "hand-scanner", value: "yes"},
+		{option: "hand-scanner", value: "true", wantErr: true},
+		{option: "resolution", value: "300"},
+		{option: "resolution", value: "0", wantErr: true},
+		{option: "resolution", value: "1201", wantErr: true},
+		{option: "resolution", value: "300.5", wantErr: true},
+		{option: "int-constraint-range", value: "6"},
+		{option: "int-constraint-range", value: "7", wantErr: true},
+		{option: "fixed-constraint-range", value: "-40.17"},
+		{option: "fixed-constraint-range", value: "-41", wantErr: true},
+		{option: "int", value: "-3"},
+		{option: "int", value: "three", wantErr: true},
+		{option: "fixed", value: "1.5"},
+		{option: "string", value: "anything at all"},
+		{option: "bool-soft-detect", value: "yes", wantErr: true},
+		{option: "button", value: "yes", wantErr: true},
+		{option: "sharpness", value: "auto"},
+		{option: "sharpness", value: "-100"},
+		{option: "sharpness", value: "101", wantErr: true},
+		{option: "auto-crop", value: "auto"},
+		{option: "mode", value: "auto", wantErr: true},
+	}
+
+	for _, opt := range parseDeviceOptions(readOptionsFixture(t, "hpaio")) {
+		if opt.Auto {
+			byName[opt.Name] = opt
+		}
+	}
+
+	for _, test := range tests {
+		opt, ok := byName[test.option]
+		if !ok {
+			t.Fatalf("option %v is missing from the fixture", test.option)
+		}
+
+		err := opt.Validate(test.value)
+		if test.wantErr && err == nil {
+			t.Errorf("%v=%q: expected an error but got nil", test.option, test.value)
+		}
+		if !test.wantErr && err != nil {
+			t.Errorf("%v=%q: unexpected error: %v", test.option, test.value, err)
+		}
+	}
+}
+
+func TestParseConstraintType(t *testing.T) {
+	tests := map[string]OptionType{
+		"0..255":                     OptionTypeInt,
+		"0..218mm":                   OptionTypeFixed,
+		"0..215.9mm":                 OptionTypeFixed,
+		"0..200mm (in steps of 1)":   OptionTypeInt,
+		"0..218mm (in steps of 0.1)": OptionTypeFixed,
+		"-50..50% (in steps of 1)":   OptionTypeInt,
+		"-100..100%":                 OptionTypeFixed,
+		"50..1200dpi":                OptionTypeInt,
+		"auto|0..218mm":              OptionTypeFixed,
+		"75|150|300dpi":              OptionTypeInt,
+		"0.5|1|2":                    OptionTypeFixed,
+	}
+
+	for constraint, expected := range tests {
+		opt := DeviceOption{Name: "l", Constraint: constraint}
+		parseConstraint(&opt)
+		if opt.Type != expected {
+			t.Errorf("%v: got %v, wanted %v", constraint, opt.Type, expected)
+		}
+	}
+
+	// the values between whole numbered bounds aren't only whole numbers
+	opt := DeviceOption{Name: "l", Constraint: "0..218mm"}
+	parseConstraint(&opt)
+	if err := opt.Validate("10.5"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestFormatOptionNumber(t *testing.T) {
+	tests := []struct {
+		input    float64
+		t        OptionType
+		expected string
+	}{
+		{input: 300, t: OptionTypeInt, expected: "300"},
+		{input: 299.6, t: OptionTypeInt, expected: "300"},
+		{input: 215.9, t: OptionTypeFixed, expected: "215.9"},
+		{input: 10, t: OptionTypeFixed, expected: "10"},
+	}
+
+	for _, test := range tests {
+		got := formatOptionNumber(test.input, test.t)
+		if got != test.expected {
+			t.Errorf("%v (%v): got %v, wanted %v", test.input, test.t, got, test.expected)
+		}
+	}
+}
+
+func TestGroupDeviceOptions(t *testing.T) {
+	opts := parseDeviceOptions(readOptionsFixture(t, "epson2"))
+
+	tests := []struct {
+		showAdvanced bool
+		// Expected group names, followed by the option names in each group
+		expected map[string][]string
+		order    []string
+	}{
+		{
+			showAdvanced: false,
+			order:        []string{"Scan Mode", "Advanced", "Preview", "Geometry", "Optional equipment"},
+			expected: map[string][]string{
+				"Scan Mode":          {"mode", "halftoning", "gamma-correction", "resolution", "threshold"},
+				"Advanced":           {"mirror", "auto-area-segmentation"},
+				"Preview":            {"preview"},
+				"Geometry":           {"l", "t", "x", "y"},
+				"Optional equipment": {"source"},
+			},
+		},
+		{
+			showAdvanced: true,
+			order:        []string{"Scan Mode", "Advanced", "Color correction", "Preview", "Geometry", "Optional equipment"},
+			expected: map[string][]string{
+				"Scan Mode":          {"mode", "depth", "halftoning", "dropout", "brightness", "sharpness", "gamma-correction", "color-correction", "resolution", "threshold"},
+				"Advanced":           {"mirror", "auto-area-segmentation", "red-gamma-table", "wait-for-button"},
+				"Color correction":   {"cct-type", "cct-profile"},
+				"Preview":            {"preview"},
+				"Geometry":           {"l", "t", "x", "y"},
+				"Optional equipment": {"source", "auto-eject", "film-type", "focus-position", "bay", "eject", "adf-mode"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got := groupDeviceOptions(opts, test.showAdvanced)
+		if len(got) != len(test.order) {
+			t.Errorf("advanced=%v: group count mismatch: got %v, wanted %v", test.showAdvanced, len(got), len(test.order))
+			continue
+		}
+
+		for i, group := range got {
+			if group.Name != test.order[i] {
+				t.Errorf("advanced=%v: group order mismatch: got %v, wanted %v", test.showAdvanced, group.Name, test.order[i])
+			}
+
+			names := []string{}
+			for _, opt := range group.Options {
+				names = append(names, opt.Name)
+			}
+
+			if !reflect.DeepEqual(names, test.expected[group.Name]) {
+				t.Errorf("advanced=%v: options mismatch for group %v: got %v, wanted %v", test.showAdvanced, group.Name, names, test.expected[group.Name])
+			}
+		}
+	}
+}
+
+func TestDiffDeviceOptions(t *testing.T) {
+	before := parseDeviceOptions([]string{
+		"    --source Flatbed|ADF [Flatbed]",
+		"    --duplex[=(yes|no)] [inactive]",
+		"    --page-height 0..355.6mm [inactive]",
+		"    --resolution 75|100|200|300|600|1200dpi [75]",
+		"    --lamp-off[=(yes|no)] [no]",
+	})
+	after := parseDeviceOptions([]string{
+		"    --source Flatbed|ADF [ADF]",
+		"    --duplex[=(yes|no)] [no]",
+		"    --page-height 0..355.6mm [296.9]",
+		"    --resolution 75|100|200|300dpi [75]",
+		"    --lamp-off[=(yes|no)] [inactive]",
+		"    --feeder-warning[=(yes|no)] [no]",
+	})
+
+	deactivated, activated := diffDeviceOptions(before, after)
+
+	if !reflect.DeepEqual(deactivated, []string{"lamp-off"}) {
+		t.Errorf("deactivated mismatch: got %v", deactivated)
+	}
+
+	if !reflect.DeepEqual(activated, []string{"duplex", "page-height", "feeder-warning"}) {
+		t.Errorf("activated mismatch: got %v", activated)
+	}
+
+	merged := mergeDeviceOptionDefaults(before, after)
+	if merged[0].Default != "Flatbed" || merged[0].Current != "ADF" {
+		t.Errorf("source default/current mismatch: got %v/%v, wanted Flatbed/ADF", merged[0].Default, merged[0].Current)
+	}
+
+	if merged[5].Default != "no" {
+		t.Errorf("new option default mismatch: got %v, wanted no", merged[5].Default)
+	}
+}
+
+func TestGetScanResolution(t *testing.T) {
+	opts := parseDeviceOptions(readOptionsFixture(t, "brother"))
+
+	tests := []struct {
+		opts     []DeviceOption
+		settings map[string]string
+		expected float64
+	}{
+		{opts: opts, settings: nil, expected: 200},
+		{opts: opts, settings: map[string]string{"resolution": "300"}, expected: 300},
+		{opts: nil, settings: map[string]string{"resolution": "150.5"}, expected: 150.5},
+		{opts: nil, settings: nil, expected: 0},
+		{opts: nil, settings: map[string]string{"resolution": "auto"}, expected: 0},
+	}
+
+	for _, test := range tests {
+		got := getScanResolution(test.opts, test.settings)
+		if got != test.expected {
+			t.Errorf("%v: got %v, wanted %v", test.settings, got, test.expected)
+		}
+	}
+}
+
+func TestReconcileDeviceSettings(t *testing.T) {
+	opts := []DeviceOption{
+		{Name: "mode", Kind: ConstraintList, Values: []string{"Color", "True Gray"}, Current: "Color"},
+		{Name: "resolution", Kind: ConstraintList, Values: []string{"100", "200", "300"}, Current: "300"},
+		{Name: "source", Kind: ConstraintList, Values: []string{"Flatbed", "ADF"}, Current: "Flatbed"},
+	}
+
+	settings, skipped := reconcileDeviceSettings(opts, map[string]string{
+		"mode":       "True Gray",
+		"resolution": "1200",
+		"brightness": "10",
+	})
+
+	expected := map[string]string{"mode": "True Gray", "resolution": "300", "source": "Flatbed"}
+	for name, v := range expected {
+		if settings[name] != v {
+			t.Errorf("%v: got %q, wanted %q", name, settings[name], v)
+		}
+	}
+	if len(settings) != len(expected) {
+		t.Errorf("unexpected settings: %v", settings)
+	}
+	if strings.Join(skipped, ",") != "brightness,resolution" {
+		t.Errorf("skipped: got %v", skipped)
+	}
+}
+
+func TestDiffDeviceOptionNames(t *testing.T) {
+	before := []DeviceOption{{Name: "mode"}, {Name: "resolution"}, {Name: "lamp-off-time"}}
+	after := []DeviceOption{{Name: "mode"}, {Name: "source"}, {Name: "resolution"}, {Name: "page-width"}}
+
+	removed, added := diffDeviceOptionNames(before, after)
+	if strings.Join(removed, ",") != "lamp-off-time" {
+		t.Errorf("removed: got %v", removed)
+	}
+	if strings.Join(added, ",") != "source,page-width" {
+		t.Errorf("added: got %v", added)
+	}
+}
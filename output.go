@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The suffix of scans that failed part way through, which are kept next to
+// where the scan would have been written so that what was scanned isn't lost.
+// It keeps them out of the gallery, since they aren't scan files.
+const PARTIAL_SUFFIX = ".partial"
+
+// scanFileSignatures are the bytes that each of the formats that scanimage
+// writes starts with.
+var scanFileSignatures = map[string][]string{
+	"png":  {"\x89PNG\r\n\x1a\n"},
+	"jpeg": {"\xff\xd8\xff"},
+	"pdf":  {"%PDF-"},
+}
+
+// scanFileTrailers are the bytes that complete files of each format end with,
+// which catches files that were cut short. Formats that don't have a fixed
+// ending aren't listed.
+var scanFileTrailers = map[string]string{
+	"png":  "IEND\xaeB`\x82",
+	"jpeg": "\xff\xd9",
+}
+
+// normalizeScanFormat returns the name of the format of scanimage's --format,
+// or of a file extension such as ".JPG", as it is used in scanFileSignatures.
+func normalizeScanFormat(format string) string {
+	format = strings.TrimPrefix(strings.ToLower(format), ".")
+	switch format {
+	case "jpg":
+		return "jpeg"
+	}
+
+	return format
+}
+
+// validateScanFile checks that the file at path is a complete file of the
+// format, such as "png": it must not be empty, it must start with the format's
+// signature, and images must have a header that can be decoded. Unknown
+// formats only need to be non-empty.
+func validateScanFile(path string, format string) error {
+	format = normalizeScanFormat(format)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %v: %w", path, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to check %v: %w", path, err)
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("the scanned file is empty")
+	}
+
+	signatures, ok := scanFileSignatures[format]
+	if !ok {
+		return nil
+	}
+
+	header := make([]byte, 8)
+	n, _ := io.ReadFull(f, header)
+	header = header[:n]
+
+	valid := false
+	for _, sig := range signatures {
+		if bytes.HasPrefix(header, []byte(sig)) {
+			valid = true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("the scanned file is not a valid %v file", format)
+	}
+
+	if format == "png" || format == "jpeg" {
+		_, err = f.Seek(0, io.SeekStart)
+		if err == nil {
+			_, _, err = image.DecodeConfig(f)
+		}
+		if err != nil {
+			return fmt.Errorf("the scanned file is not a valid %v file: %w", format, err)
+		}
+	}
+
+	if trailer, ok := scanFileTrailers[format]; ok {
+		end := make([]byte, len(trailer))
+		_, err = f.ReadAt(end, info.Size()-int64(len(trailer)))
+		if err != nil || string(end) != trailer {
+			return fmt.Errorf("the scanned %v file is incomplete", format)
+		}
+	}
+
+	return nil
+}
+
+// createTempNextTo creates an empty temporary file in the same directory as
+// filename, so that it can be renamed over filename once it's complete. Its
+// name is filename's with a leading dot and a random .tmp suffix, such as
+// ".config.yml.123456.tmp".
+func createTempNextTo(filename string) (*os.File, error) {
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a temporary file next to %v: %w", filename, err)
+	}
+
+	return f, nil
+}
+
+// createScanTemp creates the temporary file that a scan to filename is
+// streamed to. Since its name starts with a dot and doesn't end in a scan file
+// extension, it isn't mistaken for a scan.
+func createScanTemp(filename string) (*os.File, error) {
+	return createTempNextTo(filename)
+}
+
+// commitScanFile validates the complete scan at tmp, and then renames it to
+// filename, replacing any file that's already there. If it isn't valid, it is
+// handled like a partial scan and filename is left alone.
+func commitScanFile(tmp string, filename string, format string) error {
+	err := validateScanFile(tmp, format)
+	if err != nil {
+		partial := discardPartialScan(tmp, filename, true)
+		if partial != "" {
+			return fmt.Errorf("%w; the partial scan was kept at %v", err, partial)
+		}
+		return err
+	}
+
+	// temporary files are only readable by their owner
+	err = os.Chmod(tmp, 0o644)
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to move the scan to %v: %w", filename, err)
+	}
+
+	return nil
+}
+
+// discardPartialScan cleans up the file at path, which a scan to filename was
+// writing to when it failed. Empty files are deleted, as are all of them if
+// keep is false, such as for cancelled scans. Otherwise the file is kept as
+// filename with PARTIAL_SUFFIX (and a number, if that's taken), and its path
+// is returned.
+func discardPartialScan(path string, filename string, keep bool) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+
+	if !keep || info.Size() == 0 {
+		os.Remove(path)
+		return ""
+	}
+
+	partial := filename + PARTIAL_SUFFIX
+	for n := 1; fileExists(partial) && n <= MAX_COLLISION_SUFFIX; n++ {
+		partial = addPathSuffix(filename+PARTIAL_SUFFIX, n)
+	}
+
+	err = os.Rename(path, partial)
+	if err != nil {
+		os.Remove(path)
+		return ""
+	}
+
+	return partial
+}
+
+// writeFileAtomic writes b to filename by way of a temporary file, so that
+// filename is either left as it was or replaced with all of b, even if the
+// app is killed or the system crashes part way through.
+func writeFileAtomic(filename string, b []byte) error {
+	return writeFileAtomicPerm(filename, b, 0o644)
+}
+
+// writeFileAtomicPerm is writeFileAtomic for a file with the permissions perm.
+func writeFileAtomicPerm(filename string, b []byte, perm os.FileMode) error {
+	f, err := createTempNextTo(filename)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	err = errors.Join(err, f.Close())
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write %v: %w", filename, err)
+	}
+
+	// the rename only survives a crash once the directory is synced too,
+	// which not every system supports, so it's done on a best effort basis
+	dir, err := os.Open(filepath.Dir(filename))
+	if err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
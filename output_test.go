@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateScanFile(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "scanimage", "image.png"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		format  string
+		wantErr bool
+	}{
+		{name: "png", content: string(fixture), format: "png"},
+		{name: "png extension", content: string(fixture), format: ".PNG"},
+		{name: "empty", content: "", format: "png", wantErr: true},
+		{name: "truncated png", content: string(fixture[:40]), format: "png", wantErr: true},
+		{name: "signature only", content: "\x89PNG\r\n\x1a\n", format: "png", wantErr: true},
+		{name: "wrong format", content: string(fixture), format: "jpeg", wantErr: true},
+		{name: "garbage", content: "scanimage: not an image", format: "png", wantErr: true},
+		{name: "truncated jpeg", content: "\xff\xd8\xff\xe0\x00\x10JFIF", format: "jpg", wantErr: true},
+		{name: "pdf", content: "%PDF-1.4\n%%EOF\n", format: "pdf"},
+		{name: "not a pdf", content: "PDF-1.4", format: "pdf", wantErr: true},
+		{name: "unknown format", content: "P6\n1 1\n255\n\x00\x00\x00", format: "pnm"},
+	}
+
+	dir := t.TempDir()
+	for _, test := range tests {
+		path := filepath.Join(dir, "scan")
+		if err := os.WriteFile(path, []byte(test.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		err := validateScanFile(path, test.format)
+		if test.wantErr && err == nil {
+			t.Errorf("%v: expected an error but got nil", test.name)
+		}
+		if !test.wantErr && err != nil {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+		}
+	}
+}
+
+func TestDiscardPartialScan(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "scan.png")
+
+	write := func(name string, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	if got := discardPartialScan(write(".empty.tmp", ""), filename, true); got != "" || fileExists(filepath.Join(dir, ".empty.tmp")) {
+		t.Errorf("empty: expected it to be deleted, got %q", got)
+	}
+	if got := discardPartialScan(write(".cancelled.tmp", "x"), filename, false); got != "" || fileExists(filepath.Join(dir, ".cancelled.tmp")) {
+		t.Errorf("cancelled: expected it to be deleted, got %q", got)
+	}
+	if got := discardPartialScan(write(".first.tmp", "x"), filename, true); got != filename+PARTIAL_SUFFIX {
+		t.Errorf("first: got %q", got)
+	}
+	if got := discardPartialScan(write(".second.tmp", "y"), filename, true); got != filepath.Join(dir, "scan.png-1.partial") {
+		t.Errorf("second: got %q", got)
+	}
+	if fileExists(filename) {
+		t.Errorf("a partial scan was kept as the scan itself")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "doc.pdf")
+	if err := os.WriteFile(filename, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := writeFileAtomic(filename, []byte("new"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil || string(b) != "new" {
+		t.Errorf("got %q, %v", b, err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("temporary files were left behind: %v", entries)
+	}
+
+	err = writeFileAtomic(filepath.Join(dir, "missing", "doc.pdf"), []byte("new"))
+	if err == nil || strings.Contains(err.Error(), "scan") {
+		t.Errorf("missing directory: unexpected error %v", err)
+	}
+
+	f, err := createTempNextTo(filepath.Join(dir, "config.yml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.Close()
+	if name := filepath.Base(f.Name()); !strings.HasPrefix(name, ".config.yml.") || !strings.HasSuffix(name, ".tmp") || filepath.Dir(f.Name()) != dir {
+		t.Errorf("unexpected temporary file %v", f.Name())
+	}
+}
+
+func TestScanImagePartial(t *testing.T) {
+	tests := []struct {
+		mode    string
+		partial bool
+	}{
+		// the image is cut short, like when the paper jams
+		{mode: "partial", partial: true},
+		// scanimage succeeds, but what it wrote isn't an image
+		{mode: "garbage", partial: true},
+		// nothing is written at all
+		{mode: "fail"},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		filename := filepath.Join(dir, "scan.png")
+		if err := os.WriteFile(filename, []byte("earlier scan"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := ScanImage(context.Background(), fakeScanimage(t, test.mode), filename, nil, "png", "brother5:bus2;dev1", nil)
+		if err == nil {
+			t.Errorf("mode %q: expected an error but got nil", test.mode)
+			continue
+		}
+
+		b, rerr := os.ReadFile(filename)
+		if rerr != nil || string(b) != "earlier scan" {
+			t.Errorf("mode %q: the existing file was replaced: %q, %v", test.mode, b, rerr)
+		}
+
+		entries, _ := os.ReadDir(dir)
+		names := []string{}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+
+		expected := []string{"scan.png"}
+		if test.partial {
+			expected = append(expected, "scan.png.partial")
+			if !strings.Contains(err.Error(), filename+PARTIAL_SUFFIX) {
+				t.Errorf("mode %q: the error doesn't say where the partial scan is: %v", test.mode, err)
+			}
+		}
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Errorf("mode %q: got files %v, wanted %v", test.mode, names, expected)
+		}
+	}
+}
+
+func TestScanBatchPartial(t *testing.T) {
+	useFakeBackend(t, "partial")
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "doc.pdf")
+	pages, doc, _, err := scanBatchDocument(context.Background(), filename, "", nil, "brother5:bus2;dev1", pdfLayout{}, false, nil, nil)
+	if err == nil {
+		t.Fatalf("expected an error but got nil")
+	}
+
+	if len(pages) != 1 || doc != "" {
+		t.Errorf("got pages %v and document %q, wanted only the first page", pages, doc)
+	}
+	if fileExists(filepath.Join(dir, "doc-page2.png")) {
+		t.Errorf("the partial page was left as a page")
+	}
+	if !fileExists(filepath.Join(dir, "doc-page2.png"+PARTIAL_SUFFIX)) {
+		t.Errorf("the partial page was not kept")
+	}
+}
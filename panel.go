@@ -0,0 +1,446 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pwiecz/go-fltk"
+)
+
+// The height, in pixels, of each row in the options panel.
+const OPTION_ROW_HEIGHT = 25
+
+// The width, in pixels, of the check that leaves an option to the device.
+const OPTION_AUTO_WIDTH = 55
+
+// Incremented each time the device options need to be refreshed, so that a
+// slow refresh doesn't overwrite the results of a newer one.
+var refreshGeneration atomic.Int64
+
+// menuLabel escapes the characters that FLTK menus would otherwise interpret,
+// such as "/" for submenus and "&" for shortcuts.
+func menuLabel(s string) string {
+	s = strings.ReplaceAll(s, "&", "&&")
+	return strings.ReplaceAll(s, "/", "\\/")
+}
+
+// labelText escapes the "@" that FLTK labels would otherwise interpret as the
+// start of a symbol, such as in file names.
+func labelText(s string) string {
+	return strings.ReplaceAll(s, "@", "@@")
+}
+
+// indexOf returns the index of v in values, or 0 if it isn't present.
+func indexOf(values []string, v string) int {
+	for i := range values {
+		if values[i] == v {
+			return i
+		}
+	}
+
+	return 0
+}
+
+// optionEditor is implemented by each of the widgets that edit option values.
+type optionEditor interface {
+	Activate()
+	Deactivate()
+	SetTooltip(string)
+}
+
+// getDeviceSetting returns the value that the user chose for the option, or
+// the value that the device reported if the user hasn't chosen one.
+func getDeviceSetting(opt DeviceOption) string {
+	v, ok := appConf.DeviceSettings[opt.Name]
+	if !ok {
+		return opt.Current
+	}
+
+	return v
+}
+
+// setDeviceSetting validates the value and stores it in the device settings.
+// If the value is rejected, the user is told why and false is returned.
+func setDeviceSetting(opt DeviceOption, value string) bool {
+	err := opt.Validate(value)
+	if err != nil {
+		fltk.MessageBox("Error", fmt.Sprintf("Unable to set %v: %v", opt.Name, err.Error()))
+		return false
+	}
+
+	if appConf.DeviceSettings == nil {
+		appConf.DeviceSettings = make(map[string]string)
+	}
+
+	Logf("setting option %v to %v", opt.Name, value)
+	appConf.DeviceSettings[opt.Name] = value
+
+	requestConfigSave()
+	requestDeviceOptionsRefresh()
+	updateFilenamePreview()
+
+	return true
+}
+
+// setDeviceSettings validates and stores several settings at once, such as the
+// geometry of a region, and shows them in the options panel. If any of the
+// values is rejected, the user is told why, none of them are stored and false
+// is returned.
+func setDeviceSettings(values map[string]string) bool {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		opt, ok := getDeviceOption(appConf.DeviceOptions, name)
+		if !ok {
+			fltk.MessageBox("Error", fmt.Sprintf("Unable to set %v: the device doesn't have this option", name))
+			return false
+		}
+
+		err := opt.Validate(values[name])
+		if err != nil {
+			fltk.MessageBox("Error", fmt.Sprintf("Unable to set %v: %v", name, err.Error()))
+			return false
+		}
+	}
+
+	if appConf.DeviceSettings == nil {
+		appConf.DeviceSettings = make(map[string]string)
+	}
+
+	for _, name := range names {
+		Logf("setting option %v to %v", name, values[name])
+		appConf.DeviceSettings[name] = values[name]
+	}
+
+	requestConfigSave()
+	rebuildOptionsPanel()
+	requestDeviceOptionsRefresh()
+
+	return true
+}
+
+// rememberDeviceSettings stores the options and settings of the current
+// device in appConf.Devices, so that they can be restored once the device is
+// chosen again.
+func rememberDeviceSettings() {
+	if appConf.Device == "" {
+		return
+	}
+
+	if appConf.Devices == nil {
+		appConf.Devices = make(map[string]deviceState)
+	}
+
+	appConf.Devices[appConf.Device] = deviceState{
+		Options:  appConf.DeviceOptions,
+		Settings: maps.Clone(appConf.DeviceSettings),
+	}
+}
+
+// selectDevice makes dev the current device. The settings that were last used
+// with it are restored, except for the ones that it no longer accepts, and
+// any changes to its options since then are logged. Devices that weren't used
+// before start out with their defaults.
+func selectDevice(dev string) error {
+	opts, err := backend.DescribeOptions(dev, nil)
+	if err != nil {
+		return err
+	}
+
+	rememberDeviceSettings()
+
+	settings := getDeviceSettings(opts)
+	saved, ok := appConf.Devices[dev]
+	if ok {
+		removed, added := diffDeviceOptionNames(saved.Options, opts)
+		if len(removed) > 0 {
+			Warnf("%v no longer has the options: %v", dev, strings.Join(removed, ", "))
+		}
+		if len(added) > 0 {
+			Logf("%v has new options: %v", dev, strings.Join(added, ", "))
+		}
+
+		var skipped []string
+		settings, skipped = reconcileDeviceSettings(opts, saved.Settings)
+		if len(skipped) > 0 {
+			Warnf("skipped the remembered settings that %v no longer accepts: %v", dev, strings.Join(skipped, ", "))
+		}
+
+		Logf("restored the settings that were last used with %v", dev)
+	}
+
+	appConf.Device = dev
+	appConf.DeviceOptions = opts
+	appConf.DeviceSettings = settings
+
+	return nil
+}
+
+// requestDeviceOptionsRefresh refreshes the device options in the background
+// after the settings changed, superseding any refresh that is still running.
+func requestDeviceOptionsRefresh() {
+	gen := refreshGeneration.Add(1)
+	go refreshDeviceOptions(gen, appConf.Device, maps.Clone(appConf.DeviceSettings))
+}
+
+// refreshDeviceOptions re-runs option discovery with the settings applied,
+// since changing options such as mode or source often activates or deactivates
+// other options, and updates the options panel accordingly. gen is the value of
+// refreshGeneration when the refresh was requested. It runs in its own
+// goroutine, so the results are handed over to the UI thread.
+func refreshDeviceOptions(gen int64, dev string, settings map[string]string) {
+	opts, err := backend.DescribeOptions(dev, settings)
+	if err != nil {
+		Errorf("failed to refresh the device options: %v", err.Error())
+		return
+	}
+
+	// the device options and settings belong to the UI thread
+	onUI(func() {
+		if gen != refreshGeneration.Load() || dev != appConf.Device {
+			// the settings or the device changed while the options were being
+			// retrieved, so these results are already outdated
+			return
+		}
+
+		deactivated, activated := diffDeviceOptions(appConf.DeviceOptions, opts)
+		if len(deactivated) > 0 {
+			Logf("options that became inactive: %v", strings.Join(deactivated, ", "))
+		}
+		if len(activated) > 0 {
+			Logf("options that became active: %v", strings.Join(activated, ", "))
+		}
+
+		appConf.DeviceOptions = mergeDeviceOptionDefaults(appConf.DeviceOptions, opts)
+
+		// the constraints may have changed too, such as the available
+		// resolutions for a different source
+		for _, opt := range appConf.DeviceOptions {
+			v, ok := appConf.DeviceSettings[opt.Name]
+			if !ok || opt.Inactive() || !opt.Settable() {
+				continue
+			}
+
+			err := opt.Validate(v)
+			if err != nil {
+				Warnf("removing setting %v=%v, since it is no longer accepted: %v", opt.Name, v, err.Error())
+				delete(appConf.DeviceSettings, opt.Name)
+			}
+		}
+
+		requestConfigSave()
+		rebuildOptionsPanel()
+	})
+}
+
+// newOptionEditor creates the widget that fits the constraint of the option,
+// such as a spinner for ranges or a checkbox for booleans, and populates it
+// with the option's current setting. The widget is added to the current group.
+func newOptionEditor(opt DeviceOption) optionEditor {
+	value := getDeviceSetting(opt)
+
+	var editor optionEditor
+	switch opt.Kind {
+	case ConstraintRange:
+		step := opt.Step
+		if step == 0 {
+			step = 1
+		}
+
+		// options that the device can choose for itself get a check next
+		// to the spinner for leaving them to the device
+		var row *fltk.Flex
+		var auto *fltk.CheckButton
+		if opt.Auto {
+			row = fltk.NewFlex(0, 0, 0, 0)
+			row.SetType(fltk.ROW)
+			row.SetGap(4)
+
+			auto = fltk.NewCheckButton(0, 0, 0, 0, "auto")
+			auto.SetValue(value == "auto")
+			row.Fixed(auto, OPTION_AUTO_WIDTH)
+		}
+
+		spinner := fltk.NewSpinner(0, 0, 0, 0)
+		if opt.Type == OptionTypeInt {
+			spinner.SetType(fltk.SPINNER_INT_INPUT)
+		} else {
+			spinner.SetType(fltk.SPINNER_FLOAT_INPUT)
+		}
+		spinner.SetMinimum(opt.Min)
+		spinner.SetMaximum(opt.Max)
+		spinner.SetStep(step)
+
+		f, err := opt.parseNumber(value)
+		if err != nil {
+			f = opt.Min
+		}
+		spinner.SetValue(f)
+
+		spinner.SetCallback(func() {
+			if !setDeviceSetting(opt, formatOptionNumber(spinner.Value(), opt.Type)) {
+				f, err := opt.parseNumber(getDeviceSetting(opt))
+				if err != nil {
+					f = opt.Min
+				}
+				spinner.SetValue(f)
+			}
+		})
+		editor = spinner
+
+		if opt.Auto {
+			if auto.Value() {
+				spinner.Deactivate()
+			}
+
+			auto.SetCallback(func() {
+				v := "auto"
+				if !auto.Value() {
+					v = formatOptionNumber(spinner.Value(), opt.Type)
+				}
+				if !setDeviceSetting(opt, v) {
+					auto.SetValue(getDeviceSetting(opt) == "auto")
+				}
+
+				if auto.Value() {
+					spinner.Deactivate()
+				} else {
+					spinner.Activate()
+				}
+			})
+
+			row.End()
+			editor = row
+		}
+	case ConstraintBool:
+		check := fltk.NewCheckButton(0, 0, 0, 0)
+		check.SetValue(value == "yes")
+		check.SetCallback(func() {
+			v := "no"
+			if check.Value() {
+				v = "yes"
+			}
+			setDeviceSetting(opt, v)
+		})
+		editor = check
+	case ConstraintString:
+		input := fltk.NewInput(0, 0, 0, 0)
+		input.SetValue(value)
+		input.SetCallback(func() {
+			if !setDeviceSetting(opt, input.Value()) {
+				input.SetValue(getDeviceSetting(opt))
+			}
+		})
+		editor = input
+	case ConstraintList:
+		choice := fltk.NewChoice(0, 0, 0, 0)
+		for _, v := range opt.Values {
+			choice.Add(menuLabel(v), func() {
+				if !setDeviceSetting(opt, v) {
+					choice.SetValue(indexOf(opt.Values, getDeviceSetting(opt)))
+				}
+			})
+		}
+		choice.SetValue(indexOf(opt.Values, value))
+		editor = choice
+	default:
+		editor = fltk.NewBox(fltk.NO_BOX, 0, 0, 0, 0, value)
+	}
+
+	if !opt.Settable() || opt.Inactive() {
+		editor.Deactivate()
+	}
+
+	return editor
+}
+
+// rebuildOptionsPanel replaces the contents of the options panel with a row for
+// each of the device's options, grouped by option group. Advanced and inactive
+// options are only shown if the user asked for them.
+func rebuildOptionsPanel() {
+	// the filename may include the resolution or the mode
+	defer updateFilenamePreview()
+
+	if optionsPack != nil {
+		optionsScroll.Remove(optionsPack)
+		optionsPack.Destroy()
+	}
+
+	optionsScroll.Begin()
+	defer optionsScroll.End()
+
+	// the panel has no size until the window is first laid out
+	w := max(optionsScroll.W()-fltk.ScrollbarSize(), 0)
+	optionsPack = fltk.NewPack(optionsScroll.X(), optionsScroll.Y(), w, optionsScroll.H())
+	optionsPack.SetType(fltk.VERTICAL)
+	optionsPack.SetSpacing(2)
+	defer optionsPack.End()
+
+	groups := groupDeviceOptions(appConf.DeviceOptions, appConf.ShowAdvanced)
+	if len(groups) == 0 {
+		placeholder := fltk.NewBox(fltk.NO_BOX, 0, 0, w, OPTION_ROW_HEIGHT*2, "Device options will appear here, once a device is chosen")
+		placeholder.SetAlign(fltk.ALIGN_INSIDE | fltk.ALIGN_LEFT | fltk.ALIGN_WRAP)
+		return
+	}
+
+	for _, group := range groups {
+		name := group.Name
+		if name == "" {
+			name = "Options"
+		}
+
+		header := fltk.NewBox(fltk.NO_BOX, 0, 0, w, OPTION_ROW_HEIGHT, name)
+		header.SetAlign(fltk.ALIGN_INSIDE | fltk.ALIGN_LEFT)
+		header.SetLabelFont(fltk.HELVETICA_BOLD)
+
+		for _, opt := range group.Options {
+			row := fltk.NewFlex(0, 0, w, OPTION_ROW_HEIGHT)
+			row.SetType(fltk.ROW)
+			row.SetGap(4)
+
+			label := opt.Name
+			if opt.Unit != "" {
+				label = fmt.Sprintf("%v (%v)", label, opt.Unit)
+			}
+			if opt.Inactive() {
+				label = fmt.Sprintf("%v [inactive]", label)
+			}
+
+			tooltip := opt.Description
+			if opt.Constraint != "" {
+				tooltip = fmt.Sprintf("%v\n\nAccepts: %v", tooltip, opt.Constraint)
+			}
+
+			labelBox := fltk.NewBox(fltk.NO_BOX, 0, 0, 0, 0)
+			labelBox.SetLabel(label)
+			labelBox.SetAlign(fltk.ALIGN_INSIDE | fltk.ALIGN_LEFT | fltk.ALIGN_CLIP)
+			labelBox.SetTooltip(tooltip)
+
+			editor := newOptionEditor(opt)
+			editor.SetTooltip(tooltip)
+
+			row.End()
+		}
+	}
+
+	optionsScroll.ScrollTo(0, 0)
+	optionsScroll.Redraw()
+}
+
+// resizeOptionsPanel fits the rows of the options panel to the width of the
+// panel after it has been resized.
+func resizeOptionsPanel() {
+	if optionsPack == nil {
+		return
+	}
+
+	optionsPack.Resize(optionsScroll.X(), optionsScroll.Y(), max(optionsScroll.W()-fltk.ScrollbarSize(), 0), optionsPack.H())
+	optionsScroll.ScrollTo(0, 0)
+}
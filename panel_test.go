@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSelectDevice(t *testing.T) {
+	useFakeBackend(t, "")
+
+	const flatbed, feeder = "test:0", "brother5:bus2;dev1"
+
+	err := selectDevice(flatbed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if appConf.Device != flatbed || appConf.DeviceSettings["resolution"] != "100" {
+		t.Fatalf("a new device didn't start with its defaults: %v %v", appConf.Device, appConf.DeviceSettings)
+	}
+	appConf.DeviceSettings["resolution"] = "600"
+	appConf.DeviceSettings["mode"] = "True Gray"
+
+	err = selectDevice(feeder)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if appConf.DeviceSettings["resolution"] != "100" {
+		t.Errorf("the other device's settings were carried over: %v", appConf.DeviceSettings)
+	}
+	appConf.DeviceSettings["resolution"] = "300"
+
+	// the remembered settings include one that the device no longer has
+	appConf.Devices[flatbed].Settings["lamp-off-time"] = "15"
+
+	err = selectDevice(flatbed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if appConf.DeviceSettings["resolution"] != "600" || appConf.DeviceSettings["mode"] != "True Gray" {
+		t.Errorf("the settings weren't restored: %v", appConf.DeviceSettings)
+	}
+	if _, ok := appConf.DeviceSettings["lamp-off-time"]; ok {
+		t.Errorf("a setting that the device doesn't have was restored: %v", appConf.DeviceSettings)
+	}
+	if appConf.Devices[feeder].Settings["resolution"] != "300" {
+		t.Errorf("the settings of the previous device weren't remembered: %v", appConf.Devices[feeder])
+	}
+
+	useFakeBackend(t, "fail")
+	appConf.Device = flatbed
+	err = selectDevice(feeder)
+	if err == nil || appConf.Device != flatbed {
+		t.Errorf("expected an error and no change of device, got %v and %v", err, appConf.Device)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What happens when a scan would write to a file that already exists.
+const (
+	// Add a number to the end of the file name, such as "scan-1.png".
+	CollisionSuffix = "suffix"
+	// Replace the existing file.
+	CollisionOverwrite = "overwrite"
+	// Ask the user. The scan command fails instead, since there is nobody to
+	// ask.
+	CollisionPrompt = "prompt"
+)
+
+// collisionPolicies are the accepted collision policies. The first one is the
+// default.
+var collisionPolicies = []string{CollisionSuffix, CollisionOverwrite, CollisionPrompt}
+
+// collisionPolicyNames describe the collision policies to users.
+var collisionPolicyNames = map[string]string{
+	CollisionSuffix:    "add a number",
+	CollisionOverwrite: "replace it",
+	CollisionPrompt:    "ask",
+}
+
+// The most numbers that are tried for CollisionSuffix before giving up.
+const MAX_COLLISION_SUFFIX = 10000
+
+// getCollisionPolicy returns the policy, or the default one if it isn't known.
+func getCollisionPolicy(policy string) string {
+	for _, p := range collisionPolicies {
+		if p == policy {
+			return p
+		}
+	}
+
+	return collisionPolicies[0]
+}
+
+// joinOutputPath joins the output directory and a file name that was expanded
+// from a filename template, which may contain subdirectories. Returns an error
+// if the result would be outside of dir, such as for "../scan.png" or an
+// absolute path.
+func joinOutputPath(dir string, name string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("%v is not within the output directory", name)
+	}
+
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+// getScanOutputs returns the files that the scan writes to, which would be
+// replaced if they already exist. For batch scans, that's the document and the
+// first page, since the number of pages isn't known up front. Documents that
+// the pages are appended to are not included, since they are meant to exist.
+func getScanOutputs(req scanRequest) []string {
+	appends := req.AppendPDF && strings.ToLower(filepath.Ext(req.Filename)) == ".pdf"
+
+	if !req.Batch {
+		if appends {
+			return nil
+		}
+		return []string{req.Filename}
+	}
+
+	outputs := []string{}
+	if !req.AppendPDF {
+		outputs = append(outputs, getBatchDocument(req.Filename))
+	}
+
+	pattern := req.PagePattern
+	if pattern == "" {
+		pattern = getBatchPattern(req.Filename)
+	}
+
+	return append(outputs, fmt.Sprintf(pattern, 1))
+}
+
+// addPathSuffix adds "-n" to the end of the file name, before its extension,
+// such as "scan-2.png" for "scan.png". It works for scanimage --batch patterns
+// too.
+func addPathSuffix(path string, n int) string {
+	ext := filepath.Ext(path)
+
+	return fmt.Sprintf("%v-%v%v", strings.TrimSuffix(path, ext), n, ext)
+}
+
+// findCollision returns the first of the files that the scan writes to that is
+// taken, if any.
+func findCollision(req scanRequest, taken func(path string) bool) (string, bool) {
+	for _, path := range getScanOutputs(req) {
+		if taken(path) {
+			return path, true
+		}
+	}
+
+	return "", false
+}
+
+// scanCollides returns true if any of the files that the scan writes to are
+// taken.
+func scanCollides(req scanRequest, taken func(path string) bool) bool {
+	_, ok := findCollision(req, taken)
+
+	return ok
+}
+
+// avoidCollisions returns the request with the smallest number added to its
+// file names that makes none of the files that it writes to taken. The request
+// is returned as it is if it doesn't collide.
+func avoidCollisions(req scanRequest, taken func(path string) bool) (scanRequest, error) {
+	if !scanCollides(req, taken) {
+		return req, nil
+	}
+
+	for n := 1; n <= MAX_COLLISION_SUFFIX; n++ {
+		r := req
+		r.Filename = addPathSuffix(req.Filename, n)
+		if req.PagePattern != "" {
+			r.PagePattern = addPathSuffix(req.PagePattern, n)
+		}
+
+		if !scanCollides(r, taken) {
+			return r, nil
+		}
+	}
+
+	return req, fmt.Errorf("unable to find a free file name for %v", req.Filename)
+}
+
+// fileExists returns true if something exists at path, even if it can't be
+// read.
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+
+	return err == nil || !errors.Is(err, fs.ErrNotExist)
+}
+
+// applyCollisionPolicy returns the request to scan, according to the policy,
+// when taken reports which files are taken. CollisionPrompt returns an error
+// for requests that collide, since it can't ask.
+func applyCollisionPolicy(req scanRequest, policy string, taken func(path string) bool) (scanRequest, error) {
+	switch getCollisionPolicy(policy) {
+	case CollisionOverwrite:
+		return req, nil
+	case CollisionPrompt:
+		if path, ok := findCollision(req, taken); ok {
+			return req, fmt.Errorf("%v already exists", path)
+		}
+		return req, nil
+	default:
+		return avoidCollisions(req, taken)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJoinOutputPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		wantErr  bool
+	}{
+		{name: "scan.png", expected: filepath.Join("/scans", "scan.png")},
+		{name: "receipts/2024/scan.png", expected: filepath.Join("/scans", "receipts", "2024", "scan.png")},
+		{name: "receipts/../scan.png", expected: filepath.Join("/scans", "scan.png")},
+		{name: "../scan.png", wantErr: true},
+		{name: "receipts/../../scan.png", wantErr: true},
+		{name: "/etc/scan.png", wantErr: true},
+		{name: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := joinOutputPath("/scans", test.name)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error but got %v", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.name, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("%q: got %v, wanted %v", test.name, got, test.expected)
+		}
+	}
+
+	_, _, err := scanFilenames("../{label}.png", "/scans", templateVars{}, false)
+	if err == nil {
+		t.Errorf("template outside of the directory: expected an error but got nil")
+	}
+}
+
+func TestGetScanOutputs(t *testing.T) {
+	tests := []struct {
+		req      scanRequest
+		expected []string
+	}{
+		{req: scanRequest{Filename: "/s/scan.png"}, expected: []string{"/s/scan.png"}},
+		{req: scanRequest{Filename: "/s/doc.pdf", AppendPDF: true}, expected: nil},
+		{req: scanRequest{Filename: "/s/scan.png", AppendPDF: true}, expected: []string{"/s/scan.png"}},
+		{req: scanRequest{Filename: "/s/doc.pdf", Batch: true}, expected: []string{"/s/doc.pdf", "/s/doc-page1.png"}},
+		{req: scanRequest{Filename: "/s/doc.pdf", Batch: true, AppendPDF: true}, expected: []string{"/s/doc-page1.png"}},
+		{req: scanRequest{Filename: "/s/doc.pdf", PagePattern: "/s/doc-%03d.png", Batch: true}, expected: []string{"/s/doc.pdf", "/s/doc-001.png"}},
+	}
+
+	for _, test := range tests {
+		got := getScanOutputs(test.req)
+		if strings.Join(got, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%+v: got %v, wanted %v", test.req, got, test.expected)
+		}
+	}
+}
+
+func TestApplyCollisionPolicy(t *testing.T) {
+	existing := map[string]bool{
+		"/s/scan.png":        true,
+		"/s/scan-1.png":      true,
+		"/s/doc-1.png":       true,
+		"/s/doc-1-page1.png": true,
+	}
+	taken := func(path string) bool { return existing[path] }
+
+	tests := []struct {
+		req      scanRequest
+		policy   string
+		expected string
+		pattern  string
+		wantErr  bool
+	}{
+		{req: scanRequest{Filename: "/s/new.png"}, policy: CollisionPrompt, expected: "/s/new.png"},
+		{req: scanRequest{Filename: "/s/scan.png"}, policy: CollisionSuffix, expected: "/s/scan-2.png"},
+		{req: scanRequest{Filename: "/s/scan.png"}, policy: "", expected: "/s/scan-2.png"},
+		{req: scanRequest{Filename: "/s/scan.png"}, policy: CollisionOverwrite, expected: "/s/scan.png"},
+		{req: scanRequest{Filename: "/s/scan.png"}, policy: CollisionPrompt, wantErr: true},
+		// the first page of the batch collides, rather than the document
+		{req: scanRequest{Filename: "/s/doc.pdf", Batch: true, PagePattern: "/s/doc-%d.png"}, policy: CollisionSuffix, expected: "/s/doc-1.pdf", pattern: "/s/doc-%d-1.png"},
+		{req: scanRequest{Filename: "/s/doc-1.pdf", Batch: true}, policy: CollisionSuffix, expected: "/s/doc-1-1.pdf"},
+	}
+
+	for _, test := range tests {
+		got, err := applyCollisionPolicy(test.req, test.policy, taken)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%v %v: expected an error but got %v", test.req.Filename, test.policy, got.Filename)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v %v: unexpected error: %v", test.req.Filename, test.policy, err)
+			continue
+		}
+		if got.Filename != test.expected || got.PagePattern != test.pattern {
+			t.Errorf("%v %v: got %v and %q, wanted %v and %q", test.req.Filename, test.policy, got.Filename, got.PagePattern, test.expected, test.pattern)
+		}
+	}
+}
+
+func TestPerformScanSubdirectory(t *testing.T) {
+	useFakeBackend(t, "")
+
+	dir := t.TempDir()
+	filename, _, err := scanFilenames("{label}/{mode}/scan.png", dir, templateVars{Label: "receipts", Mode: "Color"}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result, err := performScan(context.Background(), scanRequest{Filename: filename, Device: "brother5:bus2;dev1"}, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := filepath.Join(dir, "receipts", "Color", "scan.png")
+	if result.File != expected {
+		t.Errorf("got %v, wanted %v", result.File, expected)
+	}
+	if _, err := os.Stat(expected); err != nil {
+		t.Errorf("scanned file is missing: %v", err)
+	}
+}
+
+func TestPerformScanUppercaseExtension(t *testing.T) {
+	useFakeBackend(t, "")
+
+	if err := checkScanChoices("{label}.PNG", "", CollisionSuffix); err != nil {
+		t.Fatalf("the template was rejected: %v", err)
+	}
+
+	dir := t.TempDir()
+	filename, _, err := scanFilenames("{label}.PNG", dir, templateVars{Label: "receipt"}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result, err := performScan(context.Background(), scanRequest{Filename: filename, Device: "brother5:bus2;dev1"}, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := filepath.Join(dir, "receipt.PNG")
+	if result.File != expected {
+		t.Errorf("got %v, wanted %v", result.File, expected)
+	}
+	if _, err := os.Stat(expected); err != nil {
+		t.Errorf("scanned file is missing: %v", err)
+	}
+}
+
+func TestRunCLIScanCollision(t *testing.T) {
+	useFakeBackend(t, "")
+
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "scan.png")
+	if err := os.WriteFile(existing, []byte("existing"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy   string
+		code     int
+		expected string
+	}{
+		{policy: CollisionPrompt, code: 1},
+		{policy: "bogus", code: 1},
+		{policy: CollisionSuffix, expected: filepath.Join(dir, "scan-1.png")},
+		{policy: CollisionSuffix, expected: filepath.Join(dir, "scan-2.png")},
+		{policy: CollisionOverwrite, expected: existing},
+	}
+
+	for _, test := range tests {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		code := runCLI([]string{"scan", "-device", "brother5:bus2;dev1", "-dir", dir, "-out", "scan.png", "-collision", test.policy}, stdout, stderr)
+		if code != test.code {
+			t.Errorf("%v: exit code mismatch: got %v, wanted %v: %v", test.policy, code, test.code, stderr.String())
+			continue
+		}
+		if test.code != 0 {
+			continue
+		}
+
+		if got := strings.TrimSpace(stdout.String()); got != test.expected {
+			t.Errorf("%v: got %v, wanted %v", test.policy, got, test.expected)
+		}
+	}
+
+	b, err := os.ReadFile(existing)
+	if err != nil || string(b) == "existing" {
+		t.Errorf("the existing file was not replaced: %q, %v", b, err)
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The resolution that is assumed for scanned pages when the resolution that
+// they were scanned at isn't known. At 72 DPI, one pixel is one point.
+const DEFAULT_PDF_DPI = 72
+
+// The page sizes that PDFs can be created with, in points. Pages are fitted to
+// the size of their image unless one of these is chosen.
+var pdfPageSizes = map[string][2]float64{
+	"a4":     {595.28, 841.89},
+	"a5":     {419.53, 595.28},
+	"letter": {612, 792},
+	"legal":  {612, 1008},
+}
+
+// The names of the page sizes that PDFs can be created with, in the order
+// that they're presented to the user. "fit" makes each page the size of its
+// image.
+var pdfPageSizeNames = []string{"fit", "a4", "a5", "letter", "legal"}
+
+// pdfLayout describes how scanned pages are laid out in a PDF.
+type pdfLayout struct {
+	// The resolution that the pages were scanned at, which determines their
+	// physical size.
+	DPI float64
+	// One of pdfPageSizeNames. Empty is the same as "fit".
+	PageSize string
+}
+
+// pdfImage is a scanned page that is ready to be embedded in a PDF as an image
+// XObject.
+type pdfImage struct {
+	Width  int
+	Height int
+	// DeviceRGB or DeviceGray
+	ColorSpace string
+	// DCTDecode for JPEG data, which PDF readers can decode as-is, or
+	// FlateDecode for zlib-compressed samples.
+	Filter string
+	Data   []byte
+}
+
+// getGraySamples returns the 8-bit gray samples of img, row by row. The rows
+// of *image.Gray images are copied as they are, since converting every pixel
+// through img.At is slow for pages scanned at a high resolution.
+func getGraySamples(img image.Image) []byte {
+	bounds := img.Bounds()
+	samples := make([]byte, 0, bounds.Dx()*bounds.Dy())
+
+	if g, ok := img.(*image.Gray); ok {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			samples = append(samples, g.Pix[g.PixOffset(bounds.Min.X, y):][:bounds.Dx()]...)
+		}
+		return samples
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			samples = append(samples, color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+		}
+	}
+
+	return samples
+}
+
+// getRGBSamples returns the 8-bit red, green and blue samples of img, row by
+// row. *image.RGBA and *image.YCbCr images, which is what pngs and jpegs of
+// color scans are decoded to, are read directly rather than through img.At.
+func getRGBSamples(img image.Image) []byte {
+	bounds := img.Bounds()
+	samples := make([]byte, 0, bounds.Dx()*bounds.Dy()*3)
+
+	switch img := img.(type) {
+	case *image.RGBA:
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			row := img.Pix[img.PixOffset(bounds.Min.X, y):][:bounds.Dx()*4]
+			for i := 0; i < len(row); i += 4 {
+				samples = append(samples, row[i], row[i+1], row[i+2])
+			}
+		}
+	case *image.YCbCr:
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r, g, b, _ := img.YCbCrAt(x, y).RGBA()
+				samples = append(samples, uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			}
+		}
+	default:
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+				samples = append(samples, c.R, c.G, c.B)
+			}
+		}
+	}
+
+	return samples
+}
+
+// loadPDFImage reads a scanned png or jpeg image into a pdfImage. JPEG images
+// are embedded without re-encoding them, so they don't lose any more quality.
+func loadPDFImage(filename string) (pdfImage, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return pdfImage{}, fmt.Errorf("failed to read image %v: %w", filename, err)
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return pdfImage{}, fmt.Errorf("failed to read image %v: %w", filename, err)
+	}
+
+	if format == "jpeg" {
+		switch cfg.ColorModel {
+		case color.GrayModel:
+			return pdfImage{Width: cfg.Width, Height: cfg.Height, ColorSpace: "DeviceGray", Filter: "DCTDecode", Data: b}, nil
+		case color.YCbCrModel:
+			return pdfImage{Width: cfg.Width, Height: cfg.Height, ColorSpace: "DeviceRGB", Filter: "DCTDecode", Data: b}, nil
+		}
+		// other jpegs, such as CMYK ones, are re-encoded below
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return pdfImage{}, fmt.Errorf("failed to decode image %v: %w", filename, err)
+	}
+
+	bounds := img.Bounds()
+	p := pdfImage{Width: bounds.Dx(), Height: bounds.Dy(), Filter: "FlateDecode"}
+
+	var samples []byte
+	switch img.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		p.ColorSpace = "DeviceGray"
+		samples = getGraySamples(img)
+	default:
+		p.ColorSpace = "DeviceRGB"
+		samples = getRGBSamples(img)
+	}
+
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	_, err = zw.Write(samples)
+	if err != nil {
+		return pdfImage{}, fmt.Errorf("failed to compress image %v: %w", filename, err)
+	}
+	err = zw.Close()
+	if err != nil {
+		return pdfImage{}, fmt.Errorf("failed to compress image %v: %w", filename, err)
+	}
+	p.Data = buf.Bytes()
+
+	return p, nil
+}
+
+// pageGeometry returns the size of the page for the image, and the position
+// and size of the image on the page, in points. On fixed page sizes the image
+// is placed in the top-left corner at its true size, since that's where it was
+// on the scanner bed, and is only scaled down if it doesn't fit.
+func (l pdfLayout) pageGeometry(p pdfImage) (pageW, pageH, x, y, w, h float64) {
+	dpi := l.DPI
+	if dpi <= 0 {
+		dpi = DEFAULT_PDF_DPI
+	}
+
+	w = float64(p.Width) * 72 / dpi
+	h = float64(p.Height) * 72 / dpi
+
+	size, ok := pdfPageSizes[l.PageSize]
+	if !ok {
+		return w, h, 0, 0, w, h
+	}
+
+	pageW, pageH = size[0], size[1]
+	if w > pageW || h > pageH {
+		scale := min(pageW/w, pageH/h)
+		w, h = w*scale, h*scale
+	}
+
+	// PDF coordinates start at the bottom-left of the page
+	return pageW, pageH, 0, pageH - h, w, h
+}
+
+// pdfNumber formats n for a PDF, without needless decimals.
+func pdfNumber(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+// pdfWriter accumulates the objects of a PDF, or of an incremental update to
+// an existing PDF, and tracks where each object starts so that the
+// cross-reference table can be written.
+type pdfWriter struct {
+	buf bytes.Buffer
+	// The length of the existing PDF that buf will be appended to.
+	base    int
+	offsets map[int]int
+}
+
+// startObj begins object n.
+func (pw *pdfWriter) startObj(n int) {
+	if pw.offsets == nil {
+		pw.offsets = make(map[int]int)
+	}
+
+	pw.offsets[n] = pw.base + pw.buf.Len()
+	fmt.Fprintf(&pw.buf, "%d 0 obj\n", n)
+}
+
+// writePage writes the page object n, followed by its content stream and
+// image as objects n+1 and n+2.
+func (pw *pdfWriter) writePage(n int, parent int, p pdfImage, layout pdfLayout) {
+	pageW, pageH, x, y, w, h := layout.pageGeometry(p)
+
+	pw.startObj(n)
+	fmt.Fprintf(&pw.buf, "<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %v %v] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>\nendobj\n", parent, pdfNumber(pageW), pdfNumber(pageH), n+2, n+1)
+
+	content := fmt.Sprintf("q %v 0 0 %v %v %v cm /Im0 Do Q\n", pdfNumber(w), pdfNumber(h), pdfNumber(x), pdfNumber(y))
+	pw.startObj(n + 1)
+	fmt.Fprintf(&pw.buf, "<< /Length %d >>\nstream\n%v\nendstream\nendobj\n", len(content), content)
+
+	pw.startObj(n + 2)
+	fmt.Fprintf(&pw.buf, "<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%v /BitsPerComponent 8 /Filter /%v /Length %d >>\nstream\n", p.Width, p.Height, p.ColorSpace, p.Filter, len(p.Data))
+	pw.buf.Write(p.Data)
+	pw.buf.WriteString("\nendstream\nendobj\n")
+}
+
+// writePageTree writes the root of the page tree as object n, with kids being
+// the page objects (or intermediate page tree nodes), and count being the
+// total number of pages in the tree.
+func (pw *pdfWriter) writePageTree(n int, kids []int, count int) {
+	pw.startObj(n)
+	pw.buf.WriteString("<< /Type /Pages /Kids [")
+	for _, k := range kids {
+		fmt.Fprintf(&pw.buf, " %d 0 R", k)
+	}
+	fmt.Fprintf(&pw.buf, " ] /Count %d >>\nendobj\n", count)
+}
+
+// writeTrailer writes the cross-reference table for the objects that were
+// written, followed by the trailer. prev is the offset of the previous
+// cross-reference table for incremental updates, or -1 for new documents.
+func (pw *pdfWriter) writeTrailer(size int, root int, prev int) {
+	nums := make([]int, 0, len(pw.offsets))
+	for n := range pw.offsets {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+
+	xref := pw.base + pw.buf.Len()
+	pw.buf.WriteString("xref\n")
+	if prev < 0 {
+		pw.buf.WriteString("0 1\n0000000000 65535 f \n")
+	}
+
+	// each subsection lists a run of consecutive object numbers
+	for i := 0; i < len(nums); {
+		j := i + 1
+		for j < len(nums) && nums[j] == nums[j-1]+1 {
+			j++
+		}
+
+		fmt.Fprintf(&pw.buf, "%d %d\n", nums[i], j-i)
+		for _, n := range nums[i:j] {
+			fmt.Fprintf(&pw.buf, "%010d 00000 n \n", pw.offsets[n])
+		}
+		i = j
+	}
+
+	fmt.Fprintf(&pw.buf, "trailer\n<< /Size %d /Root %d 0 R", size, root)
+	if prev >= 0 {
+		fmt.Fprintf(&pw.buf, " /Prev %d", prev)
+	}
+	fmt.Fprintf(&pw.buf, " >>\nstartxref\n%d\n%%%%EOF\n", xref)
+}
+
+// createPDF returns a new PDF document with one page per image.
+func createPDF(pages []pdfImage, layout pdfLayout) ([]byte, error) {
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("a pdf needs at least one page")
+	}
+
+	pw := &pdfWriter{}
+	pw.buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// the catalog is object 1 and the page tree is object 2; each page is
+	// then written as a page, its content stream, and its image
+	pw.startObj(1)
+	pw.buf.WriteString("<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+
+	kids := make([]int, len(pages))
+	for i := range pages {
+		kids[i] = 3 + i*3
+	}
+	pw.writePageTree(2, kids, len(kids))
+
+	for i, p := range pages {
+		pw.writePage(kids[i], 2, p, layout)
+	}
+
+	pw.writeTrailer(3+len(pages)*3, 1, -1)
+
+	return pw.buf.Bytes(), nil
+}
+
+var (
+	pdfStartXrefRegexp  = regexp.MustCompile(`startxref\s+(\d+)\s+%%EOF\s*$`)
+	pdfSubsectionRegexp = regexp.MustCompile(`^\s*(\d+)\s+(\d+)[ \t]*\r?\n`)
+	pdfTrailerRegexp    = regexp.MustCompile(`(?s)^\s*trailer\s*<<(.*?)>>`)
+	pdfObjRegexp        = regexp.MustCompile(`^(\d+)\s+\d+\s+obj`)
+	pdfPrevRegexp       = regexp.MustCompile(`/Prev\s+(\d+)`)
+	pdfSizeRegexp       = regexp.MustCompile(`/Size\s+(\d+)`)
+	pdfRootRegexp       = regexp.MustCompile(`/Root\s+(\d+)\s+0\s+R`)
+	pdfPagesRegexp      = regexp.MustCompile(`/Pages\s+(\d+)\s+0\s+R`)
+	pdfKidsRegexp       = regexp.MustCompile(`/Kids\s*\[([^\]]*)\]`)
+	pdfCountRegexp      = regexp.MustCompile(`/Count\s+(\d+)`)
+)
+
+// The length of each entry of a cross-reference table, including its line
+// break.
+const PDF_XREF_ENTRY_SIZE = 20
+
+// readPDFXref reads the cross-reference table at offset, along with the tables
+// of the earlier updates that its trailer refers to with /Prev. It returns the
+// offset of the latest definition of each object, where objects that were
+// freed have an offset of -1, and the dictionary of the latest trailer.
+func readPDFXref(b []byte, offset int) (map[int]int, []byte, error) {
+	offsets := make(map[int]int)
+	var latest []byte
+	seen := make(map[int]bool)
+
+	for {
+		if offset < 0 || offset >= len(b) || seen[offset] {
+			return nil, nil, fmt.Errorf("the pdf has an invalid cross-reference offset %v", offset)
+		}
+		seen[offset] = true
+
+		rest := bytes.TrimLeft(b[offset:], " \t\r\n")
+		if !bytes.HasPrefix(rest, []byte("xref")) {
+			return nil, nil, fmt.Errorf("the pdf has no cross-reference table at %v, it may be compressed", offset)
+		}
+		rest = rest[len("xref"):]
+
+		// a table only has entries for the objects that were added or
+		// changed, and the entries of later updates take precedence
+		for {
+			m := pdfSubsectionRegexp.FindSubmatch(rest)
+			if m == nil {
+				break
+			}
+			first, _ := strconv.Atoi(string(m[1]))
+			count, _ := strconv.Atoi(string(m[2]))
+			rest = rest[len(m[0]):]
+
+			if count*PDF_XREF_ENTRY_SIZE > len(rest) {
+				return nil, nil, fmt.Errorf("the pdf cross-reference table at %v is cut short", offset)
+			}
+			for i := 0; i < count; i++ {
+				entry := rest[i*PDF_XREF_ENTRY_SIZE : (i+1)*PDF_XREF_ENTRY_SIZE]
+				n := first + i
+				if _, ok := offsets[n]; ok {
+					continue
+				}
+
+				o, err := strconv.Atoi(string(entry[:10]))
+				if err != nil {
+					return nil, nil, fmt.Errorf("the pdf cross-reference table at %v has an invalid entry", offset)
+				}
+				if entry[17] != 'n' {
+					o = -1
+				}
+				offsets[n] = o
+			}
+			rest = rest[count*PDF_XREF_ENTRY_SIZE:]
+		}
+
+		m := pdfTrailerRegexp.FindSubmatch(rest)
+		if m == nil {
+			return nil, nil, fmt.Errorf("the pdf cross-reference table at %v has no trailer", offset)
+		}
+		if latest == nil {
+			latest = m[1]
+		}
+
+		m = pdfPrevRegexp.FindSubmatch(m[1])
+		if m == nil {
+			return offsets, latest, nil
+		}
+		offset, _ = strconv.Atoi(string(m[1]))
+	}
+}
+
+// findPDFObject returns the body of the latest definition of object n, using
+// the offsets from readPDFXref. Only the dictionary of objects with a stream
+// is returned, so that the stream's data, which may contain anything, isn't
+// mistaken for the end of the object.
+func findPDFObject(b []byte, offsets map[int]int, n int) ([]byte, bool) {
+	o, ok := offsets[n]
+	if !ok || o < 0 || o >= len(b) {
+		return nil, false
+	}
+
+	m := pdfObjRegexp.FindSubmatch(b[o:])
+	if m == nil || string(m[1]) != strconv.Itoa(n) {
+		return nil, false
+	}
+	body := b[o+len(m[0]):]
+
+	end := bytes.Index(body, []byte("endobj"))
+	if end < 0 {
+		return nil, false
+	}
+	if stream := bytes.Index(body[:end], []byte("stream")); stream >= 0 {
+		end = stream
+	}
+
+	return body[:end], true
+}
+
+// appendPDF adds the pages to the end of an existing PDF, as an incremental
+// update so that the existing content is left untouched. Only PDFs with a
+// plain cross-reference table and page tree can be appended to, such as the
+// ones that this app creates; compressed PDFs are rejected.
+func appendPDF(existing []byte, pages []pdfImage, layout pdfLayout) ([]byte, error) {
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no pages to append")
+	}
+
+	m := pdfStartXrefRegexp.FindSubmatch(existing)
+	if m == nil {
+		return nil, fmt.Errorf("the pdf has no cross-reference table")
+	}
+	prev, _ := strconv.Atoi(string(m[1]))
+
+	offsets, trailer, err := readPDFXref(existing, prev)
+	if err != nil {
+		return nil, err
+	}
+
+	m = pdfSizeRegexp.FindSubmatch(trailer)
+	if m == nil {
+		return nil, fmt.Errorf("the pdf trailer has no size")
+	}
+	size, _ := strconv.Atoi(string(m[1]))
+
+	m = pdfRootRegexp.FindSubmatch(trailer)
+	if m == nil {
+		return nil, fmt.Errorf("the pdf trailer has no root")
+	}
+	root, _ := strconv.Atoi(string(m[1]))
+
+	catalog, ok := findPDFObject(existing, offsets, root)
+	if !ok {
+		return nil, fmt.Errorf("the pdf catalog is missing, it may be compressed")
+	}
+	m = pdfPagesRegexp.FindSubmatch(catalog)
+	if m == nil {
+		return nil, fmt.Errorf("the pdf catalog has no pages")
+	}
+	pagesObj, _ := strconv.Atoi(string(m[1]))
+
+	tree, ok := findPDFObject(existing, offsets, pagesObj)
+	if !ok {
+		return nil, fmt.Errorf("the pdf page tree is missing, it may be compressed")
+	}
+	m = pdfKidsRegexp.FindSubmatch(tree)
+	if m == nil || !pdfCountRegexp.Match(tree) {
+		return nil, fmt.Errorf("the pdf page tree has no kids")
+	}
+
+	// the kids may be pages or intermediate page tree nodes, which are kept
+	// as they are; only the root of the tree is replaced
+	var kids []int
+	refs := strings.Fields(string(m[1]))
+	if len(refs)%3 != 0 {
+		return nil, fmt.Errorf("the pdf page tree has an invalid kid")
+	}
+	for i := 0; i < len(refs); i += 3 {
+		k, err := strconv.Atoi(refs[i])
+		if err != nil || refs[i+2] != "R" {
+			return nil, fmt.Errorf("the pdf page tree has an invalid kid")
+		}
+		kids = append(kids, k)
+	}
+	m = pdfCountRegexp.FindSubmatch(tree)
+	count, _ := strconv.Atoi(string(m[1]))
+
+	pw := &pdfWriter{base: len(existing)}
+	if !bytes.HasSuffix(existing, []byte("\n")) {
+		pw.buf.WriteString("\n")
+	}
+
+	for i, p := range pages {
+		n := size + i*3
+		pw.writePage(n, pagesObj, p, layout)
+		kids = append(kids, n)
+	}
+
+	// the existing pages are counted too, including those that are nested in
+	// intermediate page tree nodes
+	pw.writePageTree(pagesObj, kids, count+len(pages))
+
+	pw.writeTrailer(size+len(pages)*3, root, prev)
+
+	return append(existing, pw.buf.Bytes()...), nil
+}
+
+// writePDFFile combines the scanned images into a PDF at filename, with one
+// page per image. If appendExisting is true and filename already exists, the
+// pages are added to the end of it instead. Returns true if the pages were
+// appended.
+func writePDFFile(filename string, images []string, layout pdfLayout, appendExisting bool) (bool, error) {
+	pages := make([]pdfImage, 0, len(images))
+	for _, img := range images {
+		p, err := loadPDFImage(img)
+		if err != nil {
+			return false, err
+		}
+		pages = append(pages, p)
+	}
+
+	var existing []byte
+	if appendExisting {
+		var err error
+		existing, err = os.ReadFile(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return false, fmt.Errorf("failed to read pdf %v: %w", filename, err)
+		}
+	}
+
+	var b []byte
+	var err error
+	if len(existing) > 0 {
+		b, err = appendPDF(existing, pages, layout)
+	} else {
+		b, err = createPDF(pages, layout)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to write pdf %v: %w", filename, err)
+	}
+
+	// an existing pdf is only replaced once the new one is complete, so that
+	// the pages that were already in it aren't lost if writing fails
+	err = writeFileAtomic(filename, b)
+	if err != nil {
+		return false, fmt.Errorf("failed to write pdf: %w", err)
+	}
+
+	return len(existing) > 0, nil
+}
+
+// scanPDF scans a single page to a png next to filename, and then adds it to
+// the PDF at filename, since older versions of scanimage can't write PDFs and
+// none of them can append to an existing PDF. Returns true if the page was
+// appended, along with any output from the backend. onProgress is called as
+// the scan progresses.
+func scanPDF(ctx context.Context, filename string, deviceSettings map[string]string, dev string, layout pdfLayout, appendExisting bool, onProgress func(p ScanProgress)) (bool, string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), ".go-fltk-sane-*.png")
+	if err != nil {
+		return false, "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	out, err := backend.Scan(ctx, tmp.Name(), deviceSettings, "png", dev, onProgress)
+	if err != nil {
+		return false, out, err
+	}
+
+	appended, err := writePDFFile(filename, []string{tmp.Name()}, layout, appendExisting)
+
+	return appended, out, err
+}
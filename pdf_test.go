@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+var (
+	testStartXrefRegexp  = regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`)
+	testSubsectionRegexp = regexp.MustCompile(`^(\d+) (\d+)\n`)
+	testPrevRegexp       = regexp.MustCompile(`/Prev (\d+)`)
+)
+
+// checkPDFXref verifies that every entry in each of the cross-reference tables
+// of the pdf points at the start of its object, and returns the number of
+// objects that were found.
+func checkPDFXref(t *testing.T, b []byte) int {
+	t.Helper()
+
+	m := testStartXrefRegexp.FindSubmatch(b)
+	if m == nil {
+		t.Fatalf("pdf doesn't end with startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+
+	found := map[int]bool{}
+	for {
+		if !bytes.HasPrefix(b[xref:], []byte("xref\n")) {
+			t.Fatalf("startxref %v doesn't point at a cross-reference table", xref)
+		}
+		rest := b[xref+len("xref\n"):]
+
+		for {
+			m := testSubsectionRegexp.FindSubmatch(rest)
+			if m == nil {
+				break
+			}
+			first, _ := strconv.Atoi(string(m[1]))
+			count, _ := strconv.Atoi(string(m[2]))
+			rest = rest[len(m[0]):]
+
+			for i := 0; i < count; i++ {
+				entry := string(rest[:20])
+				rest = rest[20:]
+
+				n := first + i
+				if n == 0 || found[n] {
+					// the free entry, or an object that was replaced by a
+					// later update
+					continue
+				}
+				found[n] = true
+
+				o, _ := strconv.Atoi(entry[:10])
+				want := fmt.Sprintf("%d 0 obj\n", n)
+				if !bytes.HasPrefix(b[o:], []byte(want)) {
+					t.Errorf("xref entry for object %v doesn't point at it", n)
+				}
+			}
+		}
+
+		if !bytes.HasPrefix(rest, []byte("trailer")) {
+			t.Fatalf("cross-reference table at %v isn't followed by a trailer", xref)
+		}
+
+		m := testPrevRegexp.FindSubmatch(rest[:bytes.Index(rest, []byte(">>"))])
+		if m == nil {
+			break
+		}
+		xref, _ = strconv.Atoi(string(m[1]))
+	}
+
+	return len(found)
+}
+
+func TestCreatePDF(t *testing.T) {
+	img, err := loadPDFImage(filepath.Join("testdata", "scanimage", "image.png"))
+	if err != nil {
+		t.Fatalf("failed to load image: %v", err)
+	}
+	if img.Width != 4 || img.Height != 4 || img.Filter != "FlateDecode" {
+		t.Errorf("unexpected image: %vx%v %v", img.Width, img.Height, img.Filter)
+	}
+
+	b, err := createPDF([]pdfImage{img, img}, pdfLayout{DPI: 300, PageSize: "a4"})
+	if err != nil {
+		t.Fatalf("failed to write pdf: %v", err)
+	}
+
+	if !bytes.Contains(b, []byte("/Count 2 ")) {
+		t.Errorf("pdf doesn't have 2 pages")
+	}
+	if !bytes.Contains(b, []byte("/MediaBox [0 0 595.28 841.89]")) {
+		t.Errorf("pdf pages aren't a4")
+	}
+	if !bytes.Contains(b, []byte("q 0.96 0 0 0.96 0 840.93 cm /Im0 Do Q")) {
+		t.Errorf("pdf image isn't in the top-left corner at 300 dpi")
+	}
+
+	if n := checkPDFXref(t, b); n != 8 {
+		t.Errorf("expected 8 objects, got %v", n)
+	}
+
+	_, err = createPDF(nil, pdfLayout{})
+	if err == nil {
+		t.Errorf("expected an error for a pdf without pages")
+	}
+}
+
+func TestPageGeometry(t *testing.T) {
+	tests := []struct {
+		layout   pdfLayout
+		w, h     int
+		expected [6]float64
+	}{
+		// 72 dpi is one pixel per point
+		{layout: pdfLayout{}, w: 612, h: 792, expected: [6]float64{612, 792, 0, 0, 612, 792}},
+		{layout: pdfLayout{DPI: 300, PageSize: "fit"}, w: 600, h: 300, expected: [6]float64{144, 72, 0, 0, 144, 72}},
+		// a 2x letter scan at 72 dpi is scaled down to fit
+		{layout: pdfLayout{PageSize: "letter"}, w: 1224, h: 1584, expected: [6]float64{612, 792, 0, 0, 612, 792}},
+		{layout: pdfLayout{DPI: 144, PageSize: "legal"}, w: 288, h: 144, expected: [6]float64{612, 1008, 0, 936, 144, 72}},
+	}
+
+	for _, test := range tests {
+		pageW, pageH, x, y, w, h := test.layout.pageGeometry(pdfImage{Width: test.w, Height: test.h})
+		got := [6]float64{pageW, pageH, x, y, w, h}
+		if got != test.expected {
+			t.Errorf("%v %vx%v: got %v, wanted %v", test.layout, test.w, test.h, got, test.expected)
+		}
+	}
+}
+
+func TestWritePDFFileAppend(t *testing.T) {
+	img := filepath.Join("testdata", "scanimage", "image.png")
+	filename := filepath.Join(t.TempDir(), "doc.pdf")
+
+	appended, err := writePDFFile(filename, []string{img}, pdfLayout{}, true)
+	if err != nil || appended {
+		t.Fatalf("failed to create pdf: appended=%v, err=%v", appended, err)
+	}
+
+	appended, err = writePDFFile(filename, []string{img, img}, pdfLayout{}, true)
+	if err != nil || !appended {
+		t.Fatalf("failed to append to pdf: appended=%v, err=%v", appended, err)
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read pdf: %v", err)
+	}
+
+	// the latest page tree has all of the pages
+	all := regexp.MustCompile(`/Count (\d+) `).FindAllSubmatch(b, -1)
+	if got := string(all[len(all)-1][1]); got != "3" {
+		t.Errorf("expected 3 pages after appending, got %v", got)
+	}
+	if !bytes.Contains(b, []byte("/Size 12 /Root 1 0 R /Prev ")) {
+		t.Errorf("the trailer of the update is incorrect")
+	}
+	if n := checkPDFXref(t, b); n != 11 {
+		t.Errorf("expected 11 objects, got %v", n)
+	}
+
+	// without appending, the pdf is replaced
+	appended, err = writePDFFile(filename, []string{img}, pdfLayout{}, false)
+	if err != nil || appended {
+		t.Fatalf("failed to replace pdf: appended=%v, err=%v", appended, err)
+	}
+
+	_, err = appendPDF([]byte("%PDF-1.5\nnot really a pdf"), []pdfImage{{}}, pdfLayout{})
+	if err == nil {
+		t.Errorf("expected an error when appending to an unsupported pdf")
+	}
+}
+
+// opaqueImage hides the type of the image that it wraps, so that it's read
+// through At like any other image.
+type opaqueImage struct{ image.Image }
+
+func TestPDFSamples(t *testing.T) {
+	r := image.Rect(0, 0, 7, 5)
+	gray, rgba, ycbcr := image.NewGray(r), image.NewRGBA(r), image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			c := color.RGBA{uint8(x * 37), uint8(y * 51), uint8(x*y*13 + 7), 255}
+			gray.Set(x, y, c)
+			rgba.Set(x, y, c)
+			yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+			ycbcr.Y[ycbcr.YOffset(x, y)] = yy
+			ycbcr.Cb[ycbcr.COffset(x, y)] = cb
+			ycbcr.Cr[ycbcr.COffset(x, y)] = cr
+		}
+	}
+
+	// sub images don't start at the start of their pixels
+	sub := image.Rect(1, 1, 6, 4)
+	tests := []struct {
+		name string
+		img  image.Image
+		get  func(img image.Image) []byte
+	}{
+		{name: "gray", img: gray, get: getGraySamples},
+		{name: "gray sub image", img: gray.SubImage(sub), get: getGraySamples},
+		{name: "rgba", img: rgba, get: getRGBSamples},
+		{name: "rgba sub image", img: rgba.SubImage(sub), get: getRGBSamples},
+		{name: "ycbcr", img: ycbcr, get: getRGBSamples},
+		{name: "ycbcr sub image", img: ycbcr.SubImage(sub), get: getRGBSamples},
+	}
+
+	for _, test := range tests {
+		got, expected := test.get(test.img), test.get(opaqueImage{test.img})
+		if !bytes.Equal(got, expected) {
+			t.Errorf("%v: got %v, wanted %v", test.name, got, expected)
+		}
+	}
+}
+
+func TestAppendPDFStreamWithKeywords(t *testing.T) {
+	// image data may contain anything, including what looks like the end of
+	// an object and another definition of the page tree
+	img := pdfImage{Width: 1, Height: 1, ColorSpace: "DeviceGray", Filter: "FlateDecode", Data: []byte("endobj\n2 0 obj\n<< /Type /Pages /Kids [ ] /Count 0 >>\nendobj\n")}
+
+	b, err := createPDF([]pdfImage{img}, pdfLayout{})
+	if err != nil {
+		t.Fatalf("failed to write pdf: %v", err)
+	}
+
+	b, err = appendPDF(b, []pdfImage{img}, pdfLayout{})
+	if err != nil {
+		t.Fatalf("failed to append to pdf: %v", err)
+	}
+
+	all := regexp.MustCompile(`/Kids \[([^\]]*)\] /Count (\d+) `).FindAllSubmatch(b, -1)
+	last := all[len(all)-1]
+	if string(last[2]) != "2" || string(last[1]) != " 3 0 R 6 0 R " {
+		t.Errorf("unexpected page tree: %q", last[0])
+	}
+	if n := checkPDFXref(t, b); n != 8 {
+		t.Errorf("expected 8 objects, got %v", n)
+	}
+}
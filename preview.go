@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/pwiecz/go-fltk"
+)
+
+// The size of the preview window when it is first shown, and the height of
+// its row of buttons.
+const (
+	PREVIEW_WIDTH      = 420
+	PREVIEW_HEIGHT     = 560
+	PREVIEW_ROW_HEIGHT = 30
+)
+
+// The preview window shows the latest preview scan, on which the region to
+// scan can be selected by dragging a rectangle.
+var (
+	previewWin *fltk.Window
+	previewBox *fltk.Box
+	previewImg *fltk.PngImage
+	// The device that the preview was scanned with; the region only applies
+	// to that device.
+	previewDevice string
+	// The selected region, and whether it is being dragged right now.
+	previewSelection previewRegion
+	previewDragging  bool
+	// Where the preview image was last drawn, so that the mouse position can
+	// be translated into a region of the preview.
+	previewImgPos Pos
+)
+
+// startPreview queues a quick, low resolution scan of the whole area of the
+// device, which is shown in the preview window once it is done.
+func startPreview() {
+	if appConf.Device == "" {
+		fltk.MessageBox("Error", "A device has not been selected. Please refresh the list of devices and choose one.")
+		return
+	}
+
+	if _, ok := getScanArea(appConf.DeviceOptions); !ok {
+		fltk.MessageBox("Error", "This device doesn't have the geometry options (l, t, x and y) that are needed to scan a region, so it can't be previewed.")
+		return
+	}
+
+	f, err := os.CreateTemp("", "go-fltk-sane-preview-*.png")
+	if err != nil {
+		fltk.MessageBox("Error", fmt.Sprintf("Unable to create a file for the preview: %v", err.Error()))
+		return
+	}
+	filename := f.Name()
+	f.Close()
+
+	dev := appConf.Device
+	settings := getPreviewSettings(appConf.DeviceOptions, appConf.DeviceSettings)
+	region := geometryToRegion(appConf.DeviceOptions, appConf.DeviceSettings)
+
+	job, err := jobs.Submit(fmt.Sprintf("preview of %v", dev), func(ctx context.Context) error {
+		Logf("scanning a preview at %vdpi...", settings["resolution"])
+
+		out, err := backend.Scan(ctx, filename, settings, "png", dev, newProgressReporter())
+		if out != "" {
+			Log(out)
+		}
+		if ctx.Err() != nil {
+			os.Remove(filename)
+			Log("cancelled preview")
+			return ctx.Err()
+		}
+		if err != nil {
+			os.Remove(filename)
+			Errorf("failed to scan a preview: %v", err.Error())
+			showError(fmt.Sprintf("Failed to scan a preview: %v", err.Error()))
+			return err
+		}
+
+		onUI(func() {
+			showPreview(filename, dev, region)
+		})
+
+		return nil
+	})
+	if err != nil {
+		os.Remove(filename)
+		fltk.MessageBox("Error", fmt.Sprintf("Unable to queue the preview: %v", err.Error()))
+		return
+	}
+
+	Logf("queued preview #%v", job.ID)
+}
+
+// showPreview loads the preview image from filename, which is removed
+// afterwards, and shows it in the preview window with the region selected.
+func showPreview(filename string, dev string, region previewRegion) {
+	img, err := fltk.NewPngImageLoad(filename)
+	os.Remove(filename)
+	if err != nil {
+		fltk.MessageBox("Error", fmt.Sprintf("Unable to load the preview: %v", err.Error()))
+		return
+	}
+
+	if previewImg != nil {
+		previewImg.Destroy()
+	}
+	previewImg = img
+	previewDevice = dev
+	previewSelection = region
+	previewDragging = false
+
+	if previewWin == nil {
+		buildPreviewWindow()
+	}
+
+	Log("drag a rectangle on the preview to choose the region to scan")
+	previewBox.Redraw()
+	previewWin.Show()
+}
+
+// buildPreviewWindow creates the preview window, which is kept around and
+// reused for each preview.
+func buildPreviewWindow() {
+	w, h := PREVIEW_WIDTH, PREVIEW_HEIGHT
+	row := PREVIEW_ROW_HEIGHT
+
+	previewWin = fltk.NewWindow(w, h)
+	previewWin.SetLabel("Preview")
+
+	previewBox = fltk.NewBox(fltk.DOWN_BOX, 5, 5, w-10, h-row-15)
+	previewBox.SetColor(fltk.BACKGROUND2_COLOR)
+	previewBox.SetTooltip("Drag a rectangle to choose the region to scan")
+	previewBox.SetDrawHandler(drawPreview)
+	previewBox.SetEventHandler(handlePreviewEvent)
+
+	wholeBtn := fltk.NewButton(5, h-row-5, (w-15)/2, row, "Scan whole area")
+	wholeBtn.SetTooltip("Scan the whole area of the device instead of a region")
+	wholeBtn.SetCallback(func() {
+		previewSelection = wholePreviewRegion
+		previewBox.Redraw()
+		applyPreviewSelection()
+	})
+
+	closeBtn := fltk.NewButton(10+(w-15)/2, h-row-5, (w-15)/2, row, "Close")
+	closeBtn.SetCallback(func() {
+		previewWin.Hide()
+	})
+
+	previewWin.Resizable(previewBox)
+	previewWin.End()
+}
+
+// drawPreview draws the preview image, scaled to fit the preview box, with the
+// selected region outlined on top of it.
+func drawPreview(baseDraw func()) {
+	baseDraw()
+
+	if previewImg == nil {
+		return
+	}
+
+	bounds := Pos{X: previewBox.X() + 2, Y: previewBox.Y() + 2, W: previewBox.W() - 4, H: previewBox.H() - 4}
+	previewImgPos = fitRect(previewImg.DataW(), previewImg.DataH(), bounds)
+	previewImg.Scale(previewImgPos.W, previewImgPos.H, false, true)
+	previewImg.Draw(previewImgPos.X, previewImgPos.Y, previewImgPos.W, previewImgPos.H)
+
+	r := previewSelection.Normalize()
+	x := previewImgPos.X + int(r.X0*float64(previewImgPos.W))
+	y := previewImgPos.Y + int(r.Y0*float64(previewImgPos.H))
+	w := max(int((r.X1-r.X0)*float64(previewImgPos.W)), 1)
+	h := max(int((r.Y1-r.Y0)*float64(previewImgPos.H)), 1)
+
+	fltk.SetDrawColor(fltk.RED)
+	fltk.SetLineStyle(fltk.DASH, 2)
+	fltk.DrawRect(x, y, w, h)
+	fltk.SetLineStyle(fltk.SOLID, 0)
+}
+
+// previewEventPoint returns the position of the mouse as fractions of the
+// preview image's width and height.
+func previewEventPoint() (float64, float64) {
+	if previewImgPos.W <= 0 || previewImgPos.H <= 0 {
+		return 0, 0
+	}
+
+	x := float64(fltk.EventX()-previewImgPos.X) / float64(previewImgPos.W)
+	y := float64(fltk.EventY()-previewImgPos.Y) / float64(previewImgPos.H)
+
+	return clamp01(x), clamp01(y)
+}
+
+// handlePreviewEvent lets the user drag a rectangle on the preview. The region
+// is applied to the device settings once the mouse button is released.
+func handlePreviewEvent(e fltk.Event) bool {
+	if previewImg == nil {
+		return false
+	}
+
+	switch e {
+	case fltk.PUSH:
+		x, y := previewEventPoint()
+		previewSelection = previewRegion{X0: x, Y0: y, X1: x, Y1: y}
+		previewDragging = true
+	case fltk.DRAG:
+		if !previewDragging {
+			return false
+		}
+		previewSelection.X1, previewSelection.Y1 = previewEventPoint()
+	case fltk.RELEASE:
+		if !previewDragging {
+			return false
+		}
+		previewSelection.X1, previewSelection.Y1 = previewEventPoint()
+		previewDragging = false
+		applyPreviewSelection()
+	default:
+		return false
+	}
+
+	previewBox.Redraw()
+
+	return true
+}
+
+// applyPreviewSelection converts the selected region into the geometry
+// settings of the device, so that the next scan only covers that region.
+func applyPreviewSelection() {
+	if previewDevice != appConf.Device {
+		fltk.MessageBox("Error", "The preview was scanned with a different device. Please scan a new preview.")
+		return
+	}
+
+	if previewSelection.Empty() {
+		// a click without a drag; keep the settings as they are
+		previewSelection = geometryToRegion(appConf.DeviceOptions, appConf.DeviceSettings)
+		return
+	}
+
+	geometry, err := regionToGeometry(appConf.DeviceOptions, previewSelection)
+	if err != nil {
+		fltk.MessageBox("Error", fmt.Sprintf("Unable to scan the selected region: %v", err.Error()))
+		return
+	}
+
+	if setDeviceSettings(geometry) {
+		unit := ""
+		if opt, ok := getDeviceOption(appConf.DeviceOptions, "x"); ok {
+			unit = opt.Unit
+		}
+		Logf("will scan a region of %v by %v%v, starting at %v, %v", geometry["x"], geometry["y"], unit, geometry["l"], geometry["t"])
+	}
+}
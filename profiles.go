@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/pwiecz/go-fltk"
+)
+
+// scanProfile is a named set of choices for a kind of scan, such as
+// "Receipts - gray 200dpi PDF", that are applied all at once.
+type scanProfile struct {
+	Name   string
+	Device string
+	// The settings of the device, by option name.
+	DeviceSettings map[string]string
+	// The output directory. Empty keeps the current one.
+	Dir string
+	// Empty keeps the current filename template.
+	FilenameTemplate string
+}
+
+// newProfile returns a profile named name with the device, settings, output
+// directory and filename template of conf.
+func newProfile(name string, conf AppConfig) scanProfile {
+	return scanProfile{
+		Name:             name,
+		Device:           conf.Device,
+		DeviceSettings:   maps.Clone(conf.DeviceSettings),
+		Dir:              conf.SelectedDir,
+		FilenameTemplate: conf.FilenameTemplate,
+	}
+}
+
+// findProfile returns the index of the profile named name, or -1 if there
+// isn't one.
+func findProfile(profiles []scanProfile, name string) int {
+	for i := range profiles {
+		if profiles[i].Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// putProfile returns the profiles with p added to the end, or in place of the
+// profile with the same name.
+func putProfile(profiles []scanProfile, p scanProfile) []scanProfile {
+	i := findProfile(profiles, p.Name)
+	if i < 0 {
+		return append(profiles, p)
+	}
+
+	profiles = append([]scanProfile{}, profiles...)
+	profiles[i] = p
+
+	return profiles
+}
+
+// removeProfile returns the profiles without the one named name.
+func removeProfile(profiles []scanProfile, name string) []scanProfile {
+	i := findProfile(profiles, name)
+	if i < 0 {
+		return profiles
+	}
+
+	return append(append([]scanProfile{}, profiles[:i]...), profiles[i+1:]...)
+}
+
+// getProfileShortcut returns the keyboard shortcut for the profile at index i,
+// which is Alt and the number of the profile, since the numbers alone select
+// devices.
+func getProfileShortcut(i int) int {
+	key := getShortcut(i)
+	if key == 0 {
+		return 0
+	}
+
+	return fltk.ALT | key
+}
+
+// rebuildProfileChoice lists the profiles in the profile dropdown, followed by
+// the actions for saving and deleting them, and selects the profile that was
+// applied last.
+func rebuildProfileChoice() {
+	profileChoice.Clear()
+
+	// each item's action runs once the menu is done with the item, since the
+	// actions rebuild the menu
+	later := func(fn func()) func() {
+		return func() { onUI(fn) }
+	}
+
+	profileChoice.Add("No profile", later(func() {
+		appConf.Profile = ""
+		requestConfigSave()
+		rebuildProfileChoice()
+	}))
+
+	for i, p := range appConf.Profiles {
+		p := p
+		profileChoice.AddEx(menuLabel(p.Name), getProfileShortcut(i), later(func() {
+			applyProfile(p)
+		}), 0)
+	}
+
+	profileChoice.AddEx("Save as profile...", fltk.ALT|'s', later(saveCurrentProfile), 0)
+
+	flags := 0
+	if findProfile(appConf.Profiles, appConf.Profile) < 0 {
+		flags = fltk.MENU_INACTIVE
+	}
+	profileChoice.AddEx("Delete profile", 0, later(deleteCurrentProfile), flags)
+
+	profileChoice.SetValue(findProfile(appConf.Profiles, appConf.Profile) + 1)
+}
+
+// applyProfile switches to the profile's device, settings, output directory
+// and filename template.
+func applyProfile(p scanProfile) {
+	if p.Device != "" {
+		opts, err := backend.DescribeOptions(p.Device, nil)
+		if err != nil {
+			fltk.MessageBox("Error", fmt.Sprintf("Unable to get the options of %v: %v", p.Device, err.Error()))
+			rebuildProfileChoice()
+			return
+		}
+
+		settings, skipped := reconcileDeviceSettings(opts, p.DeviceSettings)
+		if len(skipped) > 0 {
+			Warnf("profile %v: skipped settings that %v doesn't accept: %v", p.Name, p.Device, strings.Join(skipped, ", "))
+		}
+
+		rememberDeviceSettings()
+		appConf.Device = p.Device
+		appConf.DeviceOptions = opts
+		appConf.DeviceSettings = settings
+
+		for i, scanner := range appConf.Scanners {
+			if scanner.Device == p.Device {
+				devicesChoice.SetValue(i)
+			}
+		}
+
+		scanBtn.Activate()
+		previewBtn.Activate()
+	}
+
+	if p.Dir != "" {
+		appConf.SelectedDir = p.Dir
+	}
+	if p.FilenameTemplate != "" {
+		appConf.FilenameTemplate = p.FilenameTemplate
+		fileTmplInput.SetValue(p.FilenameTemplate)
+	}
+
+	appConf.Profile = p.Name
+	Logf("applied profile %v", p.Name)
+
+	requestConfigSave()
+	rebuildProfileChoice()
+	rebuildOptionsPanel()
+	refreshGallery()
+	if p.Device != "" {
+		// the options depend on the settings, such as the resolutions of
+		// each source
+		requestDeviceOptionsRefresh()
+	}
+}
+
+// saveCurrentProfile asks for a name, and saves the current device, settings,
+// output directory and filename template as a profile with that name.
+func saveCurrentProfile() {
+	// the choice shows the action until a profile is selected again
+	rebuildProfileChoice()
+
+	promptText("Save profile", "Name of the profile, such as Receipts - gray 200dpi PDF:", appConf.Profile, func(name string) {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			fltk.MessageBox("Error", "The profile needs a name.")
+			return
+		}
+
+		if findProfile(appConf.Profiles, name) >= 0 && name != appConf.Profile {
+			if fltk.ChoiceDialog(fmt.Sprintf("Replace the profile %v?", name), "Replace", "Cancel") != 0 {
+				return
+			}
+		}
+
+		appConf.Profiles = putProfile(appConf.Profiles, newProfile(name, appConf))
+		appConf.Profile = name
+		Logf("saved profile %v", name)
+
+		requestConfigSave()
+		rebuildProfileChoice()
+	})
+}
+
+// deleteCurrentProfile deletes the profile that was applied last, once the
+// user confirms it.
+func deleteCurrentProfile() {
+	rebuildProfileChoice()
+
+	name := appConf.Profile
+	if findProfile(appConf.Profiles, name) < 0 {
+		return
+	}
+
+	if fltk.ChoiceDialog(fmt.Sprintf("Delete the profile %v?", name), "Delete", "Cancel") != 0 {
+		return
+	}
+
+	appConf.Profiles = removeProfile(appConf.Profiles, name)
+	appConf.Profile = ""
+	Logf("deleted profile %v", name)
+
+	requestConfigSave()
+	rebuildProfileChoice()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestNewProfile(t *testing.T) {
+	conf := AppConfig{
+		Device:           "brother5:bus2;dev1",
+		DeviceSettings:   map[string]string{"mode": "True Gray", "resolution": "200"},
+		SelectedDir:      "/scans/receipts",
+		FilenameTemplate: "receipt-{date}.pdf",
+	}
+
+	p := newProfile("Receipts", conf)
+	if p.Name != "Receipts" || p.Device != conf.Device || p.Dir != conf.SelectedDir || p.FilenameTemplate != conf.FilenameTemplate {
+		t.Errorf("unexpected profile: %+v", p)
+	}
+
+	// changing the settings afterwards doesn't change the profile
+	conf.DeviceSettings["resolution"] = "600"
+	if p.DeviceSettings["resolution"] != "200" {
+		t.Errorf("the profile shares its settings with the config: %v", p.DeviceSettings)
+	}
+}
+
+func TestPutAndRemoveProfile(t *testing.T) {
+	profiles := []scanProfile{}
+	profiles = putProfile(profiles, scanProfile{Name: "Receipts", Dir: "/a"})
+	profiles = putProfile(profiles, scanProfile{Name: "Photos", Dir: "/b"})
+
+	replaced := putProfile(profiles, scanProfile{Name: "Receipts", Dir: "/c"})
+	if len(replaced) != 2 || replaced[0].Dir != "/c" || replaced[1].Name != "Photos" {
+		t.Errorf("replace: got %+v", replaced)
+	}
+	if profiles[0].Dir != "/a" {
+		t.Errorf("replacing a profile changed the original slice: %+v", profiles)
+	}
+
+	if i := findProfile(profiles, "Photos"); i != 1 {
+		t.Errorf("find: got %v, wanted 1", i)
+	}
+	if i := findProfile(profiles, "Missing"); i != -1 {
+		t.Errorf("find missing: got %v, wanted -1", i)
+	}
+
+	removed := removeProfile(profiles, "Receipts")
+	if len(removed) != 1 || removed[0].Name != "Photos" {
+		t.Errorf("remove: got %+v", removed)
+	}
+	if len(profiles) != 2 || profiles[0].Name != "Receipts" {
+		t.Errorf("removing a profile changed the original slice: %+v", profiles)
+	}
+	if got := removeProfile(profiles, "Missing"); len(got) != 2 {
+		t.Errorf("remove missing: got %+v", got)
+	}
+}
+
+func TestProfilesConfig(t *testing.T) {
+	conf := AppConfig{
+		Profiles: []scanProfile{
+			{Name: "Receipts – gray 200dpi PDF", Device: "brother5:bus2;dev1", DeviceSettings: map[string]string{"mode": "True Gray"}, Dir: "/scans", FilenameTemplate: "receipt-{counter}.pdf"},
+		},
+		Profile: "Receipts – gray 200dpi PDF",
+	}
+
+	b, err := yaml.Marshal(conf)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+
+	var got AppConfig
+	err = yaml.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+
+	if len(got.Profiles) != 1 || got.Profiles[0].Name != conf.Profile || got.Profiles[0].DeviceSettings["mode"] != "True Gray" || got.Profiles[0].FilenameTemplate != "receipt-{counter}.pdf" || got.Profile != conf.Profile {
+		t.Errorf("profiles didn't survive the config file: %+v", got)
+	}
+}
+
+func TestGetProfileShortcut(t *testing.T) {
+	if getProfileShortcut(0) == getShortcut(0) || getProfileShortcut(0) == 0 {
+		t.Errorf("the first profile's shortcut clashes with the first device's: %v", getProfileShortcut(0))
+	}
+	if getProfileShortcut(9) != 0 {
+		t.Errorf("only the first nine profiles have shortcuts, got %v", getProfileShortcut(9))
+	}
+}
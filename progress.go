@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// ScanProgress is how far along a scan is, as reported by scanimage.
+type ScanProgress struct {
+	// The page that is being scanned, starting at 1. Single scans only have
+	// one page.
+	Page int
+	// From 0 to 100.
+	Percent float64
+}
+
+var (
+	// scanimage --progress prints "Progress: 42.3%", followed by a carriage
+	// return so that the next one overwrites it in a terminal
+	progressRegexp = regexp.MustCompile(`^Progress: *([0-9]+(?:\.[0-9]+)?)%$`)
+	// batch scans print "Scanning page 2" before each page
+	scanningPageRegexp = regexp.MustCompile(`^Scanning page ([0-9]+)$`)
+)
+
+// parseProgress returns the percentage from a progress line printed by
+// scanimage, such as "Progress: 42.3%".
+func parseProgress(line string) (float64, bool) {
+	m := progressRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return 0, false
+	}
+
+	f, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return min(f, 100), true
+}
+
+// progressWriter is an io.Writer for the stderr of scanimage. Progress lines
+// are reported to onProgress as they stream in, and all other output is kept
+// so that it can still be shown to the user.
+type progressWriter struct {
+	onProgress func(p ScanProgress)
+	page       int
+	line       []byte
+	out        bytes.Buffer
+}
+
+func newProgressWriter(onProgress func(p ScanProgress)) *progressWriter {
+	return &progressWriter{onProgress: onProgress, page: 1}
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b != '\r' && b != '\n' {
+			w.line = append(w.line, b)
+			continue
+		}
+
+		w.endLine(b)
+	}
+
+	return len(p), nil
+}
+
+// endLine handles the line that was ended by the byte b, which is either a
+// carriage return or a newline.
+func (w *progressWriter) endLine(b byte) {
+	line := string(bytes.TrimSpace(w.line))
+	w.line = w.line[:0]
+
+	if pct, ok := parseProgress(line); ok {
+		if w.onProgress != nil {
+			w.onProgress(ScanProgress{Page: w.page, Percent: pct})
+		}
+		return
+	}
+
+	if m := scanningPageRegexp.FindStringSubmatch(line); m != nil {
+		page, err := strconv.Atoi(m[1])
+		if err == nil {
+			w.page = page
+		}
+	}
+
+	if line == "" && b == '\r' {
+		return
+	}
+
+	w.out.WriteString(line)
+	w.out.WriteByte('\n')
+}
+
+// String returns the output that wasn't progress, including any incomplete
+// last line.
+func (w *progressWriter) String() string {
+	if len(w.line) > 0 {
+		w.endLine('\n')
+	}
+
+	return w.out.String()
+}
+
+// etaEstimator estimates how long is left of a page, assuming that the scan
+// proceeds at the same rate that it has so far. The rate is measured from the
+// first progress of the page that it's given, since scanimage often reports
+// the first progress of a page well after the page started.
+type etaEstimator struct {
+	page         int
+	start        time.Time
+	startPercent float64
+}
+
+// Estimate returns the time that is left for the page of p, as of now. It
+// returns false if there isn't enough progress yet to tell.
+func (e *etaEstimator) Estimate(p ScanProgress, now time.Time) (time.Duration, bool) {
+	if p.Page != e.page || e.start.IsZero() {
+		e.page = p.Page
+		e.start = now
+		e.startPercent = p.Percent
+	}
+
+	elapsed := now.Sub(e.start)
+	progressed := p.Percent - e.startPercent
+	if progressed <= 0 || elapsed <= 0 {
+		return 0, false
+	}
+	if p.Percent >= 100 {
+		return 0, true
+	}
+
+	left := time.Duration(float64(elapsed) * (100 - p.Percent) / progressed)
+
+	return left.Round(time.Second), true
+}
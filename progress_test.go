@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseProgress(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected float64
+		ok       bool
+	}{
+		{line: "Progress: 0.0%", expected: 0, ok: true},
+		{line: "Progress: 42.3%", expected: 42.3, ok: true},
+		{line: "Progress: 100%", expected: 100, ok: true},
+		{line: "Progress: 100.4%", expected: 100, ok: true},
+		{line: "Progress: %", ok: false},
+		{line: "Scanning page 1", ok: false},
+		{line: "scanimage: Progress: 12%", ok: false},
+	}
+
+	for _, test := range tests {
+		got, ok := parseProgress(test.line)
+		if ok != test.ok || got != test.expected {
+			t.Errorf("%q: got %v %v, wanted %v %v", test.line, got, ok, test.expected, test.ok)
+		}
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	tests := []struct {
+		sample   string
+		expected []ScanProgress
+		output   string
+	}{
+		{
+			sample: "single",
+			expected: []ScanProgress{
+				{1, 0}, {1, 3.1}, {1, 6.3}, {1, 25}, {1, 50}, {1, 75.2}, {1, 99.9}, {1, 100},
+			},
+			output: "scanimage: rounded value of br-x from 215.9 to 215.88\nscanimage: rounded value of br-y from 355.6 to 355.567\n",
+		},
+		{
+			sample: "batch",
+			expected: []ScanProgress{
+				{1, 0}, {1, 48.4}, {1, 100}, {2, 0}, {2, 51.6}, {2, 100},
+			},
+			output: "Scanning page 1\nScanned page 1. (scanner status = 5)\nScanning page 2\nScanned page 2. (scanner status = 5)\nScanning page 3\nscanimage: sane_start: Document feeder out of documents\nBatch terminated, 2 pages scanned\n",
+		},
+		{
+			sample:   "error",
+			expected: []ScanProgress{{1, 0}, {1, 12.5}},
+			output:   "scanimage: sane_read: Error during device I/O\n",
+		},
+	}
+
+	for _, test := range tests {
+		b, err := os.ReadFile(filepath.Join("testdata", "progress", test.sample+".txt"))
+		if err != nil {
+			t.Fatalf("failed to read sample: %v", err)
+		}
+
+		// the output arrives in arbitrary chunks, so feed it in small ones
+		// that split the lines
+		var got []ScanProgress
+		w := newProgressWriter(func(p ScanProgress) {
+			got = append(got, p)
+		})
+		for len(b) > 0 {
+			n := min(len(b), 7)
+			w.Write(b[:n])
+			b = b[n:]
+		}
+
+		if len(got) != len(test.expected) {
+			t.Fatalf("%v: got %v, wanted %v", test.sample, got, test.expected)
+		}
+		for i := range got {
+			if got[i] != test.expected[i] {
+				t.Errorf("%v: progress %v: got %v, wanted %v", test.sample, i, got[i], test.expected[i])
+			}
+		}
+
+		if out := w.String(); out != test.output {
+			t.Errorf("%v: output mismatch: got %q, wanted %q", test.sample, out, test.output)
+		}
+	}
+}
+
+func TestEtaEstimator(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	e := &etaEstimator{}
+
+	if _, ok := e.Estimate(ScanProgress{1, 0}, start); ok {
+		t.Errorf("expected no estimate without any progress")
+	}
+
+	// a quarter of the page took 10 seconds, so three quarters take 30 more
+	left, ok := e.Estimate(ScanProgress{1, 25}, start.Add(10*time.Second))
+	if !ok || left != 30*time.Second {
+		t.Errorf("got %v %v, wanted %v", left, ok, 30*time.Second)
+	}
+
+	left, ok = e.Estimate(ScanProgress{1, 100}, start.Add(40*time.Second))
+	if !ok || left != 0 {
+		t.Errorf("got %v %v for a finished page, wanted 0", left, ok)
+	}
+
+	// the next page starts over
+	if _, ok := e.Estimate(ScanProgress{2, 10}, start.Add(41*time.Second)); ok {
+		t.Errorf("expected no estimate at the start of the next page")
+	}
+	left, ok = e.Estimate(ScanProgress{2, 50}, start.Add(45*time.Second))
+	if !ok || left != 5*time.Second {
+		t.Errorf("got %v %v, wanted %v", left, ok, 5*time.Second)
+	}
+
+	// the first progress of a page can be well into it, so the rate is only
+	// measured from there: 20% in 10 seconds leaves 10 more for the last 20%
+	if _, ok := e.Estimate(ScanProgress{3, 60}, start.Add(50*time.Second)); ok {
+		t.Errorf("expected no estimate from the first progress of the page")
+	}
+	left, ok = e.Estimate(ScanProgress{3, 80}, start.Add(60*time.Second))
+	if !ok || left != 10*time.Second {
+		t.Errorf("got %v %v, wanted %v", left, ok, 10*time.Second)
+	}
+}
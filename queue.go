@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pwiecz/go-fltk"
+)
+
+// refreshJobsBrowser lists each of the scan jobs in the jobs browser, newest
+// first, keeping the selected job selected.
+func refreshJobsBrowser() {
+	selected := selectedJobID()
+
+	jobsBrowser.Clear()
+
+	all := jobs.Jobs()
+	for i := len(all) - 1; i >= 0; i-- {
+		jobsBrowser.AddWithData(all[i].String(), all[i].ID)
+		if all[i].ID == selected {
+			jobsBrowser.SetValue(jobsBrowser.Size())
+		}
+	}
+
+	_, running := jobs.Running()
+	if running {
+		scanBtn.SetLabel("Queue scan")
+		cancelBtn.Activate()
+	} else {
+		scanBtn.SetLabel("Scan")
+		cancelBtn.Deactivate()
+		progressBar.SetValue(0)
+		progressBar.SetLabel("")
+	}
+}
+
+// getCurrentTemplateVars returns the values of the filename template's tokens
+// for a scan with the current device and settings at the time now.
+func getCurrentTemplateVars(now time.Time) templateVars {
+	return getTemplateVars(now, appConf.Device, appConf.Scanners, appConf.DeviceOptions, appConf.DeviceSettings, max(appConf.FilenameCounter, 1), appConf.FilenameLabel)
+}
+
+// updateFilenamePreview shows the file that a scan would write to right now
+// beneath the filename template, or what is wrong with the template.
+func updateFilenamePreview() {
+	if filenamePreview == nil {
+		return
+	}
+
+	filename, pattern, err := scanFilenames(appConf.FilenameTemplate, "", getCurrentTemplateVars(time.Now()), appConf.BatchScan)
+	if err != nil {
+		filenamePreview.SetLabelColor(fltk.RED)
+		filenamePreview.SetLabel(labelText(err.Error()))
+		filenamePreview.Redraw()
+		return
+	}
+
+	preview := filename
+	if appConf.BatchScan {
+		if pattern == "" {
+			pattern = getBatchPattern(filename)
+		}
+		preview = fmt.Sprintf("%v, %v, ...", getBatchDocument(filename), fmt.Sprintf(pattern, 1))
+	}
+
+	filenamePreview.SetLabelColor(fltk.FOREGROUND_COLOR)
+	filenamePreview.SetLabel(labelText(fmt.Sprintf("Next: %v", preview)))
+	filenamePreview.Redraw()
+}
+
+// The files that the scans that are queued or running will write to, by job ID,
+// so that the next scan doesn't pick the same name before they exist. It
+// belongs to the UI thread.
+var pendingOutputs = make(map[int][]string)
+
+// isOutputTaken returns true if the file exists or an unfinished scan will
+// write to it.
+func isOutputTaken(path string) bool {
+	if fileExists(path) {
+		return true
+	}
+
+	for _, job := range jobs.Jobs() {
+		if job.State.Done() {
+			delete(pendingOutputs, job.ID)
+			continue
+		}
+		for _, p := range pendingOutputs[job.ID] {
+			if p == path {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// resolveCollisions applies the configured collision policy to the request,
+// asking the user what to do if the policy is to ask. Returns false if the
+// scan shouldn't happen.
+func resolveCollisions(req scanRequest) (scanRequest, bool) {
+	policy := getCollisionPolicy(appConf.CollisionPolicy)
+	if policy == CollisionPrompt {
+		path, ok := findCollision(req, isOutputTaken)
+		if !ok {
+			return req, true
+		}
+
+		switch fltk.ChoiceDialog(fmt.Sprintf("%v already exists. Do you want to keep both files or replace it?", path), "Keep both", "Replace", "Cancel") {
+		case 0:
+			policy = CollisionSuffix
+		case 1:
+			policy = CollisionOverwrite
+		default:
+			Logf("cancelled scan because %v already exists", path)
+			return req, false
+		}
+	}
+
+	r, err := applyCollisionPolicy(req, policy, isOutputTaken)
+	if err != nil {
+		fltk.MessageBox("Error", err.Error())
+		return req, false
+	}
+
+	return r, true
+}
+
+// submitScan queues the scan, and adds the files that it writes to the
+// gallery as they are written.
+func submitScan(req scanRequest) error {
+	job, err := jobs.Submit(req.Filename, func(ctx context.Context) error {
+		if req.Batch {
+			Logf("scanning all pages in the document feeder to %v...", req.Filename)
+		} else {
+			Logf("scanning to %v...", req.Filename)
+		}
+
+		result, err := performScan(ctx, req, func(page int, filename string) {
+			Logf("scanned page %v to %v", page, filename)
+			onUI(func() {
+				addScannedFile(filename, nil)
+			})
+		}, newProgressReporter())
+		if result.Output != "" {
+			Log(result.Output)
+		}
+		if ctx.Err() != nil {
+			Logf("cancelled scan to %v", req.Filename)
+			return ctx.Err()
+		}
+		if err != nil {
+			Errorf("failed to scan to %v: %v", req.Filename, err.Error())
+			showError(err.Error())
+			return err
+		}
+
+		switch {
+		case req.Batch:
+			Logf("successfully combined %v pages into %v", len(result.Pages), result.File)
+		case result.Appended:
+			Logf("successfully appended scanned page to %v", result.File)
+		default:
+			Logf("successfully wrote scanned image/document to %v", result.File)
+		}
+
+		// only single scans can be replaced by scanning them again; batch
+		// scans and appended pages would add more pages instead
+		var rescan *scanRequest
+		if !req.Batch && !result.Appended {
+			r := req
+			r.AppendPDF = false
+			rescan = &r
+		}
+		onUI(func() {
+			addScannedFile(result.File, rescan)
+		})
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	pendingOutputs[job.ID] = getScanOutputs(req)
+	Logf("queued scan #%v to %v", job.ID, req.Filename)
+
+	return nil
+}
+
+// selectedJobID returns the ID of the job that is selected in the jobs
+// browser, or 0 if none are selected.
+func selectedJobID() int {
+	line := jobsBrowser.Value()
+	if line <= 0 {
+		return 0
+	}
+
+	id, ok := jobsBrowser.Data(line).(int)
+	if !ok {
+		return 0
+	}
+
+	return id
+}
+
+// cancelJob cancels the job that is selected in the jobs browser, or the
+// running job if no unfinished job is selected.
+func cancelJob() {
+	id := selectedJobID()
+
+	for _, job := range jobs.Jobs() {
+		if job.ID == id && job.State.Done() {
+			id = 0
+		}
+	}
+
+	if id == 0 {
+		job, ok := jobs.Running()
+		if !ok {
+			return
+		}
+		id = job.ID
+	}
+
+	err := jobs.Cancel(id)
+	if err != nil {
+		Errorf("unable to cancel the scan: %v", err.Error())
+		return
+	}
+
+	Log(fmt.Sprintf("cancelling scan #%v...", id))
+}
+
+// How often, in percent, the progress of a page is written to the activity
+// log. The progress bar is updated for every step.
+const PROGRESS_LOG_STEP = 25
+
+// newProgressReporter returns a function that shows the progress of a scan in
+// the progress bar, and writes it to the activity log along with an estimate
+// of the time that is left. It is called from the goroutine of the scan job.
+func newProgressReporter() func(p ScanProgress) {
+	eta := &etaEstimator{}
+	page, logged := 0, -1
+
+	// scanimage reports progress far more often than the bar can be redrawn,
+	// so only the latest progress is handed over to the UI thread
+	var mu sync.Mutex
+	var label string
+	var percent float64
+	var pending atomic.Bool
+
+	return func(p ScanProgress) {
+		status := fmt.Sprintf("%.0f%%", p.Percent)
+		if left, ok := eta.Estimate(p, time.Now()); ok && p.Percent < 100 {
+			status = fmt.Sprintf("%v, about %v left", status, left)
+		}
+
+		if p.Page != page {
+			page, logged = p.Page, -1
+		}
+		if step := int(p.Percent) / PROGRESS_LOG_STEP; step > logged {
+			logged = step
+			Logf("page %v: %v", p.Page, status)
+		}
+
+		mu.Lock()
+		label = fmt.Sprintf("Page %v: %v", p.Page, status)
+		percent = p.Percent
+		mu.Unlock()
+
+		if !pending.CompareAndSwap(false, true) {
+			return
+		}
+
+		onUI(func() {
+			pending.Store(false)
+			mu.Lock()
+			defer mu.Unlock()
+			progressBar.SetValue(percent)
+			progressBar.SetLabel(label)
+		})
+	}
+}
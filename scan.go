@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// scanRequest describes a scan, as chosen by the user at the moment they asked
+// for it. The settings are a copy, so that changing them afterwards doesn't
+// affect scans that are queued.
+type scanRequest struct {
+	Filename string
+	Device   string
+	Settings map[string]string
+	Layout   pdfLayout
+	// Scan every page in the document feeder.
+	Batch bool
+	// The scanimage --batch pattern for the pages of batch scans, such as
+	// "/scans/doc-%d.png". If empty, the pages are named after Filename.
+	PagePattern string
+	// Add the pages to the end of the PDF, if it already exists.
+	AppendPDF bool
+}
+
+// scanResult is the outcome of a scanRequest. It is printed by the scan
+// command when -json is provided.
+type scanResult struct {
+	// The document or image that was written.
+	File string
+	// The files of the individual pages, for batch scans.
+	Pages []string `json:",omitempty"`
+	// Whether the pages were added to the end of an existing PDF.
+	Appended bool `json:",omitempty"`
+	Output   string
+}
+
+// performScan scans according to the request: every page in the document
+// feeder for batch scans, a page that is added to a PDF for PDF files, or
+// otherwise a single image. onPage is called as each page of a batch scan is
+// written, and onProgress as each page progresses. The directories of the
+// files are created if needed. The scan is stopped if ctx is cancelled.
+func performScan(ctx context.Context, req scanRequest, onPage func(page int, filename string), onProgress func(p ScanProgress)) (scanResult, error) {
+	ext := getFileType(req.Filename)
+	if ext == "" {
+		return scanResult{}, fmt.Errorf("only png, jpg, and pdf formats are supported")
+	}
+
+	// filename templates may put scans in subdirectories of the output
+	// directory, such as "{label}/{date}.pdf"
+	dirs := []string{filepath.Dir(req.Filename)}
+	if req.PagePattern != "" {
+		dirs = append(dirs, filepath.Dir(req.PagePattern))
+	}
+	for _, dir := range dirs {
+		err := os.MkdirAll(dir, 0o755)
+		if err != nil {
+			return scanResult{}, fmt.Errorf("failed to create directory %v: %w", dir, err)
+		}
+	}
+
+	if req.Batch {
+		pages, doc, out, err := scanBatchDocument(ctx, req.Filename, req.PagePattern, req.Settings, req.Device, req.Layout, req.AppendPDF, onPage, onProgress)
+		if err != nil {
+			return scanResult{Pages: pages, Output: out}, fmt.Errorf("failed to scan pages to %v after %v pages: %w", req.Filename, len(pages), err)
+		}
+
+		return scanResult{File: doc, Pages: pages, Output: out}, nil
+	}
+
+	if ext == ".pdf" {
+		appended, out, err := scanPDF(ctx, req.Filename, req.Settings, req.Device, req.Layout, req.AppendPDF, onProgress)
+		if err != nil {
+			return scanResult{Output: out}, fmt.Errorf("failed to scan to file %v: %w", req.Filename, err)
+		}
+
+		return scanResult{File: req.Filename, Appended: appended, Output: out}, nil
+	}
+
+	out, err := backend.Scan(ctx, req.Filename, req.Settings, strings.TrimPrefix(ext, "."), req.Device, onProgress)
+	if err != nil {
+		return scanResult{Output: out}, fmt.Errorf("failed to scan to file %v: %w", req.Filename, err)
+	}
+
+	return scanResult{File: req.Filename, Output: out}, nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The template that filenames are expanded from when none is configured.
+const DEFAULT_FILENAME_TEMPLATE = "scanned-doc-%t.png"
+
+// FILENAME_TEMPLATE_HELP describes the tokens of filename templates to users.
+const FILENAME_TEMPLATE_HELP = `{date} 2006-01-02, {time} 15-04-05, {date:YYYYMMDD-hhmmss} custom date and time,
+{unix} or %t unix epoch seconds, {counter} or {counter:4} a number that goes up with each scan,
+{page} or {page:3} the page within a batch scan, {model} the device's model,
+{resolution}, {mode}, {label} the label below, {{ and }} for literal braces`
+
+// templateVars are the values that the tokens of a filename template expand
+// to.
+type templateVars struct {
+	Time time.Time
+	// The number of the scan, which is persisted so that it keeps going up
+	// across runs.
+	Counter int
+	// The page within a batch scan, starting at 1. 0 leaves the page out,
+	// such as for the document that the pages are combined into.
+	Page       int
+	Model      string
+	Resolution string
+	Mode       string
+	// Entered by the user, such as "receipts".
+	Label string
+}
+
+// getTemplateVars returns the values of the tokens for a scan with the device
+// and settings at the time now. The device's model is looked up in scanners.
+func getTemplateVars(now time.Time, dev string, scanners []ScannerDevice, opts []DeviceOption, settings map[string]string, counter int, label string) templateVars {
+	vars := templateVars{
+		Time:       now,
+		Counter:    counter,
+		Resolution: getSettingOrCurrent(opts, settings, "resolution"),
+		Mode:       getSettingOrCurrent(opts, settings, "mode"),
+		Label:      label,
+	}
+
+	for _, scanner := range scanners {
+		if scanner.Device == dev {
+			vars.Model = scanner.Model
+		}
+	}
+
+	return vars
+}
+
+// templatePart is either literal text or a token, such as {date:YYYYMMDD}.
+type templatePart struct {
+	Literal string
+	// The name of the token, such as "date", or empty for literal text.
+	Token string
+	// What follows the colon in the token, such as "YYYYMMDD".
+	Arg string
+}
+
+// filenameTemplate is a parsed filename template, such as
+// "{label}-{date}-{counter:4}.pdf".
+type filenameTemplate struct {
+	parts []templatePart
+}
+
+// The tokens that filename templates accept, and whether they accept an
+// argument.
+var templateTokens = map[string]bool{
+	"date":       true,
+	"time":       true,
+	"unix":       false,
+	"counter":    true,
+	"page":       true,
+	"model":      false,
+	"resolution": false,
+	"mode":       false,
+	"label":      false,
+}
+
+// parseFilenameTemplate parses a filename template. Returns an error for
+// unknown tokens and unbalanced braces, so that mistakes are caught before
+// anything is scanned.
+func parseFilenameTemplate(s string) (filenameTemplate, error) {
+	t := filenameTemplate{}
+	var literal strings.Builder
+
+	flush := func() {
+		if literal.Len() > 0 {
+			t.parts = append(t.parts, templatePart{Literal: literal.String()})
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "{{"), strings.HasPrefix(s[i:], "}}"):
+			literal.WriteByte(s[i])
+			i++
+		case strings.HasPrefix(s[i:], "%t"):
+			// the original token for unix epoch seconds
+			flush()
+			t.parts = append(t.parts, templatePart{Token: "unix"})
+			i++
+		case s[i] == '}':
+			return t, fmt.Errorf("unexpected } at position %v; use }} for a literal brace", i+1)
+		case s[i] == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return t, fmt.Errorf("the { at position %v is never closed; use {{ for a literal brace", i+1)
+			}
+
+			name, arg, hasArg := strings.Cut(s[i+1:i+end], ":")
+			takesArg, ok := templateTokens[name]
+			if !ok {
+				return t, fmt.Errorf("unknown token {%v}", s[i+1:i+end])
+			}
+			if hasArg && !takesArg {
+				return t, fmt.Errorf("{%v} doesn't take a format", name)
+			}
+			if hasArg && (name == "counter" || name == "page") {
+				width, err := strconv.Atoi(arg)
+				if err != nil || width < 1 || width > 9 {
+					return t, fmt.Errorf("the width of {%v} must be from 1 to 9, got %v", name, arg)
+				}
+			}
+
+			flush()
+			t.parts = append(t.parts, templatePart{Token: name, Arg: arg})
+			i += end
+		default:
+			literal.WriteByte(s[i])
+		}
+	}
+
+	flush()
+
+	return t, nil
+}
+
+// Uses returns true if the template has the token, such as "counter".
+func (t filenameTemplate) Uses(token string) bool {
+	for _, p := range t.parts {
+		if p.Token == token {
+			return true
+		}
+	}
+
+	return false
+}
+
+// formatTemplateTime formats t according to a format made of YYYY, YY, MM, DD,
+// hh, mm and ss, such as "YYYYMMDD-hhmmss". Other characters are kept as they
+// are.
+func formatTemplateTime(t time.Time, format string) string {
+	r := strings.NewReplacer(
+		"YYYY", fmt.Sprintf("%04d", t.Year()),
+		"YY", fmt.Sprintf("%02d", t.Year()%100),
+		"MM", fmt.Sprintf("%02d", int(t.Month())),
+		"DD", fmt.Sprintf("%02d", t.Day()),
+		"hh", fmt.Sprintf("%02d", t.Hour()),
+		"mm", fmt.Sprintf("%02d", t.Minute()),
+		"ss", fmt.Sprintf("%02d", t.Second()),
+	)
+
+	return r.Replace(format)
+}
+
+// sanitizeFilenamePart replaces the characters that aren't allowed in file
+// names on common filesystems, so that values such as a device's model can't
+// add directories or break the file name.
+func sanitizeFilenamePart(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(s))
+
+	if s == "." || s == ".." {
+		return "_"
+	}
+
+	return s
+}
+
+// padNumber formats n with at least as many digits as arg, which is the
+// argument of a token such as {counter:4}.
+func padNumber(n int, arg string) string {
+	width, err := strconv.Atoi(arg)
+	if err != nil {
+		width = 1
+	}
+
+	return fmt.Sprintf("%0*d", width, n)
+}
+
+// expandToken returns the value of the token.
+func expandToken(p templatePart, vars templateVars) string {
+	switch p.Token {
+	case "date":
+		if p.Arg == "" {
+			return formatTemplateTime(vars.Time, "YYYY-MM-DD")
+		}
+		return sanitizeFilenamePart(formatTemplateTime(vars.Time, p.Arg))
+	case "time":
+		if p.Arg == "" {
+			return formatTemplateTime(vars.Time, "hh-mm-ss")
+		}
+		return sanitizeFilenamePart(formatTemplateTime(vars.Time, p.Arg))
+	case "unix":
+		return strconv.FormatInt(vars.Time.Unix(), 10)
+	case "counter":
+		return padNumber(vars.Counter, p.Arg)
+	case "page":
+		if vars.Page == 0 {
+			return ""
+		}
+		return padNumber(vars.Page, p.Arg)
+	case "model":
+		return sanitizeFilenamePart(vars.Model)
+	case "resolution":
+		return sanitizeFilenamePart(vars.Resolution)
+	case "mode":
+		return sanitizeFilenamePart(vars.Mode)
+	case "label":
+		return sanitizeFilenamePart(vars.Label)
+	}
+
+	return ""
+}
+
+// expand writes the template with its tokens expanded. If pattern is true, the
+// result is a printf pattern for scanimage --batch: {page} becomes a %d verb
+// and any other % is escaped.
+func (t filenameTemplate) expand(vars templateVars, pattern bool) string {
+	var b strings.Builder
+
+	escape := func(s string) string {
+		if pattern {
+			return strings.ReplaceAll(s, "%", "%%")
+		}
+		return s
+	}
+
+	for _, p := range t.parts {
+		switch {
+		case p.Token == "":
+			b.WriteString(escape(p.Literal))
+		case p.Token == "page" && pattern:
+			if p.Arg == "" {
+				b.WriteString("%d")
+			} else {
+				fmt.Fprintf(&b, "%%0%vd", p.Arg)
+			}
+		case p.Token == "page" && vars.Page == 0:
+			// leave out the separator before the page too, so that
+			// "doc-{page}.pdf" becomes "doc.pdf" rather than "doc-.pdf"
+			s := b.String()
+			if strings.HasSuffix(s, "-") || strings.HasSuffix(s, "_") || strings.HasSuffix(s, " ") || strings.HasSuffix(s, ".") {
+				b.Reset()
+				b.WriteString(s[:len(s)-1])
+			}
+		default:
+			b.WriteString(escape(expandToken(p, vars)))
+		}
+	}
+
+	return b.String()
+}
+
+// Expand returns the file name that the template expands to.
+func (t filenameTemplate) Expand(vars templateVars) string {
+	return t.expand(vars, false)
+}
+
+// expandFilenameTemplate parses the template and expands it.
+func expandFilenameTemplate(tmpl string, vars templateVars) (string, error) {
+	t, err := parseFilenameTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	return t.Expand(vars), nil
+}
+
+// nextFilenameCounter returns the value of {counter} for the scan after one
+// that was named with the template and counter. It only goes up if the
+// template uses it.
+func nextFilenameCounter(tmpl string, counter int) int {
+	t, err := parseFilenameTemplate(tmpl)
+	if err != nil || !t.Uses("counter") {
+		return counter
+	}
+
+	return counter + 1
+}
+
+// scanFilenames expands the template into the file that a scan writes to,
+// within dir. For batch scans whose template has a {page} token, it also
+// returns the scanimage --batch pattern for the pages; otherwise the pattern
+// is empty, and the pages are named after the file. Returns an error if the
+// template is invalid or doesn't expand to a supported file within dir.
+func scanFilenames(tmpl string, dir string, vars templateVars, batch bool) (string, string, error) {
+	t, err := parseFilenameTemplate(tmpl)
+	if err != nil {
+		return "", "", err
+	}
+
+	vars.Page = 1
+	pattern := ""
+	if batch && t.Uses("page") {
+		vars.Page = 0
+		pattern = t.expand(vars, true)
+
+		ext := filepath.Ext(pattern)
+		pattern, err = joinOutputPath(dir, strings.TrimSuffix(pattern, ext)+getBatchPageExt(strings.ToLower(ext)))
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	name := t.Expand(vars)
+	if getFileType(name) == "" {
+		return "", "", fmt.Errorf("%v: only png, jpg, and pdf formats are supported", name)
+	}
+	if strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)) == "" {
+		return "", "", fmt.Errorf("%v: the file name is empty", name)
+	}
+
+	path, err := joinOutputPath(dir, name)
+	if err != nil {
+		return "", "", err
+	}
+
+	return path, pattern, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseFilenameTemplate(t *testing.T) {
+	tests := []struct {
+		tmpl    string
+		wantErr bool
+	}{
+		{tmpl: "scanned-doc-%t.png"},
+		{tmpl: "{label}-{date}-{counter:4}.pdf"},
+		{tmpl: "{{braces}}.png"},
+		{tmpl: "{bogus}.png", wantErr: true},
+		{tmpl: "{date.png", wantErr: true},
+		{tmpl: "date}.png", wantErr: true},
+		{tmpl: "{counter:x}.png", wantErr: true},
+		{tmpl: "{page:0}.png", wantErr: true},
+		{tmpl: "{label:5}.png", wantErr: true},
+	}
+
+	for _, test := range tests {
+		_, err := parseFilenameTemplate(test.tmpl)
+		if test.wantErr && err == nil {
+			t.Errorf("%v: expected an error but got nil", test.tmpl)
+		}
+		if !test.wantErr && err != nil {
+			t.Errorf("%v: unexpected error: %v", test.tmpl, err)
+		}
+	}
+}
+
+func TestExpandFilenameTemplate(t *testing.T) {
+	vars := templateVars{
+		Time:       time.Date(2026, time.March, 4, 5, 6, 7, 0, time.UTC),
+		Counter:    7,
+		Page:       2,
+		Model:      "MFC-J4335DW / ADF",
+		Resolution: "300",
+		Mode:       "True Gray",
+		Label:      "tax: 2025?",
+	}
+
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{tmpl: "scanned-doc-%t.png", expected: "scanned-doc-1772600767.png"},
+		{tmpl: "{unix}.png", expected: "1772600767.png"},
+		{tmpl: "{date}_{time}.png", expected: "2026-03-04_05-06-07.png"},
+		{tmpl: "{date:YYYYMMDD-hhmmss}.png", expected: "20260304-050607.png"},
+		{tmpl: "{time:YY.MM.DD hh:mm}.png", expected: "26.03.04 05_06.png"},
+		{tmpl: "scan-{counter}.png", expected: "scan-7.png"},
+		{tmpl: "scan-{counter:4}-{page:2}.png", expected: "scan-0007-02.png"},
+		{tmpl: "{model}.jpg", expected: "MFC-J4335DW _ ADF.jpg"},
+		{tmpl: "{resolution}dpi-{mode}.png", expected: "300dpi-True Gray.png"},
+		{tmpl: "{label}.pdf", expected: "tax_ 2025_.pdf"},
+		{tmpl: "{{label}}.png", expected: "{label}.png"},
+		{tmpl: "100%.png", expected: "100%.png"},
+	}
+
+	for _, test := range tests {
+		got, err := expandFilenameTemplate(test.tmpl, vars)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.tmpl, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("%v: got %q, wanted %q", test.tmpl, got, test.expected)
+		}
+	}
+
+	// tokens can't add directories, even with unusual values
+	got, _ := expandFilenameTemplate("{label}.png", templateVars{Label: ".."})
+	if got != "_.png" {
+		t.Errorf("dot dot label: got %q", got)
+	}
+}
+
+func TestScanFilenames(t *testing.T) {
+	vars := templateVars{Time: time.Unix(1700000000, 0), Counter: 3, Label: "100%"}
+
+	tests := []struct {
+		tmpl     string
+		batch    bool
+		filename string
+		pattern  string
+		wantErr  bool
+	}{
+		{tmpl: "doc-%t.png", filename: "/scans/doc-1700000000.png"},
+		{tmpl: "doc-{page}.png", filename: "/scans/doc-1.png"},
+		{tmpl: "doc-%t.png", batch: true, filename: "/scans/doc-1700000000.png"},
+		{tmpl: "doc-{page}.pdf", batch: true, filename: "/scans/doc.pdf", pattern: "/scans/doc-%d.png"},
+		{tmpl: "{label}_{counter}_p{page:3}.jpg", batch: true, filename: "/scans/100%_3_p.jpg", pattern: "/scans/100%%_3_p%03d.jpg"},
+		{tmpl: "{page}.png", batch: true, wantErr: true},
+		{tmpl: "doc.tiff", wantErr: true},
+		{tmpl: "{doc}.png", wantErr: true},
+	}
+
+	for _, test := range tests {
+		filename, pattern, err := scanFilenames(test.tmpl, "/scans", vars, test.batch)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%v: expected an error but got %v", test.tmpl, filename)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.tmpl, err)
+			continue
+		}
+
+		if filename != filepath.FromSlash(test.filename) {
+			t.Errorf("%v: filename mismatch: got %v, wanted %v", test.tmpl, filename, test.filename)
+		}
+		if pattern != filepath.FromSlash(test.pattern) {
+			t.Errorf("%v: pattern mismatch: got %v, wanted %v", test.tmpl, pattern, test.pattern)
+		}
+	}
+}
+
+func TestNextFilenameCounter(t *testing.T) {
+	if got := nextFilenameCounter("scan-{counter:3}.png", 9); got != 10 {
+		t.Errorf("with counter: got %v, wanted 10", got)
+	}
+	if got := nextFilenameCounter("scan-%t.png", 9); got != 9 {
+		t.Errorf("without counter: got %v, wanted 9", got)
+	}
+}
+
+func TestPerformScanPagePattern(t *testing.T) {
+	useFakeBackend(t, "")
+	t.Setenv("FAKE_SCANIMAGE_PAGES", "2")
+
+	dir := t.TempDir()
+	filename, pattern, err := scanFilenames("receipt-{page:2}.pdf", dir, templateVars{}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result, err := performScan(context.Background(), scanRequest{Filename: filename, PagePattern: pattern, Device: "brother5:bus2;dev1", Batch: true}, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.File != filepath.Join(dir, "receipt.pdf") {
+		t.Errorf("document mismatch: got %v", result.File)
+	}
+	expected := []string{filepath.Join(dir, "receipt-01.png"), filepath.Join(dir, "receipt-02.png")}
+	if len(result.Pages) != len(expected) || result.Pages[0] != expected[0] || result.Pages[1] != expected[1] {
+		t.Errorf("pages mismatch: got %v, wanted %v", result.Pages, expected)
+	}
+}
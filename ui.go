@@ -10,9 +10,9 @@ import (
 // accordingly.
 const (
 	WIDTH_PORTRAIT   = 100
-	HEIGHT_PORTRAIT  = 150
+	HEIGHT_PORTRAIT  = 180
 	WIDTH_LANDSCAPE  = 150
-	HEIGHT_LANDSCAPE = 100
+	HEIGHT_LANDSCAPE = 125
 )
 
 // Positioning (x,y,w,h) for fltk elements
@@ -66,40 +66,114 @@ func responsive(win *fltk.Window) {
 	}
 
 	getDevsBtnPos := Pos{X: 5, Y: 85, W: 35, H: 10}
-	directoryBtnPos := Pos{X: 45, Y: 85, W: 50, H: 10}
-	scanBtnPos := Pos{X: 100, Y: 85, W: 45, H: 10}
-	devicesChoicePos := Pos{X: 5, Y: 5, W: 140, H: 15}
-	optsChoicePos := Pos{X: 5, Y: 25, W: 60, H: 15}
-	constChoicePos := Pos{X: 75, Y: 25, W: 70, H: 15}
-	fileTmplInputPos := Pos{X: 5, Y: 45, W: 140, H: 10}
-	activityPos := Pos{X: 5, Y: 60, W: 140, H: 20}
+	directoryBtnPos := Pos{X: 42, Y: 85, W: 33, H: 10}
+	previewBtnPos := Pos{X: 80, Y: 85, W: 18, H: 10}
+	scanBtnPos := Pos{X: 100, Y: 85, W: 25, H: 10}
+	cancelBtnPos := Pos{X: 127, Y: 85, W: 18, H: 10}
+	devicesChoicePos := Pos{X: 5, Y: 5, W: 95, H: 10}
+	profileChoicePos := Pos{X: 102, Y: 5, W: 43, H: 10}
+	advancedCheckPos := Pos{X: 5, Y: 17, W: 35, H: 6}
+	batchCheckPos := Pos{X: 40, Y: 17, W: 35, H: 6}
+	optionsScrollPos := Pos{X: 5, Y: 25, W: 70, H: 55}
+	fileTmplInputPos := Pos{X: 80, Y: 16, W: 65, H: 7}
+	filenamePreviewPos := Pos{X: 80, Y: 23, W: 65, H: 5}
+	labelInputPos := Pos{X: 92, Y: 29, W: 23, H: 7}
+	collisionChoicePos := Pos{X: 117, Y: 29, W: 28, H: 7}
+	pageSizeChoicePos := Pos{X: 80, Y: 37, W: 30, H: 7}
+	appendCheckPos := Pos{X: 112, Y: 37, W: 33, H: 7}
+	activityPos := Pos{X: 80, Y: 45, W: 65, H: 14}
+	activityMenuBtnPos := Pos{X: 124, Y: 60, W: 21, H: 7}
+	progressBarPos := Pos{X: 80, Y: 61, W: 42, H: 5}
+	jobsBrowserPos := Pos{X: 80, Y: 68, W: 65, H: 12}
+	galleryScrollPos := Pos{X: 5, Y: 98, W: 95, H: 24}
+	galleryOpenBtnPos := Pos{X: 102, Y: 98, W: 21, H: 7}
+	galleryRenameBtnPos := Pos{X: 124, Y: 98, W: 21, H: 7}
+	galleryDeleteBtnPos := Pos{X: 102, Y: 106, W: 21, H: 7}
+	galleryRescanBtnPos := Pos{X: 124, Y: 106, W: 21, H: 7}
+	galleryDirCheckPos := Pos{X: 102, Y: 114, W: 43, H: 8}
 
 	if portrait {
-		getDevsBtnPos = Pos{X: 5, Y: 105, W: 90, H: 10}
+		getDevsBtnPos = Pos{X: 5, Y: 105, W: 44, H: 10}
+		previewBtnPos = Pos{X: 51, Y: 105, W: 44, H: 10}
 		directoryBtnPos = Pos{X: 5, Y: 120, W: 90, H: 10}
-		scanBtnPos = Pos{X: 5, Y: 135, W: 90, H: 10}
-		devicesChoicePos = Pos{X: 5, Y: 5, W: 90, H: 15}
-		optsChoicePos = Pos{X: 5, Y: 25, W: 90, H: 15}
-		constChoicePos = Pos{X: 5, Y: 45, W: 90, H: 15}
-		fileTmplInputPos = Pos{X: 5, Y: 65, W: 90, H: 10}
-		activityPos = Pos{X: 5, Y: 80, W: 90, H: 20}
+		scanBtnPos = Pos{X: 5, Y: 135, W: 60, H: 10}
+		cancelBtnPos = Pos{X: 67, Y: 135, W: 28, H: 10}
+		devicesChoicePos = Pos{X: 5, Y: 5, W: 58, H: 10}
+		profileChoicePos = Pos{X: 65, Y: 5, W: 30, H: 10}
+		advancedCheckPos = Pos{X: 5, Y: 17, W: 45, H: 6}
+		batchCheckPos = Pos{X: 50, Y: 17, W: 45, H: 6}
+		optionsScrollPos = Pos{X: 5, Y: 25, W: 90, H: 33}
+		fileTmplInputPos = Pos{X: 5, Y: 60, W: 90, H: 7}
+		filenamePreviewPos = Pos{X: 5, Y: 67, W: 90, H: 4}
+		labelInputPos = Pos{X: 20, Y: 72, W: 35, H: 6}
+		collisionChoicePos = Pos{X: 57, Y: 72, W: 38, H: 6}
+		pageSizeChoicePos = Pos{X: 5, Y: 79, W: 40, H: 6}
+		appendCheckPos = Pos{X: 50, Y: 79, W: 45, H: 6}
+		activityPos = Pos{X: 5, Y: 86, W: 70, H: 8}
+		activityMenuBtnPos = Pos{X: 77, Y: 86, W: 18, H: 8}
+		progressBarPos = Pos{X: 5, Y: 95, W: 90, H: 3}
+		jobsBrowserPos = Pos{X: 5, Y: 99, W: 90, H: 5}
+		galleryScrollPos = Pos{X: 5, Y: 148, W: 90, H: 20}
+		galleryOpenBtnPos = Pos{X: 5, Y: 170, W: 17, H: 7}
+		galleryRenameBtnPos = Pos{X: 23, Y: 170, W: 17, H: 7}
+		galleryDeleteBtnPos = Pos{X: 41, Y: 170, W: 17, H: 7}
+		galleryRescanBtnPos = Pos{X: 59, Y: 170, W: 17, H: 7}
+		galleryDirCheckPos = Pos{X: 77, Y: 170, W: 18, H: 7}
 	}
 
 	getDevsBtnPos.Translate(winW, winH)
 	directoryBtnPos.Translate(winW, winH)
+	previewBtnPos.Translate(winW, winH)
 	scanBtnPos.Translate(winW, winH)
+	cancelBtnPos.Translate(winW, winH)
 	devicesChoicePos.Translate(winW, winH)
-	optsChoicePos.Translate(winW, winH)
-	constChoicePos.Translate(winW, winH)
+	profileChoicePos.Translate(winW, winH)
+	advancedCheckPos.Translate(winW, winH)
+	batchCheckPos.Translate(winW, winH)
+	optionsScrollPos.Translate(winW, winH)
 	fileTmplInputPos.Translate(winW, winH)
+	filenamePreviewPos.Translate(winW, winH)
+	labelInputPos.Translate(winW, winH)
+	collisionChoicePos.Translate(winW, winH)
+	pageSizeChoicePos.Translate(winW, winH)
+	appendCheckPos.Translate(winW, winH)
 	activityPos.Translate(winW, winH)
+	activityMenuBtnPos.Translate(winW, winH)
+	progressBarPos.Translate(winW, winH)
+	jobsBrowserPos.Translate(winW, winH)
+	galleryScrollPos.Translate(winW, winH)
+	galleryOpenBtnPos.Translate(winW, winH)
+	galleryRenameBtnPos.Translate(winW, winH)
+	galleryDeleteBtnPos.Translate(winW, winH)
+	galleryRescanBtnPos.Translate(winW, winH)
+	galleryDirCheckPos.Translate(winW, winH)
 
 	getDevicesBtn.Resize(getDevsBtnPos.X, getDevsBtnPos.Y, getDevsBtnPos.W, getDevsBtnPos.H)
 	directoryBtn.Resize(directoryBtnPos.X, directoryBtnPos.Y, directoryBtnPos.W, directoryBtnPos.H)
+	previewBtn.Resize(previewBtnPos.X, previewBtnPos.Y, previewBtnPos.W, previewBtnPos.H)
 	scanBtn.Resize(scanBtnPos.X, scanBtnPos.Y, scanBtnPos.W, scanBtnPos.H)
+	cancelBtn.Resize(cancelBtnPos.X, cancelBtnPos.Y, cancelBtnPos.W, cancelBtnPos.H)
 	devicesChoice.Resize(devicesChoicePos.X, devicesChoicePos.Y, devicesChoicePos.W, devicesChoicePos.H)
-	optChoice.Resize(optsChoicePos.X, optsChoicePos.Y, optsChoicePos.W, optsChoicePos.H)
-	constChoice.Resize(constChoicePos.X, constChoicePos.Y, constChoicePos.W, constChoicePos.H)
+	profileChoice.Resize(profileChoicePos.X, profileChoicePos.Y, profileChoicePos.W, profileChoicePos.H)
+	advancedCheck.Resize(advancedCheckPos.X, advancedCheckPos.Y, advancedCheckPos.W, advancedCheckPos.H)
+	batchCheck.Resize(batchCheckPos.X, batchCheckPos.Y, batchCheckPos.W, batchCheckPos.H)
+	optionsScroll.Resize(optionsScrollPos.X, optionsScrollPos.Y, optionsScrollPos.W, optionsScrollPos.H)
+	resizeOptionsPanel()
 	fileTmplInput.Resize(fileTmplInputPos.X, fileTmplInputPos.Y, fileTmplInputPos.W, fileTmplInputPos.H)
+	filenamePreview.Resize(filenamePreviewPos.X, filenamePreviewPos.Y, filenamePreviewPos.W, filenamePreviewPos.H)
+	labelInput.Resize(labelInputPos.X, labelInputPos.Y, labelInputPos.W, labelInputPos.H)
+	collisionChoice.Resize(collisionChoicePos.X, collisionChoicePos.Y, collisionChoicePos.W, collisionChoicePos.H)
+	pageSizeChoice.Resize(pageSizeChoicePos.X, pageSizeChoicePos.Y, pageSizeChoicePos.W, pageSizeChoicePos.H)
+	appendCheck.Resize(appendCheckPos.X, appendCheckPos.Y, appendCheckPos.W, appendCheckPos.H)
 	activity.Resize(activityPos.X, activityPos.Y, activityPos.W, activityPos.H)
+	activityMenuBtn.Resize(activityMenuBtnPos.X, activityMenuBtnPos.Y, activityMenuBtnPos.W, activityMenuBtnPos.H)
+	progressBar.Resize(progressBarPos.X, progressBarPos.Y, progressBarPos.W, progressBarPos.H)
+	jobsBrowser.Resize(jobsBrowserPos.X, jobsBrowserPos.Y, jobsBrowserPos.W, jobsBrowserPos.H)
+	galleryScroll.Resize(galleryScrollPos.X, galleryScrollPos.Y, galleryScrollPos.W, galleryScrollPos.H)
+	rebuildGallery()
+	galleryOpenBtn.Resize(galleryOpenBtnPos.X, galleryOpenBtnPos.Y, galleryOpenBtnPos.W, galleryOpenBtnPos.H)
+	galleryRenameBtn.Resize(galleryRenameBtnPos.X, galleryRenameBtnPos.Y, galleryRenameBtnPos.W, galleryRenameBtnPos.H)
+	galleryDeleteBtn.Resize(galleryDeleteBtnPos.X, galleryDeleteBtnPos.Y, galleryDeleteBtnPos.W, galleryDeleteBtnPos.H)
+	galleryRescanBtn.Resize(galleryRescanBtnPos.X, galleryRescanBtnPos.Y, galleryRescanBtnPos.W, galleryRescanBtnPos.H)
+	galleryDirCheck.Resize(galleryDirCheckPos.X, galleryDirCheckPos.Y, galleryDirCheckPos.W, galleryDirCheckPos.H)
 }